@@ -23,11 +23,11 @@ case $eventType in
     echo "Timestamp: $timestamp"
     echo "ID: $id"
     echo "Camera Name: $camera_name"
-    # Add code here to handle motion_started events
+    # Add code here to handle motion_start events
     ;;
   "motion_end")
-    echo "Motion stopped event detected"
-    # Add code here to handle motion_stopped events
+    echo "Motion ended after $(echo "$json" | jq -r '.duration_seconds')s, clip: $(echo "$json" | jq -r '.clip_path')"
+    # Add code here to handle motion_end events
     ;;
   "motion_update")
     echo "Motion update event detected"
@@ -37,6 +37,34 @@ case $eventType in
     echo "Objects detected event detected"
     # Add code here to handle objects_detected events
     ;;
+  "analysis_fps_changed")
+    echo "Analysis fps changed from $(echo "$json" | jq -r '.old_fps') to $(echo "$json" | jq -r '.new_fps') on $camera_name"
+    # Add code here to handle analysis_fps_changed events
+    ;;
+  "zone_enter"|"zone_exit"|"zone_dwell")
+    echo "$(echo "$json" | jq -r '.class') #$(echo "$json" | jq -r '.track_id') $eventType $(echo "$json" | jq -r '.zone') on $camera_name after $(echo "$json" | jq -r '.dwell_seconds')s"
+    # Add code here to handle zone events
+    ;;
+  "line_crossed")
+    echo "$(echo "$json" | jq -r '.class') #$(echo "$json" | jq -r '.track_id') crossed $(echo "$json" | jq -r '.line') $(echo "$json" | jq -r '.direction') on $camera_name"
+    # Add code here to handle line_crossed events
+    ;;
+  "object_arrived"|"object_departed")
+    echo "$(echo "$json" | jq -r '.class') #$(echo "$json" | jq -r '.track_id') $eventType on $camera_name after $(echo "$json" | jq -r '.static_seconds')s"
+    # Add code here to handle parked objects
+    ;;
+  "schedule_changed")
+    echo "Schedule changed on $camera_name: $(echo "$json" | jq -r '.changed // [] | join(", ")')"
+    # Add code here to handle schedule_changed events
+    ;;
+  "error")
+    echo "Error in $(echo "$json" | jq -r '.source') of $camera_name: $(echo "$json" | jq -r '.message')"
+    # Add code here to handle error events
+    ;;
+  "config_reloaded")
+    echo "Config reloaded, changed: $(echo "$json" | jq -r '.changed | join(", ")')"
+    # Add code here to handle config_reloaded events
+    ;;
   *)
     echo "Unknown event type: $eventType"
     # Add code here to handle unknown event types
@@ -0,0 +1,127 @@
+// Package analysisRate decides which frames of a camera feed are analysed.
+// Frames arrive at a fixed target rate, the controller passes through a fraction of them. In adaptive mode the
+// fraction follows the rolling detector latency: it drops when analysis can't keep up with real time and recovers
+// when there is headroom again.
+package analysisRate
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	TargetFps float64       // Rate frames arrive at, also the upper limit
+	MinFps    float64       // Lower limit in adaptive mode, default 0.5 or TargetFps if that is lower
+	Adaptive  bool          // Follow the detector latency, otherwise every frame is accepted
+	Window    int           // Number of latency samples averaged before deciding, default 10
+	Cooldown  time.Duration // Minimum time between two changes, default 5s
+}
+
+// Change describes an adjustment of the analysis rate
+type Change struct {
+	OldFps  float64
+	NewFps  float64
+	Latency time.Duration // Rolling average that caused the change
+	Reason  string        // overloaded or recovered
+}
+
+type Controller struct {
+	config Config
+
+	mutex      sync.Mutex
+	fps        float64
+	credit     float64
+	latencies  []time.Duration
+	lastChange time.Time
+}
+
+func New(config Config) *Controller {
+	if config.MinFps <= 0 {
+		config.MinFps = 0.5
+	}
+	if config.MinFps > config.TargetFps {
+		config.MinFps = config.TargetFps
+	}
+	if config.Window <= 0 {
+		config.Window = 10
+	}
+	if config.Cooldown <= 0 {
+		config.Cooldown = 5 * time.Second
+	}
+	return &Controller{config: config, fps: config.TargetFps}
+}
+
+// Accept reports if the next arriving frame should be analysed
+func (c *Controller) Accept() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.fps >= c.config.TargetFps {
+		return true
+	}
+
+	// Spread accepted frames evenly over the incoming ones
+	c.credit += c.fps / c.config.TargetFps
+	if c.credit >= 1 {
+		c.credit--
+		return true
+	}
+	return false
+}
+
+// Observe records how long analysing a frame took and returns a change if the rate was adjusted
+func (c *Controller) Observe(latency time.Duration, now time.Time) (Change, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.config.Adaptive {
+		return Change{}, false
+	}
+
+	c.latencies = append(c.latencies, latency)
+	if len(c.latencies) > c.config.Window {
+		c.latencies = c.latencies[1:]
+	}
+	if len(c.latencies) < c.config.Window || now.Sub(c.lastChange) < c.config.Cooldown {
+		return Change{}, false
+	}
+
+	var sum time.Duration
+	for _, l := range c.latencies {
+		sum += l
+	}
+	avg := sum / time.Duration(len(c.latencies))
+	budget := time.Duration(float64(time.Second) / c.fps)
+
+	change := Change{OldFps: c.fps, Latency: avg}
+	switch {
+	case avg > budget*9/10 && c.fps > c.config.MinFps:
+		// Step down, straight to a rate that fits the latency if that is lower
+		change.NewFps = math.Max(c.config.MinFps, math.Min(c.fps*0.75, 0.8/avg.Seconds()))
+		change.Reason = "overloaded"
+	case avg < budget/2 && c.fps < c.config.TargetFps:
+		change.NewFps = math.Min(c.config.TargetFps, c.fps*1.25)
+		change.Reason = "recovered"
+	default:
+		return Change{}, false
+	}
+
+	c.fps = change.NewFps
+	c.credit = 0
+	c.latencies = nil
+	c.lastChange = now
+	return change, true
+}
+
+// Fps returns the current analysis rate
+func (c *Controller) Fps() float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.fps
+}
+
+// TargetFps returns the configured analysis rate
+func (c *Controller) TargetFps() float64 {
+	return c.config.TargetFps
+}
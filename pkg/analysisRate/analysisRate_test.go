@@ -0,0 +1,82 @@
+package analysisRate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFixedRateAcceptsEverything(t *testing.T) {
+	c := New(Config{TargetFps: 5})
+	for i := 0; i < 20; i++ {
+		if _, changed := c.Observe(time.Second, time.Unix(int64(i*10), 0)); changed {
+			t.Fatal("Rate must not change when adaptive mode is off")
+		}
+		if !c.Accept() {
+			t.Fatalf("Frame %d was dropped", i)
+		}
+	}
+}
+
+func TestAdaptiveDropsAndRecovers(t *testing.T) {
+	c := New(Config{TargetFps: 4, Adaptive: true, Window: 3, Cooldown: time.Second})
+	now := time.Unix(0, 0)
+
+	// 400ms per frame doesn't fit the 250ms budget at 4fps
+	var change Change
+	var changed bool
+	for i := 0; i < 3; i++ {
+		change, changed = c.Observe(400*time.Millisecond, now)
+	}
+	if !changed || change.Reason != "overloaded" {
+		t.Fatalf("Expected the rate to drop, got %+v %v", change, changed)
+	}
+	if change.NewFps != 2 {
+		t.Errorf("Expected 2fps (0.8/0.4s), got %v", change.NewFps)
+	}
+
+	// At 2 of 4 fps every other frame is analysed
+	accepted := 0
+	for i := 0; i < 8; i++ {
+		if c.Accept() {
+			accepted++
+		}
+	}
+	if accepted != 4 {
+		t.Errorf("Expected 4 of 8 frames accepted, got %d", accepted)
+	}
+
+	// Nothing changes during the cooldown
+	for i := 0; i < 3; i++ {
+		if _, changed := c.Observe(10*time.Millisecond, now.Add(500*time.Millisecond)); changed {
+			t.Fatal("Rate changed during the cooldown")
+		}
+	}
+
+	// Fast inference brings the rate back up to the target
+	now = now.Add(2 * time.Second)
+	for c.Fps() < 4 {
+		changed := false
+		for i := 0; i < 3 && !changed; i++ {
+			change, changed = c.Observe(10*time.Millisecond, now)
+		}
+		if !changed || change.Reason != "recovered" {
+			t.Fatalf("Expected the rate to recover, got %+v %v", change, changed)
+		}
+		now = now.Add(2 * time.Second)
+	}
+	if c.Fps() != 4 {
+		t.Errorf("Rate must not go above the target, got %v", c.Fps())
+	}
+}
+
+func TestAdaptiveStopsAtMinimum(t *testing.T) {
+	c := New(Config{TargetFps: 2, MinFps: 1, Adaptive: true, Window: 1, Cooldown: time.Second})
+	now := time.Unix(0, 0)
+	for i := 0; i < 5; i++ {
+		c.Observe(5*time.Second, now)
+		now = now.Add(2 * time.Second)
+	}
+	if c.Fps() != 1 {
+		t.Errorf("Expected the rate to stop at 1fps, got %v", c.Fps())
+	}
+}
@@ -0,0 +1,161 @@
+// Package counters keeps line crossing counts by camera, line, class and direction in hourly and daily buckets.
+// A store is persisted as a JSON file after every change so counts survive restarts, the serve API reads the
+// same file.
+package counters
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FileName is the name of the counters file in a recordings folder
+const FileName = "counters.json"
+
+// Buckets older than this are dropped
+var (
+	hourlyRetention = 7 * 24 * time.Hour
+	dailyRetention  = 366 * 24 * time.Hour
+)
+
+const (
+	hourFormat = "2006-01-02T15"
+	dayFormat  = "2006-01-02"
+)
+
+type Counter struct {
+	Camera    string         `json:"camera"`
+	Line      string         `json:"line"`
+	Class     string         `json:"class"`
+	Direction string         `json:"direction"`
+	Total     int            `json:"total"`
+	Hourly    map[string]int `json:"hourly"` // By local hour, eg: 2023-08-14T20
+	Daily     map[string]int `json:"daily"`  // By local day, eg: 2023-08-14
+}
+
+type Store struct {
+	mutex    sync.Mutex
+	path     string
+	counters []*Counter
+}
+
+// Open loads the counters file at path, a missing file starts empty
+func Open(path string) (*Store, error) {
+	counters, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	store := &Store{path: path}
+	for i := range counters {
+		store.counters = append(store.counters, &counters[i])
+	}
+	return store, nil
+}
+
+// Load reads the counters file at path without opening it for changes
+func Load(path string) ([]Counter, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var counters []Counter
+	if err := json.Unmarshal(data, &counters); err != nil {
+		return nil, fmt.Errorf("error parsing counters file %s: %w", path, err)
+	}
+	return counters, nil
+}
+
+// Add counts one crossing at the given time and saves the store
+func (s *Store) Add(camera, line, class, direction string, at time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var counter *Counter
+	for _, c := range s.counters {
+		if c.Camera == camera && c.Line == line && c.Class == class && c.Direction == direction {
+			counter = c
+			break
+		}
+	}
+	if counter == nil {
+		counter = &Counter{Camera: camera, Line: line, Class: class, Direction: direction, Hourly: make(map[string]int), Daily: make(map[string]int)}
+		s.counters = append(s.counters, counter)
+		sort.Slice(s.counters, func(i, j int) bool { return s.counters[i].key() < s.counters[j].key() })
+	}
+
+	at = at.Local()
+	counter.Total++
+	counter.Hourly[at.Format(hourFormat)]++
+	counter.Daily[at.Format(dayFormat)]++
+	prune(counter.Hourly, hourFormat, at.Add(-hourlyRetention))
+	prune(counter.Daily, dayFormat, at.Add(-dailyRetention))
+
+	return s.save()
+}
+
+// Counters returns a copy of all counters
+func (s *Store) Counters() []Counter {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	counters := make([]Counter, len(s.counters))
+	for i, c := range s.counters {
+		counters[i] = *c
+		counters[i].Hourly = copyBuckets(c.Hourly)
+		counters[i].Daily = copyBuckets(c.Daily)
+	}
+	return counters
+}
+
+// save writes to a temporary file first so a crash doesn't leave a truncated file behind
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.counters, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".counters-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (c *Counter) key() string {
+	return c.Camera + "\x00" + c.Line + "\x00" + c.Class + "\x00" + c.Direction
+}
+
+// prune drops buckets that started before cutoff
+func prune(buckets map[string]int, format string, cutoff time.Time) {
+	for bucket := range buckets {
+		start, err := time.ParseInLocation(format, bucket, time.Local)
+		if err != nil || start.Before(cutoff) {
+			delete(buckets, bucket)
+		}
+	}
+}
+
+func copyBuckets(buckets map[string]int) map[string]int {
+	copied := make(map[string]int, len(buckets))
+	for bucket, count := range buckets {
+		copied[bucket] = count
+	}
+	return copied
+}
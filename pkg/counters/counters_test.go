@@ -0,0 +1,59 @@
+package counters
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCountsSurviveReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), FileName)
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2023, 8, 14, 20, 30, 0, 0, time.Local)
+	for _, at := range []time.Time{now, now.Add(10 * time.Minute), now.Add(time.Hour), now.Add(-8 * 24 * time.Hour)} {
+		if err := store.Add("front", "gate", "car", "in", at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Add("front", "gate", "person", "out", now); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counters := reopened.Counters()
+	if len(counters) != 2 {
+		t.Fatalf("Expected 2 counters, got %v", counters)
+	}
+	car := counters[0]
+	if car.Class != "car" || car.Total != 4 {
+		t.Fatalf("Expected 4 cars in total, got %+v", car)
+	}
+	if car.Hourly["2023-08-14T20"] != 2 || car.Hourly["2023-08-14T21"] != 1 || car.Daily["2023-08-14"] != 3 {
+		t.Errorf("Unexpected buckets: %v %v", car.Hourly, car.Daily)
+	}
+	if car.Daily["2023-08-06"] != 1 {
+		t.Errorf("Expected the old day to be kept, got %v", car.Daily)
+	}
+
+	// Retention is relative to the crossing being added, the old hour goes with the next recent one
+	if err := reopened.Add("front", "gate", "car", "in", now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reopened.Counters()[0].Hourly["2023-08-06T20"]; ok {
+		t.Error("Expected hours older than the retention to be dropped")
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	counters, err := Load(filepath.Join(t.TempDir(), FileName))
+	if err != nil || counters != nil {
+		t.Errorf("Expected no counters and no error, got %v, %v", counters, err)
+	}
+}
@@ -0,0 +1,85 @@
+package detector
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"sort"
+	"sync"
+)
+
+// Prediction is a single object found in a frame. Coordinates are in pixels of the image passed to Detect.
+type Prediction struct {
+	Object     int       `json:"object"`
+	ClassName  string    `json:"class_name"`
+	Box        []float32 `json:"box"`
+	Top        int       `json:"top"`
+	Bottom     int       `json:"bottom"`
+	Left       int       `json:"left"`
+	Right      int       `json:"right"`
+	Confidence float32   `json:"confidence"`
+	Took       float64   `json:"took"`
+}
+
+// Detector is implemented by every object detection backend.
+// Implementations must be safe for concurrent use, one detector is shared by all cameras.
+type Detector interface {
+	// Start prepares the backend (load a model, connect to a server...) and returns once it is ready to Detect
+	Start(ctx context.Context) error
+	// Detect returns all objects found in img
+	Detect(ctx context.Context, img image.Image) ([]Prediction, error)
+	// Close releases everything held by the backend
+	Close() error
+}
+
+// Config selects and configures a backend
+type Config struct {
+	Backend          string            // Name of a registered backend: onnx, network, mock or a custom one
+	OnnxModel        string            // onnx: embedded model name, eg: yolov8n
+	OnnxEnableCoreMl bool              // onnx: use CoreML execution provider
+	NetworkAddr      string            // network: addr of the object detection server, eg: 127.0.0.1:8555
+	MockPredictions  [][]Prediction    // mock: predictions returned by consecutive Detect calls, wraps around
+	Options          map[string]string // Free form options for custom backends
+}
+
+// Factory creates a detector from a config
+type Factory func(cfg Config) (Detector, error)
+
+var backendsMutex sync.RWMutex
+var backends = map[string]Factory{
+	"onnx":    NewOnnx,
+	"network": NewNetwork,
+	"mock":    NewMock,
+}
+
+// Register makes a backend available to New under the given name, registering an existing name replaces it
+func Register(name string, factory Factory) {
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+	backends[name] = factory
+}
+
+// Backends returns the names of all registered backends
+func Backends() []string {
+	backendsMutex.RLock()
+	defer backendsMutex.RUnlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates the detector selected by cfg.Backend, it still has to be started
+func New(cfg Config) (Detector, error) {
+	backendsMutex.RLock()
+	factory, ok := backends[cfg.Backend]
+	backendsMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown detector backend: %q, available: %v", cfg.Backend, Backends())
+	}
+
+	return factory(cfg)
+}
@@ -0,0 +1,126 @@
+package detector
+
+import (
+	"context"
+	"errors"
+	"image"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMockIsDeterministic(t *testing.T) {
+	d, err := New(Config{
+		Backend: "mock",
+		MockPredictions: [][]Prediction{
+			{{ClassName: "person", Box: []float32{10, 20, 30, 40}, Confidence: 0.9}},
+			{},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error creating mock: %v", err)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for i := 0; i < 4; i++ {
+		preds, err := d.Detect(context.Background(), img)
+		if err != nil {
+			t.Fatalf("Unexpected error on call %d: %v", i, err)
+		}
+
+		if i%2 == 1 {
+			if len(preds) != 0 {
+				t.Errorf("Call %d: expected no predictions, got %v", i, preds)
+			}
+			continue
+		}
+
+		if len(preds) != 1 {
+			t.Fatalf("Call %d: expected 1 prediction, got %d", i, len(preds))
+		}
+		p := preds[0]
+		if p.Left != 10 || p.Top != 20 || p.Right != 30 || p.Bottom != 40 {
+			t.Errorf("Call %d: box not converted to coordinates: %+v", i, p)
+		}
+
+		// Changing the result must not leak into the next round
+		preds[0].Box[0] = 99
+	}
+}
+
+func TestUnknownBackend(t *testing.T) {
+	if _, err := New(Config{Backend: "nope"}); err == nil {
+		t.Error("Expected an error for an unknown backend")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	Register("test", NewMock)
+	if _, err := New(Config{Backend: "test"}); err != nil {
+		t.Errorf("Unexpected error for a registered backend: %v", err)
+	}
+}
+
+func TestUnletterbox(t *testing.T) {
+	tests := []struct {
+		x, y         float32
+		bounds       image.Rectangle
+		wantX, wantY float32
+	}{
+		// 1280x720 is scaled by 0.5 to 640x360 and padded by 140 on top
+		{x: 0, y: 140, bounds: image.Rect(0, 0, 1280, 720), wantX: 0, wantY: 0},
+		{x: 320, y: 320, bounds: image.Rect(0, 0, 1280, 720), wantX: 640, wantY: 360},
+		{x: 640, y: 500, bounds: image.Rect(0, 0, 1280, 720), wantX: 1280, wantY: 720},
+		// Points in the padding are clamped to the frame
+		{x: 10, y: 5, bounds: image.Rect(0, 0, 1280, 720), wantX: 20, wantY: 0},
+		// Square frames are only scaled
+		{x: 320, y: 160, bounds: image.Rect(0, 0, 320, 320), wantX: 160, wantY: 80},
+	}
+
+	for _, test := range tests {
+		x, y := unletterbox(test.x, test.y, test.bounds, 640, 640)
+		if x != test.wantX || y != test.wantY {
+			t.Errorf("unletterbox(%v, %v, %v) = %v, %v, expected %v, %v", test.x, test.y, test.bounds, x, y, test.wantX, test.wantY)
+		}
+	}
+}
+
+func TestNetworkDetectReturnsOnCancel(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening: %v", err)
+	}
+	defer listener.Close()
+	// Reads the frames and never replies
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+
+	d, err := New(Config{Backend: "network", NetworkAddr: listener.Addr().String()})
+	if err != nil {
+		t.Fatalf("Unexpected error creating detector: %v", err)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := d.Detect(ctx, img); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the detection to be cancelled, got %v", err)
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("Expected Detect to return soon after cancel, took %s", took)
+	}
+
+	// Cancelled before it runs
+	if _, err := d.Detect(ctx, img); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a cancelled context to skip detection, got %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package detector
+
+import (
+	"context"
+	"image"
+	"sync"
+)
+
+// Mock returns a fixed sequence of predictions, one entry per Detect call, wrapping around at the end.
+// It needs no model and is deterministic, which makes it useful for tests and for trying out a config.
+type Mock struct {
+	mutex       sync.Mutex
+	predictions [][]Prediction
+	calls       int
+}
+
+func NewMock(cfg Config) (Detector, error) {
+	return &Mock{predictions: cfg.MockPredictions}, nil
+}
+
+func (d *Mock) Start(ctx context.Context) error {
+	return nil
+}
+
+func (d *Mock) Detect(ctx context.Context, img image.Image) ([]Prediction, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(d.predictions) == 0 {
+		return nil, nil
+	}
+
+	step := d.predictions[d.calls%len(d.predictions)]
+	d.calls++
+
+	// Hand out a copy so callers can't change the sequence
+	predictions := make([]Prediction, len(step))
+	for i, pred := range step {
+		if len(pred.Box) == 4 {
+			pred.Left, pred.Top, pred.Right, pred.Bottom = int(pred.Box[0]), int(pred.Box[1]), int(pred.Box[2]), int(pred.Box[3])
+		}
+		pred.Box = append([]float32(nil), pred.Box...)
+		predictions[i] = pred
+	}
+	return predictions, nil
+}
+
+func (d *Mock) Close() error {
+	return nil
+}
@@ -0,0 +1,152 @@
+package detector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net"
+	"sync"
+	"time"
+)
+
+// Network sends frames to an object detection server over TCP, eg: one of the embedded python scripts.
+// Every request is a 4 byte big endian size followed by a JPEG, the reply is a JSON array of predictions terminated by a newline.
+type Network struct {
+	mutex sync.Mutex
+	addr  string
+	conn  net.Conn
+}
+
+func NewNetwork(cfg Config) (Detector, error) {
+	if cfg.NetworkAddr == "" {
+		return nil, fmt.Errorf("network detector requires an address")
+	}
+	return &Network{addr: cfg.NetworkAddr}, nil
+}
+
+// Start waits until the server accepts connections
+func (d *Network) Start(ctx context.Context) error {
+	for {
+		conn, err := net.DialTimeout("tcp", d.addr, 1*time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for %s to respond: %w", d.addr, err)
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+func (d *Network) Detect(ctx context.Context, img image.Image) ([]Prediction, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if err := ctx.Err(); err != nil { // Cancelled while waiting for the previous frame
+		return nil, err
+	}
+
+	// Start timer
+	start := time.Now()
+
+	// Convert the image to a byte array
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		return nil, err
+	}
+	imgData := buf.Bytes()
+
+	// Check if connection is nil and re-establish it if needed
+	if d.conn == nil {
+		dialer := net.Dialer{}
+		conn, err := dialer.DialContext(ctx, "tcp", d.addr)
+		if err != nil {
+			return nil, err
+		}
+		d.conn = conn
+	}
+
+	deadline := time.Now().Add(60 * time.Second)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	// Cancelling ctx unblocks a server that doesn't reply
+	conn := d.conn
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	preds, err := d.roundTrip(imgData, deadline)
+	if !stop() {
+		err = ctx.Err() // The deadline may be set after this returns, the connection can't be reused
+	}
+	if err != nil {
+		// Drop the connection, the next call reconnects
+		d.conn.Close()
+		d.conn = nil
+		return nil, err
+	}
+
+	for i, pred := range preds {
+		if len(pred.Box) != 4 {
+			return nil, fmt.Errorf("invalid box in prediction: %v", pred.Box)
+		}
+		preds[i].Top = int(pred.Box[1])
+		preds[i].Bottom = int(pred.Box[3])
+		preds[i].Left = int(pred.Box[0])
+		preds[i].Right = int(pred.Box[2])
+		preds[i].Took = float64(time.Since(start).Milliseconds())
+	}
+
+	return preds, nil
+}
+
+func (d *Network) roundTrip(imgData []byte, deadline time.Time) ([]Prediction, error) {
+	if err := d.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	// Send the size of the image data
+	sizeBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(sizeBytes, uint32(len(imgData)))
+	if _, err := d.conn.Write(sizeBytes); err != nil {
+		return nil, err
+	}
+
+	// Send the image data
+	if _, err := d.conn.Write(imgData); err != nil {
+		return nil, err
+	}
+
+	// Read the response
+	reader := bufio.NewReader(d.conn)
+	respData, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the response data as a Prediction
+	var preds []Prediction
+	if err := json.Unmarshal(respData, &preds); err != nil {
+		return nil, err
+	}
+
+	return preds, nil
+}
+
+func (d *Network) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.conn != nil {
+		err := d.conn.Close()
+		d.conn = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package detector
+
+import (
+	"context"
+	"errors"
+	"image"
+	"math"
+	"sync"
+	"time"
+
+	ob "github.com/8ff/firescrew/pkg/objectPredict"
+)
+
+// Onnx runs one of the models embedded in objectPredict in process
+type Onnx struct {
+	mutex  sync.Mutex
+	config ob.Config
+	client *ob.Client
+}
+
+func NewOnnx(cfg Config) (Detector, error) {
+	return &Onnx{config: ob.Config{Model: cfg.OnnxModel, EnableCoreMl: cfg.OnnxEnableCoreMl}}, nil
+}
+
+func (d *Onnx) Start(ctx context.Context) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	client, err := ob.Init(d.config)
+	if err != nil {
+		return err
+	}
+	d.client = client
+	return nil
+}
+
+func (d *Onnx) Detect(ctx context.Context, img image.Image) ([]Prediction, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.client == nil {
+		return nil, errors.New("onnx detector is not started")
+	}
+	// Inference can't be interrupted, a cancelled ctx only stops calls waiting for the mutex
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	timer := time.Now()
+	objects, _, err := d.client.Predict(img)
+	if err != nil {
+		return nil, err
+	}
+	took := float64(time.Since(timer).Milliseconds())
+
+	// The model sees a letterboxed copy of the frame, map boxes back to frame pixels
+	predictions := make([]Prediction, 0, len(objects))
+	for _, object := range objects {
+		x1, y1 := unletterbox(object.X1, object.Y1, img.Bounds(), d.client.ModelWidth, d.client.ModelHeight)
+		x2, y2 := unletterbox(object.X2, object.Y2, img.Bounds(), d.client.ModelWidth, d.client.ModelHeight)
+		predictions = append(predictions, Prediction{
+			Object:     object.ClassID,
+			ClassName:  object.ClassName,
+			Box:        []float32{x1, y1, x2, y2},
+			Top:        int(y1),
+			Bottom:     int(y2),
+			Left:       int(x1),
+			Right:      int(x2),
+			Confidence: object.Confidence,
+			Took:       took,
+		})
+	}
+
+	return predictions, nil
+}
+
+func (d *Onnx) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.client != nil {
+		d.client.Close()
+		d.client = nil
+	}
+	return nil
+}
+
+// unletterbox maps a point of the padded model input back onto the original frame, same math as objectPredict.prepareInput
+func unletterbox(x, y float32, bounds image.Rectangle, modelWidth, modelHeight int) (float32, float32) {
+	ratio := math.Min(float64(modelWidth)/float64(bounds.Dx()), float64(modelHeight)/float64(bounds.Dy()))
+	dx := (modelWidth - int(float64(bounds.Dx())*ratio)) / 2
+	dy := (modelHeight - int(float64(bounds.Dy())*ratio)) / 2
+
+	fx := (float64(x)-float64(dx))/ratio + float64(bounds.Min.X)
+	fy := (float64(y)-float64(dy))/ratio + float64(bounds.Min.Y)
+
+	// Clamp to the frame, boxes can spill into the padding
+	fx = math.Max(float64(bounds.Min.X), math.Min(fx, float64(bounds.Max.X)))
+	fy = math.Max(float64(bounds.Min.Y), math.Min(fy, float64(bounds.Max.Y)))
+
+	return float32(fx), float32(fy)
+}
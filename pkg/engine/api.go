@@ -0,0 +1,184 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/8ff/firescrew/pkg/outbox"
+)
+
+// CameraStatus is the runtime state of a camera as served by the API
+type CameraStatus struct {
+	CameraName          string               `json:"camera_name"`
+	Armed               ArmState             `json:"armed"`
+	MotionTriggered     bool                 `json:"motion_triggered"`
+	MotionTriggeredLast time.Time            `json:"motion_triggered_last"`
+	EventID             string               `json:"event_id"`         // Motion event running right now, empty if there is none
+	ManualRecording     bool                 `json:"manual_recording"` // The event is held open by record_start
+	Inference           *InferenceStatsEvent `json:"inference"`        // Last inference_avg of the camera, null before the first one
+}
+
+// Status returns the runtime state of every camera
+func (e *Engine) Status() []CameraStatus {
+	e.mutex.RLock()
+	cameras := e.cameras
+	e.mutex.RUnlock()
+
+	status := make([]CameraStatus, 0, len(cameras))
+	for _, camera := range cameras {
+		status = append(status, camera.status())
+	}
+	return status
+}
+
+func (c *Camera) status() CameraStatus {
+	status := CameraStatus{CameraName: c.Config.CameraName, Armed: c.armState()}
+
+	c.MotionMutex.Lock()
+	status.EventID = c.MotionVideo.ID
+	status.MotionTriggered = c.MotionVideo.ID != ""
+	status.MotionTriggeredLast = c.MotionTriggeredLast
+	status.ManualRecording = c.manual
+	c.MotionMutex.Unlock()
+
+	c.statsMutex.Lock()
+	status.Inference = c.lastInference
+	c.statsMutex.Unlock()
+	return status
+}
+
+// Paths below /api/cameras/<name>/ that run a command, they have to be POSTed
+var commandPaths = map[string]string{
+	"arm":          CommandArm,
+	"disarm":       CommandDisarm,
+	"schedule":     CommandSchedule,
+	"record/start": CommandRecordStart,
+	"record/stop":  CommandRecordStop,
+}
+
+// apiResponse is the JSON every API endpoint but the snapshot answers with
+type apiResponse struct {
+	Success bool           `json:"success"`
+	Error   string         `json:"error"`
+	Cameras []CameraStatus `json:"cameras,omitempty"`
+	Camera  *CameraStatus  `json:"camera,omitempty"`
+	EventID string         `json:"event_id,omitempty"`
+
+	Delivery map[string]outbox.Stats `json:"delivery,omitempty"` // Delivery counters of the config sinks, only in the status
+}
+
+// startApi serves the API on addr until Stop
+func (e *Engine) startApi(addr string) {
+	e.api = &http.Server{
+		Addr:         addr,
+		Handler:      e.apiHandler(),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 2 * controlTimeout,
+	}
+	go func(server *http.Server) {
+		Log("info", fmt.Sprintf("Serving API on %s", addr))
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			Log("error", fmt.Sprintf("API stopped: %v", err))
+		}
+	}(e.api)
+}
+
+func (e *Engine) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/status", e.statusHandler)
+	mux.HandleFunc("/api/cameras/", e.cameraHandler)
+	return mux
+}
+
+// authorized checks the api.token of a request, given as bearer token or token parameter. Without api.token
+// only the status can be read.
+func (e *Engine) authorized(w http.ResponseWriter, r *http.Request, control bool) bool {
+	token := e.Config().Api.Token
+	if token == "" {
+		if control {
+			writeApiResponse(w, http.StatusForbidden, apiResponse{Error: "set api.token to enable the control API"})
+			return false
+		}
+		return true
+	}
+
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		given = r.URL.Query().Get("token")
+	}
+	if !validToken(given, token) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeApiResponse(w, http.StatusUnauthorized, apiResponse{Error: "invalid token"})
+		return false
+	}
+	return true
+}
+
+func (e *Engine) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if !e.authorized(w, r, false) {
+		return
+	}
+	writeApiResponse(w, http.StatusOK, apiResponse{Success: true, Cameras: e.Status(), Delivery: e.DeliveryStatus()})
+}
+
+// cameraHandler serves /api/cameras/<name>, <name>/snapshot.jpg and the command paths
+func (e *Engine) cameraHandler(w http.ResponseWriter, r *http.Request) {
+	rawName, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/cameras/"), "/")
+	name, err := url.PathUnescape(rawName)
+	if err != nil {
+		writeApiResponse(w, http.StatusBadRequest, apiResponse{Error: err.Error()})
+		return
+	}
+	command, isCommand := commandPaths[action]
+	if !e.authorized(w, r, action != "") {
+		return
+	}
+
+	camera := e.camera(name)
+	if camera == nil {
+		writeApiResponse(w, http.StatusNotFound, apiResponse{Error: fmt.Sprintf("%v %s", ErrUnknownCamera, name)})
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		status := camera.status()
+		writeApiResponse(w, http.StatusOK, apiResponse{Success: true, Camera: &status})
+	case action == "snapshot.jpg" && r.Method == http.MethodGet:
+		data, err := e.Snapshot(name)
+		if err != nil {
+			writeApiResponse(w, http.StatusServiceUnavailable, apiResponse{Error: err.Error()})
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(data)
+	case isCommand && r.Method == http.MethodPost:
+		eventID, err := e.Control(name, command)
+		if err != nil {
+			code := http.StatusServiceUnavailable // The frame loop didn't answer
+			if errors.Is(err, errNoManualRecording) {
+				code = http.StatusConflict
+			}
+			writeApiResponse(w, code, apiResponse{Error: err.Error()})
+			return
+		}
+		Log("info", fmt.Sprintf("[%s] Ran API command %s", name, command))
+		status := camera.status()
+		writeApiResponse(w, http.StatusOK, apiResponse{Success: true, Camera: &status, EventID: eventID})
+	case action == "" || action == "snapshot.jpg" || isCommand:
+		writeApiResponse(w, http.StatusMethodNotAllowed, apiResponse{Error: fmt.Sprintf("%s is not allowed", r.Method)})
+	default:
+		writeApiResponse(w, http.StatusNotFound, apiResponse{Error: fmt.Sprintf("unknown path %s", r.URL.Path)})
+	}
+}
+
+func writeApiResponse(w http.ResponseWriter, code int, response apiResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,188 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/8ff/firescrew/pkg/events"
+	"github.com/8ff/firescrew/pkg/schedule"
+)
+
+// Sinks of the config that can be armed by a schedule, sinks passed in Options always get every event
+var notificationSinks = []string{"webhook", "script", "slack", "mqtt", "pushover"}
+
+var scheduleCheckInterval = time.Second // How often cameras look if their schedules changed
+
+// ArmConfig names the schedules that arm the parts of a camera. Empty or always is always armed, never disarms it.
+type ArmConfig struct {
+	Detection     string            `json:"detection"`     // Object detection, no events are triggered while it is disarmed
+	Recording     string            `json:"recording"`     // Clips, snapshots and metadata of events, events are still sent while it is disarmed
+	Notifications map[string]string `json:"notifications"` // By sink: webhook, script, slack, mqtt or pushover
+}
+
+// ArmState is what the schedules of a camera arm at a point in time
+type ArmState events.ArmState
+
+// changes returns what differs between two states, eg: detection or notifications.mqtt
+func (state ArmState) changes(old ArmState) []string {
+	var changed []string
+	if state.Override != old.Override {
+		changed = append(changed, "override")
+	}
+	if state.Detection != old.Detection {
+		changed = append(changed, "detection")
+	}
+	if state.Recording != old.Recording {
+		changed = append(changed, "recording")
+	}
+	for _, sink := range notificationSinks {
+		if state.Notifications[sink] != old.Notifications[sink] {
+			changed = append(changed, "notifications."+sink)
+		}
+	}
+	return changed
+}
+
+// armedSummary lists what is armed for the log, eg: detection, recording, mqtt
+func (state ArmState) armedSummary() string {
+	var armed []string
+	if state.Detection {
+		armed = append(armed, "detection")
+	}
+	if state.Recording {
+		armed = append(armed, "recording")
+	}
+	for _, sink := range notificationSinks {
+		if state.Notifications[sink] {
+			armed = append(armed, sink)
+		}
+	}
+	if len(armed) == 0 {
+		return "nothing"
+	}
+	return strings.Join(armed, ", ")
+}
+
+// armAll arms or disarms everything
+func armAll(armed bool) ArmState {
+	state := ArmState{Detection: armed, Recording: armed, Notifications: make(map[string]bool)}
+	for _, sink := range notificationSinks {
+		state.Notifications[sink] = armed
+	}
+	return state
+}
+
+// usesSchedules reports if anything of the camera depends on a schedule
+func (arm ArmConfig) usesSchedules() bool {
+	if (arm.Detection != "" && arm.Detection != "always") || (arm.Recording != "" && arm.Recording != "always") {
+		return true
+	}
+	for _, name := range arm.Notifications {
+		if name != "" && name != "always" {
+			return true
+		}
+	}
+	return false
+}
+
+// compileSchedules prepares the schedules of a validated config
+func compileSchedules(config Config) map[string]*schedule.Schedule {
+	schedules := make(map[string]*schedule.Schedule)
+	for name, scheduleConfig := range config.Schedules {
+		s, err := schedule.New(scheduleConfig)
+		if err != nil {
+			Log("error", fmt.Sprintf("Schedule %s: %v", name, err))
+			continue
+		}
+		schedules[name] = s
+	}
+	return schedules
+}
+
+// armState evaluates arm at now
+func (e *Engine) armState(arm ArmConfig, now time.Time) ArmState {
+	e.mutex.RLock()
+	schedules := e.schedules
+	e.mutex.RUnlock()
+
+	active := func(name string) bool {
+		switch name {
+		case "", "always":
+			return true
+		case "never":
+			return false
+		}
+		s, ok := schedules[name]
+		return ok && s.Active(now)
+	}
+
+	state := ArmState{Detection: active(arm.Detection), Recording: active(arm.Recording), Notifications: make(map[string]bool)}
+	for _, sink := range notificationSinks {
+		state.Notifications[sink] = active(arm.Notifications[sink])
+	}
+	return state
+}
+
+// armState returns what is armed for the camera right now
+func (c *Camera) armState() ArmState {
+	c.armMutex.Lock()
+	defer c.armMutex.Unlock()
+	return c.armed
+}
+
+// updateArmState evaluates the schedules and the override of the camera and sends schedule_changed when the state changed.
+// The state at startup is only sent if the camera uses schedules.
+func (c *Camera) updateArmState(now time.Time, startup bool) {
+	var arm ArmConfig
+	for _, camera := range c.engine.Config().Cameras {
+		if camera.CameraName == c.Config.CameraName {
+			arm = camera.Arm
+		}
+	}
+	state := c.engine.armState(arm, now)
+
+	c.armMutex.Lock()
+	switch c.armOverride {
+	case "armed":
+		state = armAll(true)
+	case "disarmed":
+		state = armAll(false)
+	}
+	state.Override = c.armOverride
+	changed := state.changes(c.armed)
+	c.armed = state
+	c.armMutex.Unlock()
+
+	if startup || len(changed) > 0 {
+		c.engine.homeAssistant.armed(c.Config.CameraName, state)
+	}
+	if startup && !arm.usesSchedules() || !startup && len(changed) == 0 {
+		return
+	}
+	if startup {
+		changed = []string{}
+	}
+
+	Log("notice", fmt.Sprintf("[%s] Schedule armed: %s", c.Config.CameraName, state.armedSummary()))
+	c.engine.emit(EventScheduleChanged, c.Config.CameraName, ScheduleChangedEvent{
+		Header:  events.NewHeader(EventScheduleChanged, c.Config.CameraName, now),
+		Armed:   events.ArmState(state),
+		Changed: changed,
+	})
+}
+
+// watchSchedules keeps the arm state of the camera current until ctx is done
+func (c *Camera) watchSchedules(ctx context.Context) {
+	for sleepContext(ctx, scheduleCheckInterval) {
+		c.updateArmState(time.Now(), false)
+	}
+}
+
+// validArmName reports if name can be used in an arm setting
+func validArmName(name string, schedules map[string]schedule.Config) bool {
+	_, ok := schedules[name]
+	return ok || slices.Contains([]string{"", "always", "never"}, name)
+}
@@ -0,0 +1,1086 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/8ff/firescrew/pkg/analysisRate"
+	"github.com/8ff/firescrew/pkg/detector"
+	"github.com/8ff/firescrew/pkg/events"
+	"github.com/8ff/firescrew/pkg/frameQueue"
+	"github.com/8ff/firescrew/pkg/motion"
+	ob "github.com/8ff/firescrew/pkg/objectPredict"
+	"github.com/8ff/firescrew/pkg/tracker"
+	"github.com/8ff/prettyTimer"
+	"github.com/hybridgroup/mjpeg"
+)
+
+type InferenceStats struct {
+	Avg     float64
+	Min     float64
+	Max     float64
+	Latency float64 // Ingest to decision
+}
+
+type TrackedObject struct {
+	TrackID    int // Same for every detection of an object while it is tracked, unique per camera
+	BBox       image.Rectangle
+	Center     image.Point
+	Area       float64
+	LastMoved  time.Time
+	Class      string
+	Confidence float32
+	Zones      []string // Names of the zones the object was in when it was detected
+	Static     bool     // The object stays put, like a parked car. Static objects don't trigger events
+}
+
+// TrackSummary holds the detections of one tracked object during an event
+type TrackSummary struct {
+	TrackID    int
+	Class      string
+	FirstSeen  time.Time
+	LastSeen   time.Time
+	Detections []TrackDetection
+}
+
+type TrackDetection struct {
+	Time       time.Time
+	BBox       image.Rectangle
+	Confidence float32
+	Zones      []string
+	Static     bool
+}
+
+type VideoMetadata struct {
+	ID           string
+	MotionStart  time.Time
+	MotionEnd    time.Time
+	Objects      []TrackedObject
+	Tracks       []TrackSummary // Every detection of the event, grouped by track
+	ZoneEvents   []ZoneEvent
+	RecodedToMp4 bool
+	Snapshots    []string
+	VideoFile    string
+	CameraName   string
+	Manual       bool // Recorded on request of the control API
+}
+
+// TODO ADD MUTEX LOCK
+// Camera holds the runtime state of a single camera pipeline
+type Camera struct {
+	engine              *Engine
+	Config              CameraConfig
+	MotionTriggeredLast time.Time `json:"motionTriggredLast"`
+	MotionTriggered     bool      `json:"motionTriggered"`
+	// MotionTriggeredChan chan bool `json:"motionTriggeredChan"`
+	// MotionHiRecOn bool `json:"motionHiRecOn"`
+	HiResControlChannel   chan RecordMsg
+	MotionVideo           VideoMetadata
+	MotionMutex           *sync.Mutex
+	LoResStreamParams     StreamParams
+	HiResStreamParams     StreamParams
+	AnalysisParams        StreamParams    // Size of the frames passed to motion and object detection
+	MotionRegions         []motion.Region // Moving areas of the last analysed frame, in analysis frame pixels
+	InferenceTimingBuffer []InferenceStats
+	CodecName             string
+	tracker               *tracker.Tracker
+	triggeredTracks       map[int]bool                  // Tracks that are part of the running event, an object is added to it once
+	objectZones           map[int]*objectZoneState      // By track ID, objects that are in a zone
+	staticObjects         map[int]*staticObject         // By track ID, objects that stay put
+	lineAnchors           map[int]map[string][2]float64 // By track ID and line name, where the object was last time
+	analysisRate          *analysisRate.Controller
+	motion                *motion.Detector
+	frameQueue            *frameQueue.Queue[FrameMsg]
+	gifSliceMutex         sync.Mutex
+	endingEvents          sync.WaitGroup // endMotionEvent calls running in the background
+	gifSlice              []image.RGBA
+	stream                *mjpeg.Stream
+	framePool             *framePool
+	frame                 *image.RGBA // Being analysed, only used by the frame loop
+	source                FrameSource // Injected feed, nil picks ffmpeg or native ingest
+	probed                bool
+	armMutex              sync.Mutex
+	armed                 ArmState            // What the schedules of the camera arm right now
+	armOverride           string              // armed or disarmed through the control API, empty follows the schedules. Guarded by armMutex
+	recording             bool                // The active event is recorded, recording was armed when it started. Guarded by MotionMutex
+	manual                bool                // The control API holds the active event open until record_stop. Guarded by MotionMutex
+	commands              chan *cameraCommand // Control API requests that need the frame loop
+	statsMutex            sync.Mutex
+	lastInference         *InferenceStatsEvent // Last inference_avg, guarded by statsMutex
+	errorsMutex           sync.Mutex
+	lastErrors            map[string]time.Time // When an error was sent last, by source and message
+	pendingMutex          sync.Mutex
+	pendingConfig         *CameraConfig      // Set by a reload, taken over by the frame loop
+	cancel                context.CancelFunc // Stops run
+	done                  chan struct{}      // Closed when run returned
+}
+
+func newCamera(e *Engine, config CameraConfig) *Camera {
+	return &Camera{
+		engine:              e,
+		Config:              config,
+		MotionMutex:         &sync.Mutex{},
+		HiResControlChannel: make(chan RecordMsg),
+		stream:              mjpeg.NewStream(),
+		tracker:             tracker.New(trackerConfig(config)),
+		triggeredTracks:     make(map[int]bool),
+		lastErrors:          make(map[string]time.Time),
+		armed:               armAll(true),
+		commands:            make(chan *cameraCommand, 4),
+	}
+}
+
+func trackerConfig(config CameraConfig) tracker.Config {
+	return tracker.Config{
+		IouThreshold: config.TrackIouThreshold,
+		MaxDistance:  config.ObjectCenterMovementThreshold,
+		MaxAreaDiff:  config.ObjectAreaThreshold,
+		MaxAge:       time.Duration(config.TrackMaxAge * float64(time.Second)),
+		StaticAfter:  time.Duration(config.StaticAfter * float64(time.Second)),
+		StaticMaxAge: time.Duration(config.StaticMaxAge * float64(time.Second)),
+	}
+}
+
+// probeStreams fills the camera stream params either from the config bypass or from ffprobe
+func (c *Camera) probeStreams() error {
+	if c.Config.HiStreamParamBypass.Width == 0 || c.Config.HiStreamParamBypass.Height == 0 || c.Config.HiStreamParamBypass.FPS == 0 {
+		// Print HI/LO stream details
+		hiResStreamInfo, err := getStreamInfo(c.Config.HiResDeviceUrl)
+		if err != nil {
+			return fmt.Errorf("Error getting stream info: ffprobe: %v", err)
+		}
+
+		if len(hiResStreamInfo.Streams) == 0 {
+			return fmt.Errorf("No HI res streams found at %s", c.Config.HiResDeviceUrl)
+		}
+
+		// Find stream with codec_type: video
+		streamIndex := -1
+		for index, stream := range hiResStreamInfo.Streams {
+			if stream.CodecType == "video" {
+				streamIndex = index
+				c.CodecName = stream.CodecName
+				if c.engine.Config().Video.OnlyRemuxMp4 {
+					if stream.CodecName != "h264" {
+						Log("warning", fmt.Sprintf("[%s] OnlyRemuxMp4 is enabled but the stream codec is not h264 or h265. Your videos may not play in WebUI. Codec: %s", c.Config.CameraName, stream.CodecName))
+					}
+				}
+				break
+			}
+		}
+
+		if streamIndex == -1 {
+			return fmt.Errorf("No video stream found at %s", c.Config.HiResDeviceUrl)
+		}
+
+		c.HiResStreamParams = StreamParams{
+			Width:  hiResStreamInfo.Streams[streamIndex].Width,
+			Height: hiResStreamInfo.Streams[streamIndex].Height,
+			FPS:    hiResStreamInfo.Streams[streamIndex].RFrameRate,
+		}
+	} else {
+		c.HiResStreamParams = c.Config.HiStreamParamBypass
+	}
+
+	if c.Config.IngestMode == "native" {
+		// Native ingest analyses the hi res stream, the lo res stream is never opened
+		if c.CodecName != "" && c.CodecName != "h264" {
+			return fmt.Errorf("native ingest only supports h264, got: %s", c.CodecName)
+		}
+		c.LoResStreamParams = c.HiResStreamParams
+	} else if c.Config.LoStreamParamBypass.Width == 0 || c.Config.LoStreamParamBypass.Height == 0 || c.Config.LoStreamParamBypass.FPS == 0 {
+		loResStreamInfo, err := getStreamInfo(c.Config.DeviceUrl)
+		if err != nil {
+			return fmt.Errorf("Error getting stream info: %v", err)
+		}
+
+		if len(loResStreamInfo.Streams) == 0 {
+			return fmt.Errorf("No LO res streams found at %s", c.Config.DeviceUrl)
+		}
+
+		// Find stream with codec_type: video
+		streamIndex := -1
+		for index, stream := range loResStreamInfo.Streams {
+			if stream.CodecType == "video" {
+				streamIndex = index
+				break
+			}
+		}
+
+		if streamIndex == -1 {
+			return fmt.Errorf("No video stream found at %s", c.Config.DeviceUrl)
+		}
+
+		c.LoResStreamParams = StreamParams{
+			Width:  loResStreamInfo.Streams[streamIndex].Width,
+			Height: loResStreamInfo.Streams[streamIndex].Height,
+			FPS:    loResStreamInfo.Streams[streamIndex].RFrameRate,
+		}
+	} else {
+		c.LoResStreamParams = c.Config.LoStreamParamBypass
+	}
+
+	err := c.setAnalysisResolution()
+	if err != nil {
+		return err
+	}
+
+	// Print stream info
+	Log("info", fmt.Sprintf("******************** STREAM INFO: %s ********************", c.Config.CameraName))
+	Log("info", fmt.Sprintf("Lo-Res Stream Resolution: %dx%d FPS: %.2f", c.LoResStreamParams.Width, c.LoResStreamParams.Height, c.LoResStreamParams.FPS))
+	Log("info", fmt.Sprintf("Hi-Res Stream Resolution: %dx%d FPS: %.2f", c.HiResStreamParams.Width, c.HiResStreamParams.Height, c.HiResStreamParams.FPS))
+	Log("info", fmt.Sprintf("Analysis Resolution: %dx%d FPS: %.2f Adaptive: %t", c.AnalysisParams.Width, c.AnalysisParams.Height, c.AnalysisParams.FPS, c.Config.adaptiveAnalysisFps()))
+	Log("info", "*****************************************************")
+
+	return nil
+}
+
+// setAnalysisResolution picks the size frames are analysed at and scales the ignore areas, which are given in lo res stream pixels, to it
+func (c *Camera) setAnalysisResolution() error {
+	c.AnalysisParams = c.LoResStreamParams
+	if c.Config.AnalysisWidth > 0 || c.Config.AnalysisHeight > 0 {
+		if c.Config.IngestMode == "native" {
+			Log("warning", fmt.Sprintf("[%s] analysisWidth/analysisHeight are only supported with ffmpeg ingest, analysing at stream resolution", c.Config.CameraName))
+		} else if c.LoResStreamParams.Width > 0 && c.LoResStreamParams.Height > 0 {
+			width, height := c.Config.AnalysisWidth, c.Config.AnalysisHeight
+			// Keep the aspect ratio if only one side is set, rounded down to an even size for ffmpeg
+			if width == 0 {
+				width = (height * c.LoResStreamParams.Width / c.LoResStreamParams.Height) &^ 1
+			}
+			if height == 0 {
+				height = (width * c.LoResStreamParams.Height / c.LoResStreamParams.Width) &^ 1
+			}
+			c.AnalysisParams.Width, c.AnalysisParams.Height = width, height
+		}
+	}
+
+	if c.AnalysisParams.Width <= 0 || c.AnalysisParams.Height <= 0 {
+		return fmt.Errorf("Unable to determine analysis resolution, set loStreamParamBypass or analysisWidth/analysisHeight")
+	}
+
+	c.Config.IgnoreAreasClasses = c.scaleIgnoreAreas(c.Config.IgnoreAreasClasses)
+
+	c.framePool = newFramePool(c.AnalysisParams.Width, c.AnalysisParams.Height)
+	c.motion = motion.New(motion.Config{Sensitivity: c.Config.MotionSensitivity})
+
+	// Default to every 5th frame of the analysed stream
+	c.AnalysisParams.FPS = c.Config.AnalysisFps
+	if c.AnalysisParams.FPS <= 0 {
+		c.AnalysisParams.FPS = c.LoResStreamParams.FPS / 5
+	}
+	if c.LoResStreamParams.FPS > 0 && c.AnalysisParams.FPS > c.LoResStreamParams.FPS {
+		c.AnalysisParams.FPS = c.LoResStreamParams.FPS
+	}
+	if c.AnalysisParams.FPS <= 0 {
+		c.AnalysisParams.FPS = 2
+	}
+	c.analysisRate = analysisRate.New(analysisRate.Config{
+		TargetFps: c.AnalysisParams.FPS,
+		Adaptive:  c.Config.adaptiveAnalysisFps(),
+	})
+	return nil
+}
+
+// scaleIgnoreAreas returns the ignore areas, which are given in lo res stream pixels, in analysis frame pixels
+func (c *Camera) scaleIgnoreAreas(areas []IgnoreAreaClass) []IgnoreAreaClass {
+	if c.AnalysisParams.Width == c.LoResStreamParams.Width && c.AnalysisParams.Height == c.LoResStreamParams.Height {
+		return areas
+	}
+
+	scaleX := float64(c.AnalysisParams.Width) / float64(c.LoResStreamParams.Width)
+	scaleY := float64(c.AnalysisParams.Height) / float64(c.LoResStreamParams.Height)
+
+	// The slice may be shared with other cameras, scale a copy
+	ignoreAreas := make([]IgnoreAreaClass, len(areas))
+	for i, area := range areas {
+		area.Top = int(float64(area.Top) * scaleY)
+		area.Bottom = int(float64(area.Bottom) * scaleY)
+		area.Left = int(float64(area.Left) * scaleX)
+		area.Right = int(float64(area.Right) * scaleX)
+		ignoreAreas[i] = area
+	}
+	return ignoreAreas
+}
+
+// cameraNeedsRestart reports if going from old to new changes how the streams are read or recorded,
+// which a running pipeline can't pick up
+func cameraNeedsRestart(old, new CameraConfig) bool {
+	return old.DeviceUrl != new.DeviceUrl ||
+		old.HiResDeviceUrl != new.HiResDeviceUrl ||
+		old.IngestMode != new.IngestMode ||
+		old.LoStreamParamBypass != new.LoStreamParamBypass ||
+		old.HiStreamParamBypass != new.HiStreamParamBypass ||
+		old.AnalysisWidth != new.AnalysisWidth ||
+		old.AnalysisHeight != new.AnalysisHeight ||
+		old.AnalysisFps != new.AnalysisFps ||
+		old.adaptiveAnalysisFps() != new.adaptiveAnalysisFps() ||
+		old.FrameQueueSize != new.FrameQueueSize ||
+		old.PrebufferSeconds != new.PrebufferSeconds ||
+		old.HiResPath != new.HiResPath // Clips and metadata of an event must end up in the same place
+}
+
+// regionBoxes returns the boxes of the current motion regions
+func (c *Camera) regionBoxes() []events.Box {
+	boxes := make([]events.Box, len(c.MotionRegions))
+	for i, region := range c.MotionRegions {
+		boxes[i] = events.NewBox(region.Box)
+	}
+	return boxes
+}
+
+// updateConfig queues settings for the frame loop, which takes them over before the next frame
+func (c *Camera) updateConfig(config CameraConfig) {
+	c.pendingMutex.Lock()
+	c.pendingConfig = &config
+	c.pendingMutex.Unlock()
+}
+
+// applyPendingConfig takes over the settings queued by updateConfig that can change while the pipeline runs
+func (c *Camera) applyPendingConfig() {
+	c.pendingMutex.Lock()
+	config := c.pendingConfig
+	c.pendingConfig = nil
+	c.pendingMutex.Unlock()
+	if config == nil {
+		return
+	}
+
+	c.Config.PixelMotionAreaThreshold = config.PixelMotionAreaThreshold
+	c.Config.MotionSensitivity = config.MotionSensitivity
+	c.motion.SetSensitivity(config.MotionSensitivity)
+	c.Config.ObjectCenterMovementThreshold = config.ObjectCenterMovementThreshold
+	c.Config.ObjectAreaThreshold = config.ObjectAreaThreshold
+	c.Config.TrackIouThreshold = config.TrackIouThreshold
+	c.Config.TrackMaxAge = config.TrackMaxAge
+	c.Config.StaticAfter = config.StaticAfter
+	c.Config.StaticMaxAge = config.StaticMaxAge
+	c.tracker.SetConfig(trackerConfig(c.Config))
+	c.Config.ConfidenceMinThreshold = config.ConfidenceMinThreshold
+	c.Config.LookForClasses = config.LookForClasses
+	c.Config.ClassFilters = config.ClassFilters
+	c.Config.EventGap = config.EventGap
+	c.Config.StreamDrawIgnoredAreas = config.StreamDrawIgnoredAreas
+	c.Config.IgnoreAreasClasses = c.scaleIgnoreAreas(config.IgnoreAreasClasses)
+	c.Config.Zones = config.Zones
+	c.Config.Lines = config.Lines
+	Log("info", fmt.Sprintf("[%s] Applied new config", c.Config.CameraName))
+}
+
+// run starts the recorder and the feed of a camera and processes its frames until ctx is done.
+// On the way out the active event is ended and the recording flushed before run returns.
+func (c *Camera) run(ctx context.Context) {
+	ptime := prettyTimer.NewTimingStats()
+	if c.Config.EnableOutputStream {
+		go c.startWebcamStream()
+	}
+
+	c.updateArmState(time.Now(), true)
+	go c.watchSchedules(ctx)
+
+	// Define the last image
+	imgLast := c.framePool.Get()
+
+	// Analysis always works on the newest frames, dropped frames go back to the pool
+	c.frameQueue = frameQueue.New(c.Config.FrameQueueSize, func(msg FrameMsg) {
+		if rgba, ok := msg.Frame.(*image.RGBA); ok {
+			c.framePool.Put(rgba)
+		}
+	})
+
+	// The recorder outlives the feed so the active event can still be ended on shutdown
+	recorderCtx, stopRecorder := context.WithCancel(context.Background())
+	defer stopRecorder()
+	recorderDone := make(chan struct{})
+
+	source := c.source
+	if source == nil {
+		source = c.defaultSource()
+	}
+
+	if recorder, ok := source.(Recorder); ok {
+		// The source records itself, only forward the control messages
+		go func() {
+			defer close(recorderDone)
+			c.forwardRecording(recorderCtx, recorder)
+		}()
+	} else {
+		// Start HI Res prebuffering
+		go func() {
+			defer close(recorderDone)
+			for {
+				recordRTSPStream(recorderCtx, c.Config.HiResDeviceUrl, c.HiResControlChannel, time.Duration(c.Config.PrebufferSeconds)*time.Second)
+				if !sleepContext(recorderCtx, 5*time.Second) {
+					return
+				}
+				Log("warning", fmt.Sprintf("[%s] Restarting HI RTSP feed", c.Config.CameraName))
+			}
+		}()
+	}
+
+	frameChannel := make(chan FrameMsg)
+	go func() {
+		defer close(frameChannel)
+		for {
+			err := source.Run(ctx, frameChannel)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				frameChannel <- FrameMsg{Error: err.Error()}
+			}
+			if !sleepContext(ctx, 5*time.Second) {
+				return
+			}
+			Log("warning", fmt.Sprintf("[%s] Restarting feed", c.Config.CameraName))
+		}
+	}()
+
+	// Drain the feed without ever waiting for analysis so ffmpeg/the camera don't back up
+	go func() {
+		defer c.frameQueue.Close()
+		for msg := range frameChannel {
+			if msg.Error != "" {
+				Log("error", fmt.Sprintf("[%s] %s", c.Config.CameraName, msg.Error))
+				c.emitError("feed", "", errors.New(msg.Error))
+				continue
+			}
+
+			msg.Received = time.Now()
+			c.frameQueue.Push(msg)
+		}
+	}()
+
+	for {
+		msg, ok := c.frameQueue.Pop()
+		if !ok {
+			break
+		}
+
+		c.applyPendingConfig() // Settings changed by a reload
+
+		// Shutting down, only drain what is left
+		if ctx.Err() != nil {
+			if rgba, ok := msg.Frame.(*image.RGBA); ok {
+				c.framePool.Put(rgba)
+			}
+			continue
+		}
+
+		if msg.Frame != nil {
+			ptime.Start() // DEBUG TIMER
+
+			rgba, ok := msg.Frame.(*image.RGBA)
+			if !ok {
+				// Convert to RGBA if it's not already
+				rgba = image.NewRGBA(msg.Frame.Bounds())
+				draw.Draw(rgba, rgba.Bounds(), msg.Frame, msg.Frame.Bounds().Min, draw.Src)
+			}
+
+			// Frames arrive at the target analysis fps, skip some while the detector is behind
+			if !c.analysisRate.Accept() {
+				c.framePool.Put(rgba)
+				ptime.Finish() // DEBUG TIMER
+				continue
+			}
+
+			c.frame = rgba
+
+			// Handle all motion stuff here, the background model sees every analysed frame to stay current
+			c.MotionRegions = c.motion.Detect(rgba)
+			// Once an event is triggered every frame goes to object detection, otherwise we may not be able to identify all objects.
+			// Objects in zones are followed until they leave, even if they stand still.
+			if c.MotionTriggered || c.followingObjects() || motion.TotalArea(c.MotionRegions) > int(c.Config.PixelMotionAreaThreshold) {
+				// If its been more than EventGap seconds since the last motion event, untrigger
+				if c.eventGapPassed() {
+					c.untrigger()
+				}
+
+				// While detection is disarmed a running event still ends, nothing new is detected
+				if c.armState().Detection {
+					start := time.Now()
+					predict, err := c.engine.detector.Detect(ctx, rgba) // Cancelled when the camera stops
+					if err != nil {
+						if ctx.Err() == nil {
+							Log("error", fmt.Sprintf("[%s] Error running detector: %v", c.Config.CameraName, err))
+							c.MotionMutex.Lock()
+							eventID := c.MotionVideo.ID // An event may be ending in the background
+							c.MotionMutex.Unlock()
+							c.emitError("detector", eventID, err)
+						}
+					} else {
+						took := time.Since(start)
+						c.performDetectionOnObject(rgba, predict)
+						c.calcInferenceStats(took, time.Since(msg.Received)) // Calculate inference stats
+						c.adjustAnalysisRate(took)
+					}
+				}
+			}
+
+			c.handleCommands(rgba) // Manual recordings and snapshots of the control API
+
+			// if c.Config.EnableOutputStream {
+			// 	c.streamImage(rgba) // Stream the image to the web
+			// }
+
+			c.frame = nil
+			c.framePool.Put(imgLast) // Nothing holds on to the previous frame anymore
+			imgLast = rgba           // Set the last image to the current image
+
+			ptime.Finish() // DEBUG TIMER
+			// ptime.PrintStats() // DEBUG TIMER
+
+		}
+	}
+
+	// The feed is stopped, finish the active event while the recorder still runs so the clip and metadata are complete
+	c.endingEvents.Wait()
+	if c.MotionTriggered {
+		Log("info", fmt.Sprintf("[%s] Ending active motion event before stopping", c.Config.CameraName))
+		c.MotionTriggered = false
+		c.endMotionEvent()
+	}
+	stopRecorder()
+	<-recorderDone
+	Log("info", fmt.Sprintf("[%s] Stopped", c.Config.CameraName))
+}
+
+// forwardRecording passes recording control messages to a source that records itself until ctx is done
+func (c *Camera) forwardRecording(ctx context.Context, recorder Recorder) {
+	defer recorder.StopRecording()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-c.HiResControlChannel:
+			if msg.Record {
+				if err := recorder.StartRecording(msg.Filename); err != nil {
+					Log("error", fmt.Sprintf("[%s] Error starting recording: %v", c.Config.CameraName, err))
+					c.emitError("recording", "", err)
+				}
+			} else {
+				recorder.StopRecording()
+			}
+		}
+	}
+}
+
+func (c *Camera) performDetectionOnObject(frame *image.RGBA, prediction []detector.Prediction) {
+	now := time.Now()
+
+	var predictions []detector.Prediction
+	var detections []tracker.Detection
+	for _, predict := range prediction {
+		// If class is not within LookForClasses, skip it
+		if len(c.Config.LookForClasses) > 0 {
+			found := false
+			for _, filterClass := range c.Config.LookForClasses {
+				if predict.ClassName == filterClass {
+					found = true
+				}
+			}
+			if !found {
+				Log("debug", fmt.Sprintf("[%s] Rejected %s %.2f: not in lookForClasses", c.Config.CameraName, predict.ClassName, predict.Confidence))
+				continue
+			}
+		}
+
+		box := image.Rect(predict.Left, predict.Top, predict.Right, predict.Bottom)
+		filter, source := c.classFilter(predict.ClassName, box)
+		if rule := filter.reject(box, predict.Confidence, c.AnalysisParams.Width, c.AnalysisParams.Height); rule != "" {
+			Log("debug", fmt.Sprintf("[%s] Rejected %s %.2f at %v: %s (%s)", c.Config.CameraName, predict.ClassName, predict.Confidence, box, rule, source))
+			continue
+		}
+
+		predictions = append(predictions, predict)
+		detections = append(detections, tracker.Detection{
+			Box:        box,
+			Class:      predict.ClassName,
+			Confidence: predict.Confidence,
+		})
+	}
+	tracks := c.tracker.Update(detections, now)
+
+	for i, predict := range predictions {
+		rect := detections[i].Box
+
+		object := TrackedObject{
+			TrackID:    tracks[i].ID,
+			BBox:       rect,
+			Center:     image.Pt((predict.Left+predict.Right)/2, (predict.Top+predict.Bottom)/2),
+			LastMoved:  now,
+			Area:       float64(rect.Dx() * rect.Dy()),
+			Class:      predict.ClassName,
+			Confidence: predict.Confidence,
+		}
+
+		object.Static = tracks[i].Static
+		c.updateStatic(object, tracks[i], now)
+
+		// Lines count every tracked object, zones and ignore areas only decide what triggers events
+		c.checkLines(object, now)
+
+		// Objects in ignore areas and outside the zones are tracked but don't trigger, the other predictions of the frame still count
+		zones, allowed := c.zonesOf(object)
+		if !allowed || c.inIgnoreArea(object) {
+			c.updateZones(object, now) // Without zones, the object left them
+			continue
+		}
+		object.Zones = zones
+
+		// Moving objects keep the event going, static objects don't until they move again
+		if !object.Static && c.MotionTriggered && c.triggeredTracks[object.TrackID] {
+			c.MotionMutex.Lock()
+			c.MotionTriggeredLast = now
+			c.MotionMutex.Unlock()
+		}
+
+		// A track is added to the event once
+		if !object.Static && !c.triggeredTracks[object.TrackID] {
+			c.triggeredTracks[object.TrackID] = true
+
+			Log("info", fmt.Sprintf("[%s] TRIGGERED NEW OBJECT #%d @ COORD: %d AREA: %f [%s|%f]", c.Config.CameraName, object.TrackID, object.Center, object.Area, object.Class, object.Confidence))
+			if !c.MotionTriggered {
+				c.endingEvents.Wait() // The previous event must be written before MotionVideo is reused
+				armed := c.armState()
+
+				// Lock mutex
+				c.MotionMutex.Lock()
+				c.MotionTriggered = true
+				c.MotionTriggeredLast = now
+				c.MotionVideo.CameraName = c.Config.CameraName
+				c.MotionVideo.MotionStart = now
+				// Generate random string filename for c.MotionVideo.Filename
+				c.MotionVideo.ID = generateRandomString(15)
+				c.MotionVideo.Objects = append(c.MotionVideo.Objects, object)
+				c.recording = armed.Recording
+				if c.recording {
+					c.MotionVideo.VideoFile = fmt.Sprintf("clip_%s.ts", c.MotionVideo.ID)                                                  // Set filename for video file
+					c.HiResControlChannel <- RecordMsg{Record: true, Filename: filepath.Join(c.Config.HiResPath, c.MotionVideo.VideoFile)} // Start recording
+				}
+
+				started := c.motionEvent(EventMotionStart, now)
+
+				// Unlock mutex
+				c.MotionMutex.Unlock()
+
+				// Notify in realtime about detected objects, sinks attach the snapshot outside of the lock
+				c.emitDetection(EventMotionStart, started)
+			} else {
+				// Lock mutex
+				c.MotionMutex.Lock()
+				c.MotionTriggeredLast = now
+				c.MotionVideo.Objects = append(c.MotionVideo.Objects, object)
+				updated := c.motionEvent(EventMotionUpdate, now)
+
+				// Unlock mutex
+				c.MotionMutex.Unlock()
+
+				// Notify in realtime about detected objects
+				c.emitDetection(EventMotionUpdate, updated)
+			}
+
+			// Log("error", fmt.Sprintf("STORED %d OBJECTS", len(c.MotionVideo.Objects)))
+
+			ob.DrawRectangle(frame, rect, color.RGBA{255, 165, 0, 255}, 2) // Draw orange rectangle
+
+			pt := image.Pt(predict.Left, predict.Top-5)
+			if predict.Top-5 < 0 {
+				pt = image.Pt(predict.Left, predict.Top+20) // if the box is too close to the top of the image, put the label inside the box
+			}
+			ob.AddLabelWithTTF(frame, fmt.Sprintf("%s %.2f", predict.ClassName, predict.Confidence), pt, color.RGBA{255, 165, 0, 255}, 12.0) // Orange size 12 font
+
+			// Store snapshot of the object
+			if c.MotionVideo.ID != "" {
+				// Add frames for the pushover gif, frames are reused so keep a deep copy
+				if c.engine.Config().Notifications.EnablePushoverAlerts {
+					copyFrame := cloneRGBA(frame)
+					c.gifSliceMutex.Lock()
+					c.gifSlice = append(c.gifSlice, *copyFrame)
+					c.gifSliceMutex.Unlock()
+				}
+				c.engine.homeAssistant.snapshot(c.Config.CameraName, frame)
+
+				if c.recording {
+					snapshotFilename := fmt.Sprintf("snap_%s_%s.jpg", c.MotionVideo.ID, generateRandomString(4))
+					c.MotionVideo.Snapshots = append(c.MotionVideo.Snapshots, snapshotFilename)
+					saveJPEG(filepath.Join(c.Config.HiResPath, snapshotFilename), frame, 100)
+				}
+			} else {
+				Log("warning", fmt.Sprintf("[%s] MotionVideo.ID is empty, not writing snapshot. This shouldnt happen.", c.Config.CameraName))
+			}
+		}
+
+		c.recordTrack(object, now)
+		c.updateZones(object, now)
+	}
+
+	for id := range c.triggeredTracks {
+		if !c.tracker.Has(id) {
+			delete(c.triggeredTracks, id)
+		}
+	}
+	c.pruneLines()
+	c.expireStatic(now)
+	c.expireZones(now)
+}
+
+// untrigger ends the running event in the background, the next triggering object starts a new one once it is written
+func (c *Camera) untrigger() {
+	c.MotionTriggered = false // Frames keep coming while the event ends, don't end it twice
+	clear(c.triggeredTracks)  // Objects still in view trigger the next event
+	c.endingEvents.Add(1)
+	go func() {
+		defer c.endingEvents.Done()
+		c.endMotionEvent()
+	}()
+}
+
+// eventGapPassed reports if the running event saw no triggering object for eventGap seconds, manual events are held
+func (c *Camera) eventGapPassed() bool {
+	return c.MotionTriggered && !c.manual && time.Since(c.MotionTriggeredLast) > time.Duration(c.Config.EventGap)*time.Second
+}
+
+// recordTrack adds a detection to its track in the metadata of the running event
+func (c *Camera) recordTrack(object TrackedObject, now time.Time) {
+	c.MotionMutex.Lock()
+	defer c.MotionMutex.Unlock()
+	if c.MotionVideo.ID == "" {
+		return
+	}
+
+	detection := TrackDetection{Time: now, BBox: object.BBox, Confidence: object.Confidence, Zones: object.Zones, Static: object.Static}
+	for i := range c.MotionVideo.Tracks {
+		track := &c.MotionVideo.Tracks[i]
+		if track.TrackID == object.TrackID {
+			track.LastSeen = now
+			track.Detections = append(track.Detections, detection)
+			return
+		}
+	}
+	c.MotionVideo.Tracks = append(c.MotionVideo.Tracks, TrackSummary{
+		TrackID:    object.TrackID,
+		Class:      object.Class,
+		FirstSeen:  now,
+		LastSeen:   now,
+		Detections: []TrackDetection{detection},
+	})
+}
+
+// streamImage serves img as JPEG on the output stream, with the ignore areas drawn when streamDrawIgnoredAreas is set
+func (c *Camera) streamImage(img *image.RGBA) {
+	// Draw ignore areas from IgnoreAreasClasses
+	if c.Config.StreamDrawIgnoredAreas {
+		for _, ignoreAreaClass := range c.Config.IgnoreAreasClasses {
+			// Draw the ignore area
+			rect := image.Rect(ignoreAreaClass.Left, ignoreAreaClass.Top, ignoreAreaClass.Right, ignoreAreaClass.Bottom)
+			ob.DrawRectangle(img, rect, color.RGBA{255, 0, 0, 0}, 2)
+		}
+	}
+
+	// Encode the RGBA image to JPEG
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		// Handle encoding error
+		return
+	}
+
+	// Stream video over HTTP
+	c.stream.UpdateJPEG(buf.Bytes())
+}
+
+func (c *Camera) startWebcamStream() {
+	// start http server, every camera gets its own mux so they can run side by side
+	mux := http.NewServeMux()
+	mux.Handle("/", c.stream)
+
+	server := &http.Server{
+		Addr:         c.Config.OutputStreamAddr,
+		Handler:      mux,
+		ReadTimeout:  60 * time.Second,
+		WriteTimeout: 60 * time.Second,
+	}
+
+	err := server.ListenAndServe()
+	if err != nil {
+		Log("error", fmt.Sprintf("[%s] Output stream stopped: %v", c.Config.CameraName, err))
+	}
+}
+
+// calcInferenceStats collects how long detection took and periodically reports it against the time budget of the current analysis fps
+func (c *Camera) calcInferenceStats(took time.Duration, latency time.Duration) {
+	tookMs := float64(took.Microseconds()) / 1000
+	ceiling := int(1000 / c.analysisRate.Fps())
+	if tookMs > float64(ceiling) {
+		Log("warning", fmt.Sprintf("[%s] Inference took %fms, max ceiling should be: %dms", c.Config.CameraName, tookMs, ceiling))
+	}
+
+	stats := InferenceStats{Avg: tookMs, Min: tookMs, Max: tookMs, Latency: float64(latency.Microseconds()) / 1000}
+
+	c.InferenceTimingBuffer = append(c.InferenceTimingBuffer, stats)
+
+	if len(c.InferenceTimingBuffer) >= interenceAvgInterval {
+		statsFinal := InferenceStats{}
+		statsFinal.Min = math.MaxFloat64
+		statsFinal.Max = 0 // Initialize Max to 0
+		// Calculate avg inference time
+		for _, inferenceTime := range c.InferenceTimingBuffer {
+			statsFinal.Avg += inferenceTime.Avg
+			statsFinal.Latency += inferenceTime.Latency
+			if inferenceTime.Min < statsFinal.Min {
+				statsFinal.Min = inferenceTime.Min
+			}
+
+			if inferenceTime.Max > statsFinal.Max {
+				statsFinal.Max = inferenceTime.Max
+			}
+		}
+
+		statsFinal.Avg = statsFinal.Avg / float64(len(c.InferenceTimingBuffer))
+		statsFinal.Latency = statsFinal.Latency / float64(len(c.InferenceTimingBuffer))
+
+		// Log avg inference time
+		event := InferenceStatsEvent{
+			Header:       events.NewHeader(EventInferenceAvg, c.Config.CameraName, time.Now()),
+			InferenceAvg: statsFinal.Avg,
+			InferenceMin: statsFinal.Min,
+			InferenceMax: statsFinal.Max,
+			Ceiling:      ceiling,
+			AnalysisFps:  c.analysisRate.Fps(),
+			TargetFps:    c.analysisRate.TargetFps(),
+			LatencyAvg:   statsFinal.Latency,
+			Dropped:      c.frameQueue.Dropped(),
+		}
+		c.statsMutex.Lock()
+		c.lastInference = &event
+		c.statsMutex.Unlock()
+		c.emit(EventInferenceAvg, event)
+		Log("notice", fmt.Sprintf("[%s] Inference avg: %fms, min: %fms, max: %fms, analysis fps: %.2f/%.2f, decision latency avg: %fms, dropped frames: %d", c.Config.CameraName, statsFinal.Avg, statsFinal.Min, statsFinal.Max, c.analysisRate.Fps(), c.analysisRate.TargetFps(), statsFinal.Latency, c.frameQueue.Dropped()))
+
+		// Clear inferenceTimingLog
+		c.InferenceTimingBuffer = make([]InferenceStats, 0)
+	}
+}
+
+// adjustAnalysisRate feeds the detection latency to the analysis rate controller and reports any change
+func (c *Camera) adjustAnalysisRate(took time.Duration) {
+	change, changed := c.analysisRate.Observe(took, time.Now())
+	if !changed {
+		return
+	}
+
+	Log("notice", fmt.Sprintf("[%s] Analysis fps changed from %.2f to %.2f, avg inference: %dms (%s)", c.Config.CameraName, change.OldFps, change.NewFps, change.Latency.Milliseconds(), change.Reason))
+
+	c.emit(EventAnalysisFpsChanged, AnalysisFpsChangedEvent{
+		Header:       events.NewHeader(EventAnalysisFpsChanged, c.Config.CameraName, time.Now()),
+		OldFps:       change.OldFps,
+		NewFps:       change.NewFps,
+		TargetFps:    c.analysisRate.TargetFps(),
+		InferenceAvg: float64(change.Latency.Microseconds()) / 1000,
+		Reason:       change.Reason,
+	})
+}
+
+// endMotionEvent stops the recording of the active event and writes its metadata. An event that started while
+// recording was disarmed left nothing to write. The caller untriggers the camera before.
+func (c *Camera) endMotionEvent() {
+	// Log("info", fmt.Sprintf("SINCE_LAST_EVENT: %d GAP: %d", time.Since(c.MotionTriggeredLast), time.Duration(c.Config.EventGap)*time.Second))
+	Log("info", fmt.Sprintf("[%s] MOTION_ENDED", c.Config.CameraName))
+	c.engine.homeAssistant.motionEnded(c.Config.CameraName)
+	c.MotionMutex.Lock()
+	c.manual = false
+
+	// The gif is encoded when motion_end is sent
+	c.gifSliceMutex.Lock()
+	gifFrames := c.gifSlice
+	c.gifSlice = make([]image.RGBA, 0)
+	c.gifSliceMutex.Unlock()
+
+	// Stop Hi res recording and dump json file as well as clear struct
+	c.MotionVideo.MotionEnd = time.Now()
+	ended := c.motionEndEvent()
+	if !c.recording {
+		c.MotionVideo = VideoMetadata{}
+		c.MotionMutex.Unlock()
+		c.emitMotionEnd(ended, gifFrames)
+		return
+	}
+	c.HiResControlChannel <- RecordMsg{Record: false}
+
+	recode := c.engine.Config().Video.RecodeTsToMp4
+	if recode { // Store this for future reference
+		c.MotionVideo.RecodedToMp4 = true
+		c.engine.recodeWg.Add(1)
+		go func(videoFile string) {
+			defer c.engine.recodeWg.Done()
+			// Recode the ts file to mp4
+			mp4File, err := c.recodeToMP4(videoFile)
+			if err != nil {
+				Log("error", fmt.Sprintf("Error recoding ts file to mp4: %v", err))
+				c.emitError("recode", ended.ID, err)
+			} else {
+				ended.ClipPath = mp4File
+				// Remove the ts file
+				err = os.Remove(videoFile)
+				if err != nil {
+					Log("error", fmt.Sprintf("Error removing ts file: %v", err))
+				}
+			}
+
+			// motion_end waits for the final clip
+			ended.Timestamp = time.Now()
+			c.emitMotionEnd(ended, gifFrames)
+		}(filepath.Join(c.Config.HiResPath, c.MotionVideo.VideoFile))
+	}
+
+	jsonData, err := json.Marshal(c.MotionVideo)
+	if err != nil {
+		Log("error", fmt.Sprintf("Error marshalling metadata: %v", err))
+	}
+
+	err = os.WriteFile(ended.MetadataPath, jsonData, 0644)
+	if err != nil {
+		Log("error", fmt.Sprintf("Error writing metadata file: %v", err))
+		c.emitError("metadata", ended.ID, err)
+	}
+
+	// Clear the whole c.MotionVideo struct
+	c.MotionVideo = VideoMetadata{}
+	c.MotionMutex.Unlock()
+
+	if !recode {
+		c.emitMotionEnd(ended, gifFrames)
+	}
+}
+
+// motionEvent describes the running event for motion_start and motion_update, the caller holds MotionMutex
+func (c *Camera) motionEvent(eventType string, now time.Time) MotionEvent {
+	return MotionEvent{
+		Header:              events.NewHeader(eventType, c.Config.CameraName, now),
+		ID:                  c.MotionVideo.ID,
+		MotionStart:         c.MotionVideo.MotionStart,
+		MotionTriggeredLast: c.MotionTriggeredLast,
+		Objects:             schemaObjects(c.MotionVideo.Objects),
+		MotionRegions:       c.regionBoxes(),
+	}
+}
+
+// motionEndEvent describes the event that just ended, the caller holds MotionMutex
+func (c *Camera) motionEndEvent() MotionEndEvent {
+	video := c.MotionVideo
+	event := MotionEndEvent{
+		Header:      events.NewHeader(EventMotionEnd, c.Config.CameraName, video.MotionEnd),
+		ID:          video.ID,
+		MotionStart: video.MotionStart,
+		MotionEnd:   video.MotionEnd,
+		Duration:    video.MotionEnd.Sub(video.MotionStart).Seconds(),
+		Manual:      video.Manual,
+		Recorded:    c.recording,
+		Snapshots:   []string{},
+		Objects:     schemaObjects(video.Objects),
+		Classes:     make(map[string]events.ClassSummary),
+	}
+	for _, object := range video.Objects {
+		summary := event.Classes[object.Class]
+		summary.Count++
+		summary.MaxConfidence = max(summary.MaxConfidence, object.Confidence)
+		event.Classes[object.Class] = summary
+	}
+	for _, track := range video.Tracks {
+		summary, ok := event.Classes[track.Class]
+		if !ok {
+			continue // Followed but never triggered, eg: in an ignore area
+		}
+		for _, detection := range track.Detections {
+			summary.MaxConfidence = max(summary.MaxConfidence, detection.Confidence)
+		}
+		event.Classes[track.Class] = summary
+	}
+
+	if c.recording {
+		event.ClipPath = filepath.Join(c.Config.HiResPath, video.VideoFile)
+		for _, snapshot := range video.Snapshots {
+			event.Snapshots = append(event.Snapshots, filepath.Join(c.Config.HiResPath, snapshot))
+		}
+		event.MetadataPath = filepath.Join(c.Config.HiResPath, fmt.Sprintf("meta_%s.json", video.ID))
+	}
+	return event
+}
+
+// schemaObjects converts objects to the objects of the event schema
+func schemaObjects(objects []TrackedObject) []events.Object {
+	converted := make([]events.Object, len(objects))
+	for i, object := range objects {
+		converted[i] = events.Object{
+			TrackID:    object.TrackID,
+			Class:      object.Class,
+			Confidence: object.Confidence,
+			BBox:       events.NewBox(object.BBox),
+			Area:       object.Area,
+			Zones:      append([]string{}, object.Zones...),
+		}
+	}
+	return converted
+}
+
+// emitError sends an error event, the same error of a source is sent once per errorEventInterval
+func (c *Camera) emitError(source, eventID string, err error) {
+	now := time.Now()
+	key := source + ": " + err.Error()
+	c.errorsMutex.Lock()
+	if last, ok := c.lastErrors[key]; ok && now.Sub(last) < errorEventInterval {
+		c.errorsMutex.Unlock()
+		return
+	}
+	c.lastErrors[key] = now
+	c.errorsMutex.Unlock()
+
+	c.emit(EventError, ErrorEvent{
+		Header:  events.NewHeader(EventError, c.Config.CameraName, now),
+		Source:  source,
+		Message: err.Error(),
+		EventID: eventID,
+	})
+}
+
+// emit sends an event of this camera to every sink its schedules arm
+func (c *Camera) emit(eventType string, data any) {
+	c.engine.emitTo(eventType, c.Config.CameraName, data, c.armState().Notifications, nil)
+}
+
+// emitDetection is emit for events of the frame being analysed, webhooks attach that frame with the tracks drawn.
+// Only the frame loop calls it.
+func (c *Camera) emitDetection(eventType string, data any) {
+	var snapshot snapshotFunc
+	if frame := c.frame; frame != nil {
+		snapshot = func(bool) ([]byte, error) { return annotatedJPEG(frame, c.tracker.Tracks()) }
+	}
+	c.engine.emitTo(eventType, c.Config.CameraName, data, c.armState().Notifications, snapshot)
+}
+
+// emitMotionEnd sends motion_end, webhooks attach the first snapshot of the event and pushover a GIF of
+// gifFrames, or the snapshot without frames. Events that weren't recorded have no snapshot.
+func (c *Camera) emitMotionEnd(ended MotionEndEvent, gifFrames []image.RGBA) {
+	snapshot := func(animated bool) ([]byte, error) {
+		if animated && len(gifFrames) > 0 {
+			return encodeGIF(gifFrames, 100)
+		}
+		if len(ended.Snapshots) > 0 {
+			return os.ReadFile(ended.Snapshots[0])
+		}
+		return nil, nil
+	}
+	c.engine.emitTo(EventMotionEnd, c.Config.CameraName, ended, c.armState().Notifications, snapshot)
+}
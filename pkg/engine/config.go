@@ -0,0 +1,425 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/8ff/firescrew/pkg/detector"
+	"github.com/8ff/firescrew/pkg/schedule"
+)
+
+// Config describes the cameras and everything shared between them, it is the same structure as the firescrew config file
+type Config struct {
+	CameraName                    string            `json:"cameraName"`
+	PrintDebug                    bool              `json:"printDebug"`
+	DeviceUrl                     string            `json:"deviceUrl"`
+	LoStreamParamBypass           StreamParams      `json:"loStreamParamBypass"`
+	HiResDeviceUrl                string            `json:"hiResDeviceUrl"`
+	HiStreamParamBypass           StreamParams      `json:"hiStreamParamBypass"`
+	IngestMode                    string            `json:"ingestMode"` // ffmpeg (default) or native, used when a camera does not set its own
+	AnalysisWidth                 int               `json:"analysisWidth"`
+	AnalysisHeight                int               `json:"analysisHeight"`
+	PixelMotionAreaThreshold      float64           `json:"pixelMotionAreaThreshold"`
+	ObjectCenterMovementThreshold float64           `json:"objectCenterMovementThreshold"`
+	ObjectAreaThreshold           float64           `json:"objectAreaThreshold"`
+	StreamDrawIgnoredAreas        bool              `json:"streamDrawIgnoredAreas"`
+	IgnoreAreasClasses            []IgnoreAreaClass `json:"ignoreAreasClasses"`
+	Zones                         []Zone            `json:"zones"`
+	Lines                         []Line            `json:"lines"`
+	EnableOutputStream            bool              `json:"enableOutputStream"`
+	OutputStreamAddr              string            `json:"outputStreamAddr"`
+	Cameras                       []CameraConfig    `json:"cameras"`
+	Motion                        struct {
+		Detector                  string                  `json:"detector"` // onnx, network, mock or a registered custom backend. Empty picks onnx when onnxModel is set, network otherwise
+		OnnxModel                 string                  `json:"onnxModel"`
+		OnnxEnableCoreMl          bool                    `json:"onnxEnableCoreMl"`
+		EmbeddedObjectScript      string                  `json:"embeddedObjectScript"` // Only used by the firescrew binary, which runs the script
+		ConfidenceMinThreshold    float64                 `json:"confidenceMinThreshold"`
+		Sensitivity               float64                 `json:"sensitivity"` // Motion detection sensitivity from 0 to 1, default 0.5
+		LookForClasses            []string                `json:"lookForClasses"`
+		ClassFilters              map[string]ClassFilter  `json:"classFilters"` // By class, detections outside the limits are dropped
+		NetworkObjectDetectServer string                  `json:"networkObjectDetectServer"`
+		MockPredictions           [][]detector.Prediction `json:"mockPredictions"`
+		AnalysisFps               float64                 `json:"analysisFps"`         // Frames per second analysed, 0 = a fifth of the analysed stream fps
+		AdaptiveAnalysisFps       bool                    `json:"adaptiveAnalysisFps"` // Lower the analysis fps while the detector can't keep up
+		FrameQueueSize            int                     `json:"frameQueueSize"`      // Frames waiting for analysis, older ones are dropped. Default 2
+		EventGap                  int                     `json:"eventGap"`
+		TrackIouThreshold         float64                 `json:"trackIouThreshold"` // Minimum overlap of a detection with the predicted box of a tracked object to continue its track, default 0.3
+		TrackMaxAge               float64                 `json:"trackMaxAge"`       // Seconds a tracked object may go undetected before its track ends, default 30
+		StaticAfter               float64                 `json:"staticAfter"`       // Seconds an object has to stay put to become static, static objects don't trigger events. Default 300
+		StaticMaxAge              float64                 `json:"staticMaxAge"`      // Seconds a parked object is remembered without being detected, default 86400
+		PrebufferSeconds          int                     `json:"prebufferSeconds"`
+	} `json:"motion"`
+	Video struct {
+		HiResPath     string `json:"hiResPath"`
+		RecodeTsToMp4 bool   `json:"recodeTsToMp4"`
+		OnlyRemuxMp4  bool   `json:"onlyRemuxMp4"`
+	} `json:"video"`
+	Events struct {
+		Mqtt struct {
+			Url               string `json:"url"` // Broker URL, eg: mqtts://broker:8883. Replaces host and port, which connect over plain tcp
+			Host              string `json:"host"`
+			Port              int    `json:"port"`
+			User              string `json:"user"`
+			Pass              string `json:"pass"`
+			Password          string `json:"password"` // Older templates used password, same as pass
+			Topic             string `json:"topic"`
+			ClientId          string `json:"clientId"`          // Default firescrew-<hostname>
+			Qos               int    `json:"qos"`               // 0, 1 or 2
+			Retain            bool   `json:"retain"`            // Retain the event messages
+			AvailabilityTopic string `json:"availabilityTopic"` // Gets online/offline, retained. Default <topic>/availability
+			CameraTopics      bool   `json:"cameraTopics"`      // Publish camera events to <topic>/<camera>/<event type> instead of <topic>
+			QueueSize         int    `json:"queueSize"`         // Messages kept while the broker is unreachable, default 1000. Events wait in the outbox instead
+			Tls               struct {
+				CaFile             string `json:"caFile"` // Empty uses the system roots
+				CertFile           string `json:"certFile"`
+				KeyFile            string `json:"keyFile"`
+				InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+			} `json:"tls"` // Used with ssl://, mqtts:// and wss:// URLs
+			HomeAssistant struct {
+				Discovery       bool   `json:"discovery"`       // Publish Home Assistant discovery configs and the states of the entities below <topic>/<camera>
+				DiscoveryPrefix string `json:"discoveryPrefix"` // Default homeassistant
+				AllowArm        bool   `json:"allowArm"`        // The armed entity is a switch that arms and disarms the camera, without api.token. Otherwise it only shows the state
+			} `json:"homeAssistant"`
+		} `json:"mqtt"`
+		Slack struct {
+			Url string `json:"url"`
+		} `json:"slack"`
+		ScriptPath string          `json:"scriptPath"`
+		Webhook    string          `json:"webhookUrl"`
+		Webhooks   []WebhookConfig `json:"webhooks"` // In addition to webhookUrl
+		Delivery   DeliveryConfig  `json:"delivery"`
+	} `json:"events"`
+	Notifications struct {
+		EnablePushoverAlerts bool   `json:"enablePushoverAlerts"`
+		PushoverAppToken     string `json:"pushoverAppToken"`
+		PushoverUserKey      string `json:"pushoverUserKey"`
+	} `json:"notifications"`
+	Schedules map[string]schedule.Config `json:"schedules"` // By name, referenced by arm settings
+	Arm       ArmConfig                  `json:"arm"`       // Used when a camera does not set its own
+	Api       struct {
+		Addr         string `json:"addr"`         // Serves the status and control API, empty disables it
+		Token        string `json:"token"`        // Required by every API request, without it only the status is served
+		CommandTopic string `json:"commandTopic"` // MQTT topic on the events.mqtt broker that takes control commands, empty disables it
+	} `json:"api"`
+
+	legacy bool // The config had no cameras list, camera 0 was made from the top level fields
+}
+
+// WebhookConfig is a webhook of events.webhooks, every field but url is optional
+type WebhookConfig struct {
+	Name        string            `json:"name"` // Names its outbox, default its position in the list starting at 1
+	Url         string            `json:"url"`
+	Method      string            `json:"method"`      // POST, PUT or PATCH, default POST
+	Headers     map[string]string `json:"headers"`     // eg: {"Authorization": "Bearer ..."}
+	Secret      string            `json:"secret"`      // Signs every request with HMAC-SHA256 over its timestamp and body
+	Template    string            `json:"template"`    // Go text/template of the body, empty sends the event JSON
+	ContentType string            `json:"contentType"` // Of the body, default application/json
+	EventTypes  []string          `json:"eventTypes"`  // Only send these events, empty sends every event
+	Classes     []string          `json:"classes"`     // Only send events with an object of these classes
+	Cameras     []string          `json:"cameras"`     // Only send events of these cameras
+	Snapshot    string            `json:"snapshot"`    // multipart attaches the frame of the event as file, base64 adds it to the event as snapshot. Empty sends none
+}
+
+// DeliveryConfig sets how the webhook, script, slack, mqtt and pushover sinks get events
+type DeliveryConfig struct {
+	QueueSize       int    `json:"queueSize"`       // Events per sink waiting in memory, default 100. With the outbox the rest wait on disk
+	TimeoutSeconds  int    `json:"timeoutSeconds"`  // Per delivery attempt, default 10
+	RetryMaxSeconds int    `json:"retryMaxSeconds"` // Retries start after a second and double up to this, default 300
+	MaxAgeHours     int    `json:"maxAgeHours"`     // Events that couldn't be delivered in this time are dropped, default 24
+	OutboxPath      string `json:"outboxPath"`      // Events are kept here until delivered, one folder per sink. Default <video.hiResPath>/.outbox
+	DisableOutbox   bool   `json:"disableOutbox"`   // Keep events in memory only, they are lost on restart
+}
+
+// CameraConfig holds everything that is specific to a single camera.
+// Zero values are filled from the top level config, so a camera entry only
+// needs to list what differs from the shared defaults.
+type CameraConfig struct {
+	CameraName                    string                 `json:"cameraName"`
+	DeviceUrl                     string                 `json:"deviceUrl"`
+	LoStreamParamBypass           StreamParams           `json:"loStreamParamBypass"`
+	HiResDeviceUrl                string                 `json:"hiResDeviceUrl"`
+	HiStreamParamBypass           StreamParams           `json:"hiStreamParamBypass"`
+	IngestMode                    string                 `json:"ingestMode"`     // ffmpeg (default) or native
+	AnalysisWidth                 int                    `json:"analysisWidth"`  // Scale analysis frames to this size, 0 keeps the lo res stream size. When only one side is set the aspect ratio is kept
+	AnalysisHeight                int                    `json:"analysisHeight"` // Same as AnalysisWidth
+	HiResPath                     string                 `json:"hiResPath"`
+	PixelMotionAreaThreshold      float64                `json:"pixelMotionAreaThreshold"`
+	MotionSensitivity             float64                `json:"motionSensitivity"` // Same as motion.sensitivity
+	ObjectCenterMovementThreshold float64                `json:"objectCenterMovementThreshold"`
+	ObjectAreaThreshold           float64                `json:"objectAreaThreshold"`
+	ConfidenceMinThreshold        float64                `json:"confidenceMinThreshold"`
+	LookForClasses                []string               `json:"lookForClasses"`
+	ClassFilters                  map[string]ClassFilter `json:"classFilters"` // Replace the motion.classFilters entries of the same class
+	EventGap                      int                    `json:"eventGap"`
+	TrackIouThreshold             float64                `json:"trackIouThreshold"`
+	TrackMaxAge                   float64                `json:"trackMaxAge"`
+	StaticAfter                   float64                `json:"staticAfter"`
+	StaticMaxAge                  float64                `json:"staticMaxAge"`
+	PrebufferSeconds              int                    `json:"prebufferSeconds"`
+	AnalysisFps                   float64                `json:"analysisFps"`
+	AdaptiveAnalysisFps           *bool                  `json:"adaptiveAnalysisFps"` // Unset takes motion.adaptiveAnalysisFps
+	FrameQueueSize                int                    `json:"frameQueueSize"`
+	StreamDrawIgnoredAreas        bool                   `json:"streamDrawIgnoredAreas"`
+	IgnoreAreasClasses            []IgnoreAreaClass      `json:"ignoreAreasClasses"`
+	Zones                         []Zone                 `json:"zones"`
+	Lines                         []Line                 `json:"lines"`
+	EnableOutputStream            bool                   `json:"enableOutputStream"`
+	OutputStreamAddr              string                 `json:"outputStreamAddr"`
+	Arm                           ArmConfig              `json:"arm"` // Unset fields and sinks are taken from the top level arm
+}
+
+type StreamParams struct {
+	Width  int
+	Height int
+	FPS    float64
+}
+
+type IgnoreAreaClass struct {
+	Class       []string `json:"class"`
+	Coordinates string   `json:"coordinates"`
+	Top         int      `json:"top"`
+	Bottom      int      `json:"bottom"`
+	Left        int      `json:"left"`
+	Right       int      `json:"right"`
+}
+
+// Normalize turns a legacy single camera config into a camera list, fills unset fields with their defaults
+// and validates the result. New calls it, calling it more than once is harmless.
+func (config *Config) Normalize() error {
+	config.applyDefaults()
+	return config.Validate().Err()
+}
+
+// applyDefaults does the normalization part of Normalize, problems are left for Validate to report
+func (config *Config) applyDefaults() {
+	// Legacy single camera configs are turned into a one element camera list
+	if len(config.Cameras) == 0 {
+		config.legacy = true
+		config.Cameras = []CameraConfig{{
+			CameraName:             config.CameraName,
+			DeviceUrl:              config.DeviceUrl,
+			LoStreamParamBypass:    config.LoStreamParamBypass,
+			HiResDeviceUrl:         config.HiResDeviceUrl,
+			HiStreamParamBypass:    config.HiStreamParamBypass,
+			IgnoreAreasClasses:     config.IgnoreAreasClasses,
+			Zones:                  config.Zones,
+			Lines:                  config.Lines,
+			StreamDrawIgnoredAreas: config.StreamDrawIgnoredAreas,
+			EnableOutputStream:     config.EnableOutputStream,
+			OutputStreamAddr:       config.OutputStreamAddr,
+		}}
+	}
+
+	for i := range config.Cameras {
+		camera := &config.Cameras[i]
+		config.applyCameraDefaults(camera)
+		if camera.IngestMode == "" {
+			camera.IngestMode = "ffmpeg"
+		}
+
+		// Split the coordinates string into separate integers, the slice may be shared with other cameras
+		ignoreAreas := make([]IgnoreAreaClass, len(camera.IgnoreAreasClasses))
+		for j, area := range camera.IgnoreAreasClasses {
+			area.Top, area.Bottom, area.Left, area.Right, _ = parseCoordinates(area.Coordinates)
+			ignoreAreas[j] = area
+		}
+		camera.IgnoreAreasClasses = ignoreAreas
+
+		zones := make([]Zone, len(camera.Zones))
+		for j, zone := range camera.Zones {
+			if zone.Containment == "" {
+				zone.Containment = "center"
+			}
+			if zone.MinOverlap == 0 {
+				zone.MinOverlap = 0.5
+			}
+			zones[j] = zone
+		}
+		camera.Zones = zones
+
+		lines := make([]Line, len(camera.Lines))
+		for j, line := range camera.Lines {
+			if line.Direction == "" {
+				line.Direction = "both"
+			}
+			if line.Anchor == "" {
+				line.Anchor = "center"
+			}
+			lines[j] = line
+		}
+		camera.Lines = lines
+	}
+
+	if config.Motion.Detector == "" {
+		if config.Motion.OnnxModel != "" {
+			config.Motion.Detector = "onnx"
+		} else {
+			config.Motion.Detector = "network"
+		}
+	}
+
+	if config.Events.Mqtt.Pass == "" {
+		config.Events.Mqtt.Pass = config.Events.Mqtt.Password
+	}
+	if config.Events.Mqtt.ClientId == "" {
+		hostname, _ := os.Hostname()
+		config.Events.Mqtt.ClientId = "firescrew-" + hostname
+	}
+	if config.Events.Mqtt.HomeAssistant.DiscoveryPrefix == "" {
+		config.Events.Mqtt.HomeAssistant.DiscoveryPrefix = "homeassistant"
+	}
+	if config.Events.Mqtt.AvailabilityTopic == "" && config.Events.Mqtt.Topic != "" {
+		config.Events.Mqtt.AvailabilityTopic = config.Events.Mqtt.Topic + "/availability"
+	}
+
+	// The list may be shared with the config that is replaced on reload
+	webhooks := make([]WebhookConfig, len(config.Events.Webhooks))
+	for i, webhook := range config.Events.Webhooks {
+		if webhook.Name == "" {
+			webhook.Name = strconv.Itoa(i + 1)
+		}
+		if webhook.Method == "" {
+			webhook.Method = http.MethodPost
+		}
+		if webhook.ContentType == "" {
+			webhook.ContentType = "application/json"
+		}
+		webhooks[i] = webhook
+	}
+	config.Events.Webhooks = webhooks
+
+	delivery := &config.Events.Delivery
+	if delivery.QueueSize == 0 {
+		delivery.QueueSize = 100
+	}
+	if delivery.TimeoutSeconds == 0 {
+		delivery.TimeoutSeconds = 10
+	}
+	if delivery.RetryMaxSeconds == 0 {
+		delivery.RetryMaxSeconds = 300
+	}
+	if delivery.MaxAgeHours == 0 {
+		delivery.MaxAgeHours = 24
+	}
+	if delivery.OutboxPath == "" && config.Video.HiResPath != "" {
+		delivery.OutboxPath = filepath.Join(config.Video.HiResPath, ".outbox")
+	}
+}
+
+// applyCameraDefaults fills unset camera fields from the top level config
+func (config *Config) applyCameraDefaults(camera *CameraConfig) {
+	if camera.HiResPath == "" {
+		camera.HiResPath = config.Video.HiResPath
+	}
+	if camera.IngestMode == "" {
+		camera.IngestMode = config.IngestMode
+	}
+	if camera.AnalysisWidth == 0 && camera.AnalysisHeight == 0 {
+		camera.AnalysisWidth, camera.AnalysisHeight = config.AnalysisWidth, config.AnalysisHeight
+	}
+	if camera.PixelMotionAreaThreshold == 0 {
+		camera.PixelMotionAreaThreshold = config.PixelMotionAreaThreshold
+	}
+	if camera.MotionSensitivity == 0 {
+		camera.MotionSensitivity = config.Motion.Sensitivity
+	}
+	if camera.ObjectCenterMovementThreshold == 0 {
+		camera.ObjectCenterMovementThreshold = config.ObjectCenterMovementThreshold
+	}
+	if camera.ObjectAreaThreshold == 0 {
+		camera.ObjectAreaThreshold = config.ObjectAreaThreshold
+	}
+	if camera.ConfidenceMinThreshold == 0 {
+		camera.ConfidenceMinThreshold = config.Motion.ConfidenceMinThreshold
+	}
+	if len(camera.LookForClasses) == 0 {
+		camera.LookForClasses = config.Motion.LookForClasses
+	}
+	if len(config.Motion.ClassFilters) > 0 {
+		// The map may be shared with other cameras
+		filters := make(map[string]ClassFilter, len(config.Motion.ClassFilters)+len(camera.ClassFilters))
+		for class, filter := range config.Motion.ClassFilters {
+			filters[class] = filter
+		}
+		for class, filter := range camera.ClassFilters {
+			filters[class] = filter
+		}
+		camera.ClassFilters = filters
+	}
+	if camera.Arm.Detection == "" {
+		camera.Arm.Detection = config.Arm.Detection
+	}
+	if camera.Arm.Recording == "" {
+		camera.Arm.Recording = config.Arm.Recording
+	}
+	if len(config.Arm.Notifications) > 0 {
+		// The map may be shared with other cameras
+		notifications := make(map[string]string, len(config.Arm.Notifications)+len(camera.Arm.Notifications))
+		for sink, name := range config.Arm.Notifications {
+			notifications[sink] = name
+		}
+		for sink, name := range camera.Arm.Notifications {
+			notifications[sink] = name
+		}
+		camera.Arm.Notifications = notifications
+	}
+	if camera.EventGap == 0 {
+		camera.EventGap = config.Motion.EventGap
+	}
+	if camera.TrackIouThreshold == 0 {
+		camera.TrackIouThreshold = config.Motion.TrackIouThreshold
+	}
+	if camera.TrackMaxAge == 0 {
+		camera.TrackMaxAge = config.Motion.TrackMaxAge
+	}
+	if camera.StaticAfter == 0 {
+		camera.StaticAfter = config.Motion.StaticAfter
+	}
+	if camera.StaticMaxAge == 0 {
+		camera.StaticMaxAge = config.Motion.StaticMaxAge
+	}
+	if camera.PrebufferSeconds == 0 {
+		camera.PrebufferSeconds = config.Motion.PrebufferSeconds
+	}
+	if camera.AnalysisFps == 0 {
+		camera.AnalysisFps = config.Motion.AnalysisFps
+	}
+	if camera.AdaptiveAnalysisFps == nil {
+		adaptive := config.Motion.AdaptiveAnalysisFps
+		camera.AdaptiveAnalysisFps = &adaptive
+	}
+	if camera.FrameQueueSize == 0 {
+		camera.FrameQueueSize = config.Motion.FrameQueueSize
+	}
+	if camera.FrameQueueSize <= 0 {
+		camera.FrameQueueSize = 2
+	}
+}
+
+// adaptiveAnalysisFps tells if the analysis fps of the camera adapts to the detector
+func (camera CameraConfig) adaptiveAnalysisFps() bool {
+	return camera.AdaptiveAnalysisFps != nil && *camera.AdaptiveAnalysisFps
+}
+
+// parseCoordinates splits a "top,bottom,left,right" coordinates string into integers
+func parseCoordinates(coordinates string) (top, bottom, left, right int, err error) {
+	coords := strings.Split(coordinates, ",")
+	if len(coords) != 4 {
+		return 0, 0, 0, 0, errors.New("coordinates string must contain 4 comma separated integers")
+	}
+
+	values := make([]int, 4)
+	for i, coord := range coords {
+		values[i], err = strconv.Atoi(strings.TrimSpace(coord))
+		if err != nil {
+			return 0, 0, 0, 0, fmt.Errorf("coordinates string must contain 4 comma separated integers, got %q", coord)
+		}
+	}
+	return values[0], values[1], values[2], values[3], nil
+}
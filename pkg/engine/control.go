@@ -0,0 +1,234 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"path/filepath"
+	"time"
+
+	ob "github.com/8ff/firescrew/pkg/objectPredict"
+	"github.com/8ff/firescrew/pkg/tracker"
+)
+
+// Commands of the control API, the MQTT command topic takes the same ones
+const (
+	CommandArm         = "arm"          // Arm everything regardless of the schedules
+	CommandDisarm      = "disarm"       // Disarm everything regardless of the schedules
+	CommandSchedule    = "schedule"     // Follow the schedules again
+	CommandRecordStart = "record_start" // Start an event that is recorded until record_stop, or hold the active one open
+	CommandRecordStop  = "record_stop"  // Release the event, it ends once nothing was detected for eventGap
+	commandSnapshot    = "snapshot"     // Only served over HTTP
+)
+
+var controlTimeout = 5 * time.Second // How long control requests wait for the frame loop of a camera
+
+var ErrUnknownCamera = errors.New("unknown camera")
+var errNoManualRecording = errors.New("no manual recording is running")
+
+// cameraCommand is a control request handled by the frame loop, which owns the event state and the current frame
+type cameraCommand struct {
+	name  string
+	ctx   context.Context   // Done when the caller gave up
+	reply chan commandReply // Buffered, the frame loop never waits for the caller
+}
+
+type commandReply struct {
+	eventID string
+	jpeg    []byte
+	err     error
+}
+
+// Control runs a command on a camera. Record commands return the ID of the event they started or released.
+func (e *Engine) Control(cameraName, command string) (string, error) {
+	camera := e.camera(cameraName)
+	if camera == nil {
+		return "", fmt.Errorf("%w %s", ErrUnknownCamera, cameraName)
+	}
+
+	switch command {
+	case CommandArm, CommandDisarm, CommandSchedule:
+		override := map[string]string{CommandArm: "armed", CommandDisarm: "disarmed", CommandSchedule: ""}[command]
+		camera.armMutex.Lock()
+		camera.armOverride = override
+		camera.armMutex.Unlock()
+		camera.updateArmState(time.Now(), false)
+		return "", nil
+	case CommandRecordStart, CommandRecordStop:
+		reply := camera.request(command)
+		return reply.eventID, reply.err
+	}
+	return "", fmt.Errorf("unknown command %q", command)
+}
+
+// Snapshot returns the frame a camera analysed last as JPEG, with the boxes of the objects detected in it
+func (e *Engine) Snapshot(cameraName string) ([]byte, error) {
+	camera := e.camera(cameraName)
+	if camera == nil {
+		return nil, fmt.Errorf("%w %s", ErrUnknownCamera, cameraName)
+	}
+	reply := camera.request(commandSnapshot)
+	return reply.jpeg, reply.err
+}
+
+// camera returns the running camera called name or nil
+func (e *Engine) camera(name string) *Camera {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	for _, camera := range e.cameras {
+		if camera.Config.CameraName == name {
+			return camera
+		}
+	}
+	return nil
+}
+
+// request hands a command to the frame loop and waits up to controlTimeout for it to be handled
+func (c *Camera) request(command string) commandReply {
+	ctx, cancel := context.WithTimeout(context.Background(), controlTimeout)
+	defer cancel()
+
+	cmd := &cameraCommand{name: command, ctx: ctx, reply: make(chan commandReply, 1)}
+	select {
+	case c.commands <- cmd:
+	case <-ctx.Done():
+		return commandReply{err: fmt.Errorf("camera %s is busy", c.Config.CameraName)}
+	}
+	select {
+	case reply := <-cmd.reply:
+		return reply
+	case <-ctx.Done():
+		return commandReply{err: fmt.Errorf("camera %s didn't analyse a frame within %s", c.Config.CameraName, controlTimeout)}
+	}
+}
+
+// handleCommands runs the queued control requests, frame is the frame that was just analysed
+func (c *Camera) handleCommands(frame *image.RGBA) {
+	for {
+		select {
+		case cmd := <-c.commands:
+			if cmd.ctx.Err() != nil {
+				continue // The caller gave up
+			}
+			switch cmd.name {
+			case CommandRecordStart:
+				cmd.reply <- c.startManualRecording(time.Now())
+			case CommandRecordStop:
+				cmd.reply <- c.stopManualRecording()
+			case commandSnapshot:
+				data, err := annotatedJPEG(frame, c.tracker.Tracks())
+				cmd.reply <- commandReply{jpeg: data, err: err}
+			}
+		default:
+			return
+		}
+	}
+}
+
+// startManualRecording starts a recorded event, or records and holds the active one, regardless of what is armed
+func (c *Camera) startManualRecording(now time.Time) commandReply {
+	if !c.MotionTriggered {
+		c.endingEvents.Wait() // The previous event must be written before MotionVideo is reused
+	}
+
+	c.MotionMutex.Lock()
+	defer c.MotionMutex.Unlock()
+
+	if !c.MotionTriggered {
+		c.MotionTriggered = true
+		c.MotionTriggeredLast = now
+		c.recording = false
+		c.MotionVideo.CameraName = c.Config.CameraName
+		c.MotionVideo.MotionStart = now
+		c.MotionVideo.ID = generateRandomString(15)
+		c.emitDetection(EventMotionStart, c.motionEvent(EventMotionStart, now))
+	}
+	if !c.recording {
+		c.recording = true
+		c.MotionVideo.VideoFile = fmt.Sprintf("clip_%s.ts", c.MotionVideo.ID)
+		c.HiResControlChannel <- RecordMsg{Record: true, Filename: filepath.Join(c.Config.HiResPath, c.MotionVideo.VideoFile)}
+	}
+	c.manual = true
+	c.MotionVideo.Manual = true
+
+	Log("info", fmt.Sprintf("[%s] Manual recording of event %s started", c.Config.CameraName, c.MotionVideo.ID))
+	return commandReply{eventID: c.MotionVideo.ID}
+}
+
+// stopManualRecording releases the event held by startManualRecording, it ends like any other event
+func (c *Camera) stopManualRecording() commandReply {
+	c.MotionMutex.Lock()
+	defer c.MotionMutex.Unlock()
+
+	if !c.manual {
+		return commandReply{err: errNoManualRecording}
+	}
+	c.manual = false
+	Log("info", fmt.Sprintf("[%s] Manual recording of event %s stopped", c.Config.CameraName, c.MotionVideo.ID))
+	return commandReply{eventID: c.MotionVideo.ID}
+}
+
+// annotatedJPEG draws the boxes of the objects that were detected in frame on a copy of it
+func annotatedJPEG(frame *image.RGBA, tracks []tracker.Track) ([]byte, error) {
+	annotated := cloneRGBA(frame)
+	for _, track := range tracks {
+		if track.Misses > 0 {
+			continue // Not detected in this frame
+		}
+		ob.DrawRectangle(annotated, track.Box, color.RGBA{255, 165, 0, 255}, 2)
+
+		pt := image.Pt(track.Box.Min.X, track.Box.Min.Y-5)
+		if track.Box.Min.Y-5 < 0 {
+			pt = image.Pt(track.Box.Min.X, track.Box.Min.Y+20) // if the box is too close to the top of the image, put the label inside the box
+		}
+		ob.AddLabelWithTTF(annotated, fmt.Sprintf("#%d %s %.2f", track.ID, track.Class, track.Confidence), pt, color.RGBA{255, 165, 0, 255}, 12.0)
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, annotated, &jpeg.Options{Quality: 90}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// validToken compares a token given by a client with api.token in constant time
+func validToken(given, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// CommandMessage is what the MQTT command topic takes, eg: {"camera": "front", "command": "disarm", "token": "..."}
+type CommandMessage struct {
+	Camera  string `json:"camera"`
+	Command string `json:"command"`
+	Token   string `json:"token"` // Must be api.token, without api.token every command is rejected
+}
+
+// handleCommandMessage runs a command received on api.commandTopic
+func (e *Engine) handleCommandMessage(topic string, payload []byte) {
+	var command CommandMessage
+	if err := json.Unmarshal(payload, &command); err != nil {
+		Log("error", fmt.Sprintf("Invalid MQTT command: %v", err))
+		return
+	}
+	token := e.Config().Api.Token
+	if token == "" {
+		Log("warning", fmt.Sprintf("Rejected MQTT command %s for %s: set api.token to enable commands", command.Command, command.Camera))
+		return
+	}
+	if !validToken(command.Token, token) {
+		Log("warning", fmt.Sprintf("Rejected MQTT command %s for %s: invalid token", command.Command, command.Camera))
+		return
+	}
+
+	if _, err := e.Control(command.Camera, command.Command); err != nil {
+		Log("error", fmt.Sprintf("MQTT command %s for %s failed: %v", command.Command, command.Camera, err))
+		return
+	}
+	Log("info", fmt.Sprintf("[%s] Ran MQTT command %s", command.Camera, command.Command))
+}
@@ -0,0 +1,168 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/8ff/firescrew/pkg/outbox"
+)
+
+var deliveryShutdownTimeout = 5 * time.Second // How long Stop keeps delivering queued events
+
+// queuedSink hands the events of a config sink to its outbox, which delivers them in the background so a slow or
+// unreachable sink never holds up a camera. Reload swaps the sink and keeps the queue.
+type queuedSink struct {
+	name   string // Of the outbox, see queueName
+	arm    string // Name of the sink in arm.notifications
+	outbox *outbox.Outbox
+
+	mutex sync.Mutex
+	sink  Sink
+}
+
+func (s *queuedSink) wants(event Event) bool {
+	s.mutex.Lock()
+	filter, ok := s.sink.(eventFilter)
+	s.mutex.Unlock()
+	return !ok || filter.wants(event)
+}
+
+func (s *queuedSink) wantsSnapshot() bool {
+	s.mutex.Lock()
+	attacher, ok := s.sink.(snapshotSink)
+	s.mutex.Unlock()
+	return ok && attacher.wantsSnapshot()
+}
+
+func (s *queuedSink) wantsAnimation() bool {
+	s.mutex.Lock()
+	animator, ok := s.sink.(animationSink)
+	s.mutex.Unlock()
+	return ok && animator.wantsAnimation()
+}
+
+// Send queues event, its snapshot is stored with it so every attempt sends the same
+func (s *queuedSink) Send(event Event) error {
+	s.outbox.Push(outbox.Message{Type: event.Type, CameraName: event.CameraName, Payload: event.Payload, Attachment: event.Snapshot, Data: event.Data})
+	return nil
+}
+
+// deliver sends an event of the outbox, events stored by an earlier run have no Data
+func (s *queuedSink) deliver(message outbox.Message) error {
+	s.mutex.Lock()
+	sink := s.sink
+	s.mutex.Unlock()
+
+	err := sink.Send(Event{Type: message.Type, CameraName: message.CameraName, Data: message.Data, Payload: message.Payload, Snapshot: message.Attachment})
+	if err != nil {
+		err = errors.New(Redact(err.Error())) // Ends up in the API status
+		Log("warning", fmt.Sprintf("Delivering %s event to %s failed: %v", message.Type, s.name, err))
+	}
+	return err
+}
+
+// queueSinks puts the named sinks behind their outbox, sinks of Options and Home Assistant are called directly.
+// Outboxes of sinks that are gone are closed, what they still hold is delivered once the sink comes back.
+// The caller holds lifecycle and mutex.
+func (e *Engine) queueSinks(sinks []Sink) []Sink {
+	queued := make([]Sink, len(sinks))
+	current := make(map[string]bool)
+	for i, sink := range sinks {
+		name := queueName(sink)
+		if name == "" {
+			queued[i] = sink
+			continue
+		}
+		current[name] = true
+
+		q := e.queues[name]
+		if q == nil {
+			q = e.newQueuedSink(name, sinkName(sink))
+			e.queues[name] = q
+		}
+		q.mutex.Lock()
+		q.sink = sink
+		q.mutex.Unlock()
+		queued[i] = q
+	}
+
+	for name, q := range e.queues {
+		if !current[name] {
+			go q.outbox.Close(0)
+			delete(e.queues, name)
+		}
+	}
+	return queued
+}
+
+// newQueuedSink creates the outbox of a sink from the delivery settings the engine started with. An outbox
+// folder that can't be used falls back to memory.
+func (e *Engine) newQueuedSink(name, arm string) *queuedSink {
+	q := &queuedSink{name: name, arm: arm}
+	config := outbox.Config{
+		QueueSize:  e.delivery.QueueSize,
+		MaxBackoff: time.Duration(e.delivery.RetryMaxSeconds) * time.Second,
+		MaxAge:     time.Duration(e.delivery.MaxAgeHours) * time.Hour,
+		Deliver:    q.deliver,
+		OnError: func(err error) {
+			Log("error", fmt.Sprintf("Outbox of %s: %v", name, err))
+		},
+	}
+	if e.delivery.OutboxPath != "" && !e.delivery.DisableOutbox {
+		config.Dir = filepath.Join(e.delivery.OutboxPath, name)
+	}
+
+	var err error
+	q.outbox, err = outbox.New(config)
+	if err != nil {
+		Log("error", fmt.Sprintf("Cannot use outbox %s, %s events are only kept in memory: %v", config.Dir, name, err))
+		config.Dir = ""
+		q.outbox, _ = outbox.New(config)
+	}
+	return q
+}
+
+// DeliveryStatus returns the delivery counters of the webhook, script, slack, mqtt and pushover sinks by outbox
+// name, eg: webhook-alarm for the webhook called alarm
+func (e *Engine) DeliveryStatus() map[string]outbox.Stats {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	status := make(map[string]outbox.Stats)
+	for name, q := range e.queues {
+		status[name] = q.outbox.Stats()
+	}
+	return status
+}
+
+// closeQueues delivers what the outboxes hold for up to deliveryShutdownTimeout, the rest is delivered after the
+// next start. The closed outboxes are dropped, Stop can be called again.
+func (e *Engine) closeQueues() {
+	names := make([]string, 0, len(e.queues))
+	for name := range e.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(q *queuedSink) {
+			defer wg.Done()
+			q.outbox.Close(deliveryShutdownTimeout)
+		}(e.queues[name])
+	}
+	wg.Wait()
+	for _, name := range names {
+		if queued := e.queues[name].outbox.Stats().Queued; queued > 0 {
+			Log("warning", fmt.Sprintf("%d events for %s weren't delivered", queued, name))
+		}
+	}
+
+	e.mutex.Lock()
+	clear(e.queues)
+	e.mutex.Unlock()
+}
@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Settings that are only read when the engine starts
+var processRestartPaths = []string{
+	"motion.detector",
+	"motion.onnxModel",
+	"motion.onnxEnableCoreMl",
+	"motion.embeddedObjectScript",
+	"motion.networkObjectDetectServer",
+	"motion.mockPredictions",
+	"api.addr",
+	"events.delivery.queueSize",
+	"events.delivery.retryMaxSeconds",
+	"events.delivery.maxAgeHours",
+	"events.delivery.outboxPath",
+	"events.delivery.disableOutbox",
+}
+
+// needsProcessRestart reports if the setting at path can't be changed by a reload
+func needsProcessRestart(path string) bool {
+	for _, restartPath := range processRestartPaths {
+		if path == restartPath || strings.HasPrefix(path, restartPath+"[") || strings.HasPrefix(path, restartPath+".") {
+			return true
+		}
+	}
+	// The output stream http server can't be moved
+	return strings.HasSuffix(path, "enableOutputStream") || strings.HasSuffix(path, "outputStreamAddr")
+}
+
+// diffConfig returns the JSON paths of every setting that differs between old and new, eg: cameras[1].lookForClasses
+func diffConfig(old, new Config) []string {
+	var changed []string
+	diffValue("", toJSONValue(old), toJSONValue(new), &changed)
+	return changed
+}
+
+// toJSONValue turns v into the maps and slices encoding/json decodes into, so any config can be walked the same way
+func toJSONValue(v any) any {
+	var value any
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	json.Unmarshal(data, &value)
+	return value
+}
+
+func diffValue(path string, old, new any, changed *[]string) {
+	oldMap, oldIsMap := old.(map[string]any)
+	newMap, newIsMap := new.(map[string]any)
+	if oldIsMap && newIsMap {
+		keys := make([]string, 0, len(oldMap)+len(newMap))
+		for key := range oldMap {
+			keys = append(keys, key)
+		}
+		for key := range newMap {
+			if _, ok := oldMap[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+			diffValue(keyPath, oldMap[key], newMap[key], changed)
+		}
+		return
+	}
+
+	// Lists of the same length are compared item by item, otherwise the whole list changed
+	oldList, oldIsList := old.([]any)
+	newList, newIsList := new.([]any)
+	if oldIsList && newIsList && len(oldList) == len(newList) {
+		for i := range oldList {
+			diffValue(fmt.Sprintf("%s[%d]", path, i), oldList[i], newList[i], changed)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(old, new) {
+		*changed = append(*changed, path)
+	}
+}
@@ -0,0 +1,430 @@
+// Package engine runs the firescrew pipeline: it reads camera feeds, runs motion and object detection on them,
+// records events and hands the resulting events to sinks. The firescrew binary is a thin CLI around it, other
+// programs can embed it the same way:
+//
+//	e, err := engine.New(config, engine.Options{
+//		Sinks: []engine.Sink{engine.SinkFunc(func(event engine.Event) error {
+//			fmt.Println(event.Type, string(event.Payload))
+//			return nil
+//		})},
+//	})
+//	...
+//	err = e.Start(ctx)
+//	...
+//	e.Stop()
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/8ff/firescrew/pkg/counters"
+	"github.com/8ff/firescrew/pkg/detector"
+	"github.com/8ff/firescrew/pkg/events"
+	"github.com/8ff/firescrew/pkg/mqttClient"
+	"github.com/8ff/firescrew/pkg/schedule"
+)
+
+var interenceAvgInterval = 10                // Frames to average inference time over
+var recodeShutdownTimeout = 30 * time.Second // How long Stop waits for pending mp4 recodes
+var objectLostTimeout = 5 * time.Second      // Objects in a zone that weren't detected this long have left it
+
+// Options replace parts of the pipeline described by the config
+type Options struct {
+	Detector     detector.Detector      // Used instead of the one from config.Motion. The engine starts it but doesn't close it
+	Sinks        []Sink                 // Receive every event, in addition to the sinks of the config events section
+	FrameSources map[string]FrameSource // By camera name, replaces the ffmpeg/native feed of that camera
+}
+
+type Engine struct {
+	options      Options
+	detector     detector.Detector
+	ownsDetector bool // Created from the config, closed by Stop
+
+	mutex     sync.RWMutex // Guards config, sinks, schedules and cameras, which Reload replaces while cameras run
+	config    Config
+	sinks     []Sink
+	schedules map[string]*schedule.Schedule // By name
+	api       *http.Server                  // Serves the API when api.addr is set
+	mqtt      *mqttClient.Client            // Connection to the events.mqtt broker, nil without one. Written under lifecycle
+
+	homeAssistant *homeAssistant // Discovery and entity states, a sink while events.mqtt.homeAssistant.discovery is on
+
+	delivery DeliveryConfig         // events.delivery the engine started with, outboxes are created from it
+	queues   map[string]*queuedSink // Outboxes of the config sinks by sink name, written under lifecycle and mutex
+
+	lifecycle sync.Mutex      // Serializes Start, Reload and Stop
+	cameras   []*Camera       // Written under lifecycle and mutex
+	ctx       context.Context // Parent of every camera pipeline, set by Start
+	cancel    context.CancelFunc
+	stopped   bool
+	wg        sync.WaitGroup // Running camera pipelines
+
+	countersMutex sync.Mutex
+	counters      map[string]*counters.Store // Line crossing counts by recordings folder
+
+	// Pending mp4 recodes, Stop waits for them and cancels whatever is left after recodeShutdownTimeout
+	recodeWg      sync.WaitGroup
+	recodeCtx     context.Context
+	cancelRecodes context.CancelFunc
+}
+
+// New normalizes config and sets up a camera for every entry, nothing is started yet
+func New(config Config, options Options) (*Engine, error) {
+	err := config.Normalize()
+	if err != nil {
+		return nil, err
+	}
+	SetPrintDebug(config.PrintDebug)
+	AddSecrets(config.Secrets()...)
+
+	e := &Engine{
+		config:    config,
+		options:   options,
+		schedules: compileSchedules(config),
+		detector:  options.Detector,
+		delivery:  config.Events.Delivery,
+		queues:    make(map[string]*queuedSink),
+	}
+	e.mqtt, err = newMqttClient(config, e.handleCommandMessage)
+	if err != nil {
+		return nil, err
+	}
+	e.homeAssistant = newHomeAssistant(e)
+	e.homeAssistant.update(config, e.mqtt)
+	e.sinks = e.queueSinks(e.configSinks(config, e.mqtt))
+	e.recodeCtx, e.cancelRecodes = context.WithCancel(context.Background())
+
+	for _, cameraConfig := range config.Cameras {
+		e.cameras = append(e.cameras, e.newCamera(cameraConfig))
+	}
+	return e, nil
+}
+
+func (e *Engine) newCamera(config CameraConfig) *Camera {
+	camera := newCamera(e, config)
+	camera.source = e.options.FrameSources[config.CameraName]
+	return camera
+}
+
+// Config returns the normalized config the engine runs with
+func (e *Engine) Config() Config {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.config
+}
+
+// Probe looks up the stream params of every camera, from the config bypass or with ffprobe.
+// Start calls it if it wasn't called before, calling it first allows failing early.
+func (e *Engine) Probe() error {
+	e.lifecycle.Lock()
+	defer e.lifecycle.Unlock()
+	return probeCameras(e.cameras)
+}
+
+// probeCameras probes the cameras that weren't probed yet
+func probeCameras(cameras []*Camera) error {
+	for _, camera := range cameras {
+		if camera.probed {
+			continue
+		}
+		if err := camera.probeStreams(); err != nil {
+			return fmt.Errorf("[%s] %v", camera.Config.CameraName, err)
+		}
+		camera.probed = true
+	}
+	return nil
+}
+
+// Start starts the detector and every camera pipeline, they all share the same detector.
+// The pipelines run until ctx is done or Stop is called.
+func (e *Engine) Start(ctx context.Context) error {
+	e.lifecycle.Lock()
+	defer e.lifecycle.Unlock()
+
+	if err := probeCameras(e.cameras); err != nil {
+		return err
+	}
+
+	if e.detector == nil {
+		d, err := detector.New(detector.Config{
+			Backend:          e.config.Motion.Detector,
+			OnnxModel:        e.config.Motion.OnnxModel,
+			OnnxEnableCoreMl: e.config.Motion.OnnxEnableCoreMl,
+			NetworkAddr:      e.config.Motion.NetworkObjectDetectServer,
+			MockPredictions:  e.config.Motion.MockPredictions,
+		})
+		if err != nil {
+			return fmt.Errorf("Cannot create detector: %v", err)
+		}
+		e.detector = d
+		e.ownsDetector = true
+		Log("info", fmt.Sprintf("Starting %s detector", e.config.Motion.Detector))
+	}
+
+	err := e.detector.Start(ctx)
+	if err != nil {
+		return fmt.Errorf("Cannot start detector: %v", err)
+	}
+
+	e.ctx, e.cancel = context.WithCancel(ctx)
+	for _, camera := range e.cameras {
+		e.startCamera(camera)
+	}
+	if e.config.Api.Addr != "" {
+		e.startApi(e.config.Api.Addr)
+	}
+	if e.mqtt != nil {
+		e.mqtt.Connect()
+	}
+	return nil
+}
+
+func (e *Engine) startCamera(camera *Camera) {
+	ctx, cancel := context.WithCancel(e.ctx)
+	camera.cancel = cancel
+	camera.done = make(chan struct{})
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+		defer close(camera.done)
+		camera.run(ctx)
+	}()
+}
+
+// stopCamera stops a single pipeline and waits until it ended its active event
+func (e *Engine) stopCamera(camera *Camera) {
+	camera.cancel()
+	<-camera.done
+}
+
+// Reload validates config and applies it to the engine, nothing changes if it is invalid.
+// Thresholds, classes, ignore areas, notifications and sinks apply to the running cameras. Cameras whose
+// streams changed are restarted, new cameras are started and removed ones stopped. Detector and output
+// stream settings are only read on startup. A config_reloaded event summarizes the changes.
+func (e *Engine) Reload(config Config) error {
+	err := config.Normalize()
+	if err != nil {
+		return err
+	}
+	AddSecrets(config.Secrets()...)
+
+	e.lifecycle.Lock()
+	defer e.lifecycle.Unlock()
+
+	if e.stopped {
+		return errors.New("engine is stopped")
+	}
+
+	old := e.Config()
+	event := ConfigReloadedEvent{
+		Header:          events.NewHeader(EventConfigReloaded, "", time.Now()),
+		Changed:         diffConfig(old, config),
+		Restarted:       []string{}, // Lists are never null in events
+		Added:           []string{},
+		Removed:         []string{},
+		RestartRequired: []string{},
+	}
+	if len(event.Changed) == 0 {
+		Log("info", "Config reloaded, nothing changed")
+		return nil
+	}
+	for _, path := range event.Changed {
+		if needsProcessRestart(path) {
+			event.RestartRequired = append(event.RestartRequired, path)
+		}
+	}
+
+	// Match cameras by name, unchanged streams keep running
+	oldConfigs := make(map[string]CameraConfig)
+	for _, cameraConfig := range old.Cameras {
+		oldConfigs[cameraConfig.CameraName] = cameraConfig
+	}
+	running := make(map[string]*Camera)
+	for _, camera := range e.cameras {
+		running[camera.Config.CameraName] = camera
+	}
+
+	var cameras, starting, stopping []*Camera
+	updates := make(map[*Camera]CameraConfig)
+	for _, cameraConfig := range config.Cameras {
+		name := cameraConfig.CameraName
+		camera, exists := running[name]
+		delete(running, name)
+		if exists && !cameraNeedsRestart(oldConfigs[name], cameraConfig) {
+			updates[camera] = cameraConfig
+			cameras = append(cameras, camera)
+			continue
+		}
+
+		if exists {
+			event.Restarted = append(event.Restarted, name)
+			stopping = append(stopping, camera)
+		} else {
+			event.Added = append(event.Added, name)
+		}
+		camera = e.newCamera(cameraConfig)
+		cameras = append(cameras, camera)
+		starting = append(starting, camera)
+	}
+	for name, camera := range running {
+		event.Removed = append(event.Removed, name)
+		stopping = append(stopping, camera)
+	}
+	sort.Strings(event.Removed)
+
+	// Probe before anything is stopped so a bad stream keeps the old config running
+	if e.ctx != nil {
+		if err := probeCameras(starting); err != nil {
+			return err
+		}
+	}
+
+	client, err := e.reloadMqtt(old, config)
+	if err != nil {
+		return err
+	}
+	e.mutex.Lock()
+	e.config = config
+	e.sinks = e.queueSinks(e.configSinks(config, client))
+	e.schedules = compileSchedules(config)
+	e.mutex.Unlock()
+	SetPrintDebug(config.PrintDebug)
+
+	e.homeAssistant.update(config, client)
+	if client != e.mqtt {
+		// The old connection goes first, its offline message must not follow the online of the new one
+		if e.mqtt != nil {
+			e.mqtt.Close()
+		}
+		if client != nil && e.ctx != nil {
+			client.Connect()
+		}
+		e.mqtt = client
+	}
+
+	for camera, cameraConfig := range updates {
+		camera.updateConfig(cameraConfig)
+	}
+	if e.ctx != nil {
+		for _, camera := range stopping {
+			e.stopCamera(camera)
+		}
+		for _, camera := range starting {
+			e.startCamera(camera)
+		}
+	}
+	e.mutex.Lock()
+	e.cameras = cameras
+	e.mutex.Unlock()
+
+	Log("notice", fmt.Sprintf("Config reloaded, changed: %s", strings.Join(event.Changed, ", ")))
+	if len(event.RestartRequired) > 0 {
+		Log("warning", fmt.Sprintf("These settings only apply after a restart: %s", strings.Join(event.RestartRequired, ", ")))
+	}
+	e.emit(EventConfigReloaded, "", event)
+	return nil
+}
+
+// Stop stops every camera, which ends active events and flushes their recordings. Pending recodes get
+// recodeShutdownTimeout to finish, whatever is left is cancelled and keeps its .ts file. A detector created
+// from the config is closed last.
+func (e *Engine) Stop() {
+	e.lifecycle.Lock()
+	defer e.lifecycle.Unlock()
+
+	e.stopped = true
+	if e.cancel != nil {
+		e.cancel()
+	}
+	e.wg.Wait()
+	if e.api != nil {
+		e.api.Close()
+	}
+
+	recodesDone := make(chan struct{})
+	go func() {
+		e.recodeWg.Wait()
+		close(recodesDone)
+	}()
+	select {
+	case <-recodesDone:
+	case <-time.After(recodeShutdownTimeout):
+		Log("warning", fmt.Sprintf("Recodes still running after %s, cancelling them", recodeShutdownTimeout))
+		e.cancelRecodes()
+		<-recodesDone
+	}
+
+	e.closeQueues() // After the recodes, they send events as well
+	if e.mqtt != nil {
+		e.mqtt.Close()
+	}
+	if e.ownsDetector && e.detector != nil {
+		e.detector.Close()
+	}
+}
+
+// emit hands an event to every sink, a failing sink doesn't keep the others from getting it.
+// Secrets are masked in the payload, it ends up in third party services.
+func (e *Engine) emit(eventType string, cameraName string, data any) {
+	e.emitTo(eventType, cameraName, data, nil, nil)
+}
+
+// snapshotFunc takes the snapshot of an event, animated asks for a GIF of the event where there is one
+type snapshotFunc func(animated bool) ([]byte, error)
+
+// emitTo is emit for the sinks that are armed in notifications, by sink name. Sinks of Options have no name
+// and always get the event, nil notifications reach every sink. snapshot is called once per kind if a sink
+// attaches snapshots, nil sends none.
+func (e *Engine) emitTo(eventType string, cameraName string, data any, notifications map[string]bool, snapshot snapshotFunc) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		Log("error", fmt.Sprintf("Error marshalling %s event: %v", eventType, err))
+		return
+	}
+	payload = []byte(Redact(string(payload)))
+
+	e.mutex.RLock()
+	sinks := e.sinks
+	e.mutex.RUnlock()
+
+	event := Event{Type: eventType, CameraName: cameraName, Data: data, Payload: payload}
+	taken := make(map[bool][]byte) // By animated, every sink asking for a kind gets the same
+	takeSnapshot := func(animated bool) []byte {
+		if snapshot == nil {
+			return nil
+		}
+		if snap, ok := taken[animated]; ok {
+			return snap
+		}
+		snap, err := snapshot(animated)
+		if err != nil {
+			Log("warning", fmt.Sprintf("Sending %s event without snapshot: %v", eventType, err))
+		}
+		taken[animated] = snap
+		return snap
+	}
+	for _, sink := range sinks {
+		if name := sinkName(sink); notifications != nil && name != "" && !notifications[name] {
+			continue
+		}
+		if filter, ok := sink.(eventFilter); ok && !filter.wants(event) {
+			continue
+		}
+		sinkEvent := event // Only sinks asking for the snapshot get it
+		if attacher, ok := sink.(snapshotSink); ok && attacher.wantsSnapshot() {
+			animator, ok := sink.(animationSink)
+			sinkEvent.Snapshot = takeSnapshot(ok && animator.wantsAnimation())
+		}
+		if err := sink.Send(sinkEvent); err != nil {
+			Log("error", err.Error())
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const envPrefix = "FIRESCREW_"
+
+// ApplyEnv overrides settings of a JSON config with FIRESCREW_* environment variables. The variable name is the
+// JSON path of the setting in upper snake case, list entries by index, eg: FIRESCREW_MOTION_EVENT_GAP=30 or
+// FIRESCREW_CAMERAS_0_DEVICE_URL. A _FILE suffix reads the value from a file instead, eg:
+// FIRESCREW_EVENTS_MQTT_PASS_FILE=/run/secrets/mqtt. Lists and objects are given as JSON, string lists may
+// also be comma separated. environ is in the format of os.Environ.
+func ApplyEnv(data []byte, environ []string) ([]byte, Diagnostics) {
+	var diags Diagnostics
+
+	var raw any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return data, nil // ValidateJSON reports it
+	}
+	root, ok := raw.(map[string]any)
+	if !ok {
+		return data, nil
+	}
+
+	values := make(map[string]string)
+	for _, entry := range environ {
+		name, value, _ := strings.Cut(entry, "=")
+		if strings.HasPrefix(name, envPrefix) {
+			values[name] = value
+		}
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	applied := false
+	for _, name := range names {
+		value := values[name]
+		words := strings.Split(strings.TrimPrefix(name, envPrefix), "_")
+		path, t, ok := resolveEnvPath(words, reflect.TypeOf(Config{}))
+		if !ok && len(words) > 1 && words[len(words)-1] == "FILE" {
+			path, t, ok = resolveEnvPath(words[:len(words)-1], reflect.TypeOf(Config{}))
+			if ok {
+				if _, exists := values[strings.TrimSuffix(name, "_FILE")]; exists {
+					diags.Error(name, "%s is set as well, only one of them can be used", strings.TrimSuffix(name, "_FILE"))
+					continue
+				}
+				content, err := os.ReadFile(value)
+				if err != nil {
+					diags.Error(name, "%v", err)
+					continue
+				}
+				value = strings.TrimRight(string(content), "\r\n")
+			}
+		}
+		if !ok {
+			diags.Warning(name, "does not match any config setting")
+			continue
+		}
+
+		jsonValue, err := envValue(value, t)
+		if err != nil {
+			// The value isn't part of the message, it might be a secret
+			diags.Error(name, "expected %s", typeName(t))
+			continue
+		}
+		if err := setJSONPath(root, path, jsonValue); err != nil {
+			diags.Error(name, "%v", err)
+			continue
+		}
+		applied = true
+	}
+
+	if !applied {
+		return data, diags
+	}
+	data, err := json.Marshal(root)
+	if err != nil {
+		diags.Error("", "%v", err)
+	}
+	return data, diags
+}
+
+// resolveEnvPath finds the setting an environment variable name refers to, it returns the JSON keys and list
+// indexes leading to it and its type
+func resolveEnvPath(words []string, t reflect.Type) ([]any, reflect.Type, bool) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if len(words) == 0 {
+		return nil, t, true
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+
+			fieldWords := strings.Split(snakeCase(name), "_")
+			if len(fieldWords) > len(words) || !slices.Equal(fieldWords, words[:len(fieldWords)]) {
+				continue
+			}
+			if path, t, ok := resolveEnvPath(words[len(fieldWords):], field.Type); ok {
+				return append([]any{name}, path...), t, true
+			}
+		}
+	case reflect.Slice:
+		index, err := strconv.Atoi(words[0])
+		if err != nil || index < 0 {
+			return nil, nil, false
+		}
+		if path, t, ok := resolveEnvPath(words[1:], t.Elem()); ok {
+			return append([]any{index}, path...), t, true
+		}
+	}
+	return nil, nil, false
+}
+
+// snakeCase turns a JSON key into the upper snake case used by environment variables, eg: hiResDeviceUrl -> HI_RES_DEVICE_URL
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			previousLower := unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if previousLower || (unicode.IsUpper(runes[i-1]) && nextLower) {
+				b.WriteRune('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// envValue converts an environment variable into the JSON value for a setting of type t
+func envValue(value string, t reflect.Type) (any, error) {
+	switch t.Kind() {
+	case reflect.String:
+		return value, nil
+	case reflect.Bool:
+		return strconv.ParseBool(value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.ParseInt(value, 10, 64)
+	case reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(value, 64)
+	}
+
+	var result any
+	err := json.Unmarshal([]byte(value), &result)
+	if err != nil && t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String {
+		// Comma separated string list
+		var items []any
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		return items, nil
+	}
+	return result, err
+}
+
+// setJSONPath sets a value in a decoded JSON document, missing objects are created. Lists can be extended by
+// one entry at a time.
+func setJSONPath(node map[string]any, path []any, value any) error {
+	var current any = node
+	for i, segment := range path {
+		last := i == len(path)-1
+		switch key := segment.(type) {
+		case string:
+			object, ok := current.(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s is not an object in the config", key)
+			}
+			// encoding/json matches keys case insensitively, override the key the config uses
+			for existing := range object {
+				if strings.EqualFold(existing, key) {
+					key = existing
+					break
+				}
+			}
+			if last {
+				object[key] = value
+				return nil
+			}
+			if object[key] == nil {
+				if _, isIndex := path[i+1].(int); isIndex {
+					object[key] = []any{}
+				} else {
+					object[key] = map[string]any{}
+				}
+			}
+			if list, ok := object[key].([]any); ok {
+				index, isIndex := path[i+1].(int)
+				if !isIndex {
+					return fmt.Errorf("%s is a list in the config, expected an object", key)
+				}
+				// Lists are replaced when extended, keep the parent pointing at the new one
+				if index == len(list) {
+					list = append(list, nil)
+					object[key] = list
+				}
+			}
+			current = object[key]
+		case int:
+			list, ok := current.([]any)
+			if !ok {
+				return fmt.Errorf("not a list in the config")
+			}
+			if key >= len(list) {
+				return fmt.Errorf("index %d is out of range, the list has %d entries", key, len(list))
+			}
+			if last {
+				list[key] = value
+				return nil
+			}
+			if list[key] == nil {
+				list[key] = map[string]any{}
+			}
+			current = list[key]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package engine
+
+import (
+	"time"
+
+	"github.com/8ff/firescrew/pkg/events"
+)
+
+// Event types
+const (
+	EventMotionStart        = events.TypeMotionStart
+	EventMotionUpdate       = events.TypeMotionUpdate
+	EventMotionEnd          = events.TypeMotionEnd
+	EventInferenceAvg       = events.TypeInference
+	EventError              = events.TypeError
+	EventAnalysisFpsChanged = events.TypeAnalysisFps
+	EventConfigReloaded     = events.TypeConfigReloaded
+	EventZoneEnter          = events.TypeZoneEnter
+	EventZoneExit           = events.TypeZoneExit
+	EventZoneDwell          = events.TypeZoneDwell
+	EventLineCrossed        = events.TypeLineCrossed
+	EventObjectArrived      = events.TypeObjectArrived
+	EventObjectDeparted     = events.TypeObjectDeparted
+	EventScheduleChanged    = events.TypeScheduleChanged
+)
+
+var eventTypes = []string{
+	EventMotionStart, EventMotionUpdate, EventMotionEnd, EventInferenceAvg, EventError, EventAnalysisFpsChanged,
+	EventConfigReloaded, EventZoneEnter, EventZoneExit, EventZoneDwell, EventLineCrossed, EventObjectArrived,
+	EventObjectDeparted, EventScheduleChanged,
+}
+
+// Event is what sinks receive. Data holds one of the typed events below, Payload is its JSON encoding
+// with secrets masked, which is what webhooks, scripts, slack and mqtt get.
+type Event struct {
+	Type       string
+	CameraName string
+	Data       any
+	Payload    []byte
+	Snapshot   []byte // JPEG of the camera when the event happened, only taken when a webhook attaches snapshots
+}
+
+// Every event follows the versioned schema of pkg/events
+type (
+	MotionEvent             = events.MotionEvent
+	MotionEndEvent          = events.MotionEndEvent
+	InferenceStatsEvent     = events.InferenceEvent
+	ErrorEvent              = events.ErrorEvent
+	AnalysisFpsChangedEvent = events.AnalysisFpsChangedEvent
+	ConfigReloadedEvent     = events.ConfigReloadedEvent
+	ZoneEvent               = events.ZoneEvent
+	LineCrossedEvent        = events.LineCrossedEvent
+	ObjectEvent             = events.ObjectEvent
+	ScheduleChangedEvent    = events.ScheduleChangedEvent // It reaches every sink, even disarmed ones
+)
+
+var errorEventInterval = time.Minute // How often the same error of a camera is sent
@@ -0,0 +1,346 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type StreamInfo struct {
+	Streams []struct {
+		Width      int     `json:"width"`
+		Height     int     `json:"height"`
+		CodecType  string  `json:"codec_type"`
+		CodecName  string  `json:"codec_name"`
+		RFrameRate float64 `json:"-"`
+	} `json:"streams"`
+}
+
+// RecordMsg struct to control recording
+type RecordMsg struct {
+	Record   bool
+	Filename string
+}
+
+type FrameMsg struct {
+	Frame image.Image
+	Error string
+	// Exited   bool
+	ExitCode int
+	Received time.Time // When the frame was taken off the feed
+}
+
+// framePool hands out reusable RGBA frames of a fixed size so the raw video pipe doesn't allocate for every frame
+type framePool struct {
+	rect image.Rectangle
+	pool sync.Pool
+}
+
+func newFramePool(width, height int) *framePool {
+	p := &framePool{rect: image.Rect(0, 0, width, height)}
+	p.pool.New = func() any {
+		return image.NewRGBA(p.rect)
+	}
+	return p
+}
+
+func (p *framePool) Get() *image.RGBA {
+	return p.pool.Get().(*image.RGBA)
+}
+
+// Put returns a frame to the pool, frames of another size are left to the GC
+func (p *framePool) Put(img *image.RGBA) {
+	if img == nil || img.Rect != p.rect {
+		return
+	}
+	p.pool.Put(img)
+}
+
+// FrameSize is the number of bytes in a single rgba frame
+func (p *framePool) FrameSize() int {
+	return p.rect.Dx() * p.rect.Dy() * 4
+}
+
+// readRawFrame reads exactly one rgba frame from r into a frame from pool
+func readRawFrame(r io.Reader, pool *framePool) (*image.RGBA, error) {
+	frame := pool.Get()
+	if _, err := io.ReadFull(r, frame.Pix[:pool.FrameSize()]); err != nil {
+		pool.Put(frame)
+		return nil, err
+	}
+	return frame, nil
+}
+
+func getStreamInfo(rtspURL string) (StreamInfo, error) {
+	// Create a context that will time out
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "ffprobe", "-rtsp_transport", "tcp", "-v", "quiet", "-print_format", "json", "-show_streams", rtspURL)
+	output, err := cmd.Output()
+	if err != nil {
+		Log("debug", fmt.Sprintf("ffprobe output: %s", output))
+		return StreamInfo{}, err
+	}
+
+	Log("debug", fmt.Sprintf("ffprobe url: %s output: %s", rtspURL, output))
+
+	// Unmarshal into a temporary structure to get the raw frame rate
+	var rawInfo struct {
+		Streams []struct {
+			Width      int    `json:"width"`
+			Height     int    `json:"height"`
+			CodecType  string `json:"codec_type"`
+			CodecName  string `json:"codec_name"`
+			RFrameRate string `json:"r_frame_rate"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(output, &rawInfo); err != nil {
+		return StreamInfo{}, err
+	}
+
+	// Process the streams, converting the frame rate and filtering as needed
+	var info StreamInfo
+	for _, stream := range rawInfo.Streams {
+		if stream.Width == 0 || stream.Height == 0 {
+			continue // Skip streams with zero values
+		}
+		frParts := strings.Split(stream.RFrameRate, "/")
+		if len(frParts) == 2 {
+			numerator, err1 := strconv.Atoi(frParts[0])
+			denominator, err2 := strconv.Atoi(frParts[1])
+			if err1 != nil || err2 != nil || denominator == 0 {
+				return StreamInfo{}, fmt.Errorf("invalid frame rate: %s", stream.RFrameRate)
+			}
+			frameRate := float64(numerator) / float64(denominator) // Calculate FPS
+			info.Streams = append(info.Streams, struct {
+				Width      int     `json:"width"`
+				Height     int     `json:"height"`
+				CodecType  string  `json:"codec_type"`
+				CodecName  string  `json:"codec_name"`
+				RFrameRate float64 `json:"-"`
+			}{
+				Width:      stream.Width,
+				Height:     stream.Height,
+				CodecType:  stream.CodecType,
+				CodecName:  stream.CodecName,
+				RFrameRate: frameRate,
+			})
+		}
+	}
+
+	return info, nil
+}
+
+func CheckFFmpegAndFFprobe() (bool, error) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		// Print PATH
+		path := os.Getenv("PATH")
+		Log("error", fmt.Sprintf("PATH: %s", path))
+		return false, fmt.Errorf("ffmpeg binary not found: %w", err)
+	}
+
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		// Print PATH
+		path := os.Getenv("PATH")
+		Log("error", fmt.Sprintf("PATH: %s", path))
+		return false, fmt.Errorf("ffprobe binary not found: %w", err)
+	}
+
+	return true, nil
+}
+
+// processRTSPFeed reads raw rgba frames from ffmpeg into buffers taken from pool, frames are always scaled to the pool size
+// so a wrong ffprobe result can't misalign the pipe. The receiver should Put frames back once it is done with them
+func processRTSPFeed(ctx context.Context, rtspURL string, fps float64, pool *framePool, msgChannel chan<- FrameMsg) {
+	cmd := exec.CommandContext(ctx,
+		"ffmpeg",
+		"-rtsp_transport", "tcp",
+		"-re",
+		"-i", rtspURL,
+		"-analyzeduration", "1000000",
+		"-probesize", "1000000",
+		"-vf", fmt.Sprintf("fps=%g,scale=%d:%d", fps, pool.rect.Dx(), pool.rect.Dy()),
+		"-fps_mode", "vfr",
+		"-pix_fmt", "rgba",
+		"-f", "rawvideo",
+		"-",
+	)
+	stderrBuffer := &bytes.Buffer{}
+	cmd.Stderr = stderrBuffer
+
+	pipe, err := cmd.StdoutPipe()
+	if err != nil {
+		msgChannel <- FrameMsg{Error: err.Error()}
+		return
+	}
+	defer pipe.Close()
+
+	err = cmd.Start()
+	if err != nil {
+		msgChannel <- FrameMsg{Error: err.Error()}
+		return
+	}
+
+	for {
+		frame, err := readRawFrame(pipe, pool)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			msgChannel <- FrameMsg{Error: err.Error()}
+			return
+		}
+
+		msgChannel <- FrameMsg{Frame: frame}
+	}
+
+	err = cmd.Wait()
+	if ctx.Err() != nil {
+		return // Killed on shutdown
+	}
+	exitCode := 0
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				exitCode = status.ExitStatus()
+			}
+		}
+		msgChannel <- FrameMsg{Error: "FFmpeg exited with error: " + err.Error(), ExitCode: exitCode}
+	}
+
+	if stderrBuffer.Len() > 0 {
+		msgChannel <- FrameMsg{Error: "FFmpeg STDERR: " + stderrBuffer.String()}
+	}
+}
+
+func recordRTSPStream(ctx context.Context, rtspURL string, controlChannel <-chan RecordMsg, prebufferDuration time.Duration) {
+	var file *os.File
+	recording := false
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-rtsp_transport", "tcp", "-i", rtspURL, "-c", "copy", "-f", "mpegts", "pipe:1")
+	pipe, err := cmd.StdoutPipe()
+	if err != nil {
+		Log("error", fmt.Sprintf("Error creating pipe: %v", err))
+		return
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		Log("error", fmt.Sprintf("Error starting ffmpeg: %v", err))
+		return
+	}
+
+	defer func() {
+		if recording && file != nil {
+			file.Close()
+		}
+		cmd.Wait()
+	}()
+
+	type chunkInfo struct {
+		Data []byte
+		Time time.Time
+	}
+
+	bufferSize := 4096
+	prebuffer := make([]chunkInfo, 0)
+	buffer := make([]byte, bufferSize)
+
+	for {
+		select {
+		case msg := <-controlChannel:
+			if msg.Record && !recording {
+				file, err = os.Create(msg.Filename)
+				if err != nil {
+					Log("error", fmt.Sprintf("Error creating recording: %v", err))
+					continue
+				}
+				recording = true
+				for _, chunk := range prebuffer { // Write prebuffered data
+					_, err := file.Write(chunk.Data)
+					if err != nil {
+						Log("error", fmt.Sprintf("Error writing recording: %v", err))
+						return
+					}
+				}
+			} else if !msg.Record && recording {
+				file.Close()
+				recording = false
+			}
+
+		default:
+			n, err := pipe.Read(buffer)
+			if err != nil {
+				if err != io.EOF {
+					Log("error", fmt.Sprintf("Error reading HI RTSP feed: %v", err))
+				}
+				return
+			}
+
+			// Prebuffer handling
+			chunk := make([]byte, n)
+			copy(chunk, buffer[:n])
+			timestamp := time.Now()
+			prebuffer = append(prebuffer, chunkInfo{Data: chunk, Time: timestamp})
+			// Remove chunks that are older than prebufferDuration
+			for len(prebuffer) > 1 && timestamp.Sub(prebuffer[0].Time) > prebufferDuration {
+				prebuffer = prebuffer[1:]
+			}
+
+			if recording && file != nil {
+				_, err := file.Write(buffer[:n])
+				if err != nil {
+					Log("error", fmt.Sprintf("Error writing recording: %v", err))
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c *Camera) recodeToMP4(inputFile string) (string, error) {
+	// Check if the input file has a .ts extension
+	if !strings.HasSuffix(inputFile, ".ts") {
+		return "", fmt.Errorf("input file must have a .ts extension. Got: %s", inputFile)
+	}
+
+	// Remove the .ts extension and replace it with .mp4
+	outputFile := strings.TrimSuffix(inputFile, ".ts") + ".mp4"
+
+	var cmd *exec.Cmd
+	// Create the FFmpeg command
+	if c.engine.Config().Video.OnlyRemuxMp4 {
+		if c.CodecName == "hevc" {
+			cmd = exec.CommandContext(c.engine.recodeCtx, "ffmpeg", "-i", inputFile,
+				"-c:v", "copy",
+				"-c:a", "aac",
+				"-tag:v", "hvc1",
+				"-movflags", "+faststart",
+				"-hls_segment_type", "fmp4",
+				outputFile)
+		} else {
+			cmd = exec.CommandContext(c.engine.recodeCtx, "ffmpeg", "-i", inputFile, "-c", "copy", outputFile)
+		}
+	} else {
+		cmd = exec.CommandContext(c.engine.recodeCtx, "ffmpeg", "-i", inputFile, "-c:v", "libx264", "-c:a", "aac", outputFile)
+	}
+
+	// Capture the standard output and standard error
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		os.Remove(outputFile) // Don't leave a partial mp4 next to the .ts
+		return "", fmt.Errorf("FFmpeg command failed: %v\n%s", err, output)
+	}
+
+	return outputFile, nil
+}
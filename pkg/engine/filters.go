@@ -0,0 +1,64 @@
+package engine
+
+import (
+	"fmt"
+	"image"
+)
+
+// ClassFilter rejects detections of a class that are unlikely to be real, like tiny distant persons in the trees.
+// Unset fields don't filter.
+type ClassFilter struct {
+	MinConfidence  float64 `json:"minConfidence"`  // Replaces confidenceMinThreshold for the class
+	MinArea        float64 `json:"minArea"`        // Box area as a share of the frame area, from 0 to 1
+	MaxArea        float64 `json:"maxArea"`        // Same as MinArea
+	MinAspectRatio float64 `json:"minAspectRatio"` // Box width divided by its height, eg: 0.5 for a box twice as high as wide
+	MaxAspectRatio float64 `json:"maxAspectRatio"` // Same as MinAspectRatio
+}
+
+// reject returns the rule a detection of box, in pixels of a width x height frame, breaks or "" if it passes
+func (f ClassFilter) reject(box image.Rectangle, confidence float32, width, height int) string {
+	if float64(confidence) < f.MinConfidence {
+		return fmt.Sprintf("confidence %.2f is below minConfidence %v", confidence, f.MinConfidence)
+	}
+	if width > 0 && height > 0 {
+		area := float64(box.Dx()*box.Dy()) / float64(width*height)
+		if area < f.MinArea {
+			return fmt.Sprintf("area %.4f is below minArea %v", area, f.MinArea)
+		}
+		if f.MaxArea > 0 && area > f.MaxArea {
+			return fmt.Sprintf("area %.4f is above maxArea %v", area, f.MaxArea)
+		}
+	}
+	if box.Dy() > 0 {
+		ratio := float64(box.Dx()) / float64(box.Dy())
+		if ratio < f.MinAspectRatio {
+			return fmt.Sprintf("aspect ratio %.2f is below minAspectRatio %v", ratio, f.MinAspectRatio)
+		}
+		if f.MaxAspectRatio > 0 && ratio > f.MaxAspectRatio {
+			return fmt.Sprintf("aspect ratio %.2f is above maxAspectRatio %v", ratio, f.MaxAspectRatio)
+		}
+	}
+	return ""
+}
+
+// classFilter returns the filter for a detection and where it comes from. The filter of the first zone the
+// detection is in that has one for its class wins over the filter of the camera, unset confidence falls back to
+// confidenceMinThreshold.
+func (c *Camera) classFilter(class string, box image.Rectangle) (ClassFilter, string) {
+	filter, ok := c.Config.ClassFilters[class]
+	source := "classFilters." + class
+	if !ok {
+		source = "confidenceMinThreshold"
+	}
+	for _, zone := range c.Config.Zones {
+		zoneFilter, ok := zone.ClassFilters[class]
+		if ok && zone.appliesTo(class) && zone.contains(box, c.AnalysisParams.Width, c.AnalysisParams.Height) {
+			filter, source = zoneFilter, fmt.Sprintf("zone %s classFilters.%s", zone.Name, class)
+			break
+		}
+	}
+	if filter.MinConfidence == 0 {
+		filter.MinConfidence = c.Config.ConfidenceMinThreshold
+	}
+	return filter, source
+}
@@ -0,0 +1,277 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/8ff/firescrew/pkg/mqttClient"
+)
+
+var haUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// homeAssistant publishes Home Assistant MQTT discovery configs for every camera and keeps the states of its
+// entities current. It is a sink for the motion and inference events, the camera calls it directly when an event
+// ends, a snapshot was taken or the armed state changed. A nil homeAssistant does nothing.
+type homeAssistant struct {
+	engine *Engine
+
+	mutex      sync.Mutex
+	client     *mqttClient.Client  // Nil while discovery is off
+	topic      string              // events.mqtt.topic, the state topics of a camera are below <topic>/<camera>
+	cameras    map[string][]string // LookForClasses by camera name
+	discovered map[string]bool     // Retained discovery topics, emptied when their entity goes away
+	subscribed string              // Topic of the arm switches, empty without allowArm
+}
+
+func newHomeAssistant(e *Engine) *homeAssistant {
+	return &homeAssistant{engine: e, discovered: make(map[string]bool)}
+}
+
+// haId makes name usable in discovery topics and unique IDs
+func haId(name string) string {
+	return haUnsafe.ReplaceAllString(name, "_")
+}
+
+// update publishes the discovery configs for config through client and removes the ones of cameras and classes
+// that are gone. Without discovery every config is removed.
+func (h *homeAssistant) update(config Config, client *mqttClient.Client) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	mqttConfig := config.Events.Mqtt
+	enabled := client != nil && mqttConfig.HomeAssistant.Discovery && mqttConfig.Topic != ""
+	if h.client != nil && h.client == client && h.subscribed != "" {
+		client.Unsubscribe(h.subscribed)
+	}
+	known := h.cameras
+	h.client, h.topic, h.subscribed = nil, "", ""
+	h.cameras = make(map[string][]string)
+
+	configs := make(map[string]map[string]any)
+	if enabled {
+		h.client, h.topic = client, mqttConfig.Topic
+		for _, camera := range config.Cameras {
+			h.cameras[camera.CameraName] = camera.LookForClasses
+			for topic, payload := range h.discovery(mqttConfig.HomeAssistant.DiscoveryPrefix, mqttConfig.AvailabilityTopic, mqttConfig.HomeAssistant.AllowArm, camera) {
+				configs[topic] = payload
+			}
+		}
+		// Whoever can publish to the broker can use the switch, it is only there when asked for
+		if mqttConfig.HomeAssistant.AllowArm {
+			h.subscribed = h.topic + "/+/armed/set"
+			client.Subscribe(h.subscribed, 1, h.handleArmCommand)
+		}
+	}
+
+	if client != nil {
+		for topic := range h.discovered {
+			if configs[topic] == nil {
+				client.Publish(topic, nil, 1, true)
+				delete(h.discovered, topic)
+			}
+		}
+	}
+	topics := make([]string, 0, len(configs))
+	for topic := range configs {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	for _, topic := range topics {
+		payload, _ := json.Marshal(configs[topic])
+		client.Publish(topic, payload, 1, true)
+		h.discovered[topic] = true
+	}
+
+	// Cameras that are new to Home Assistant start without motion, running ones report their armed state
+	for name, classes := range h.cameras {
+		if slices.Equal(known[name], classes) {
+			continue
+		}
+		h.clear(name, classes)
+		if camera := h.engine.camera(name); camera != nil {
+			if state := camera.armState(); state.Notifications != nil {
+				h.publishArmed(name, state)
+			}
+		}
+	}
+}
+
+// discovery returns the discovery configs of a camera by topic, the armed state is a switch when allowArm is set
+func (h *homeAssistant) discovery(prefix, availabilityTopic string, allowArm bool, camera CameraConfig) map[string]map[string]any {
+	id := "firescrew_" + haId(camera.CameraName)
+	base := h.cameraTopic(camera.CameraName)
+	device := map[string]any{"identifiers": []string{id}, "name": camera.CameraName, "manufacturer": "firescrew", "model": "firescrew"}
+
+	configs := make(map[string]map[string]any)
+	add := func(component, object string, entity map[string]any) {
+		entity["unique_id"] = id + "_" + object
+		entity["device"] = device
+		if availabilityTopic != "" {
+			entity["availability_topic"] = availabilityTopic
+		}
+		configs[strings.Join([]string{prefix, component, id, object, "config"}, "/")] = entity
+	}
+
+	add("binary_sensor", "motion", map[string]any{"name": "Motion", "device_class": "motion", "state_topic": base + "/motion"})
+	for _, class := range camera.LookForClasses {
+		if class == "" {
+			continue
+		}
+		classTopic := base + "/objects/" + mqttTopicLevel(class)
+		name := strings.ToUpper(class[:1]) + class[1:] // eg: Person
+		add("binary_sensor", haId(class), map[string]any{"name": name, "device_class": "occupancy", "state_topic": classTopic})
+		// Counts the objects that joined the event, not the ones in view, objects that left count until it ends
+		add("sensor", haId(class)+"_count", map[string]any{"name": name + " in this event", "state_class": "measurement", "state_topic": classTopic + "/count"})
+	}
+	add("sensor", "inference", map[string]any{
+		"name":                "Inference latency",
+		"device_class":        "duration",
+		"unit_of_measurement": "ms",
+		"state_class":         "measurement",
+		"entity_category":     "diagnostic",
+		"state_topic":         base + "/inference_ms",
+	})
+	if allowArm {
+		add("switch", "armed", map[string]any{"name": "Armed", "icon": "mdi:shield-home", "state_topic": base + "/armed", "command_topic": base + "/armed/set"})
+	} else {
+		add("binary_sensor", "armed", map[string]any{"name": "Armed", "icon": "mdi:shield-home", "state_topic": base + "/armed"})
+	}
+	add("camera", "snapshot", map[string]any{"name": "Snapshot", "topic": base + "/snapshot"})
+	return configs
+}
+
+// cameraTopic is the topic the states of a camera are published below
+func (h *homeAssistant) cameraTopic(name string) string {
+	return h.topic + "/" + mqttTopicLevel(name)
+}
+
+// publish sends a retained state, states have to survive restarts of Home Assistant
+func (h *homeAssistant) publish(topic string, payload []byte) {
+	h.client.Publish(topic, payload, 0, true)
+}
+
+// clear turns the motion and object sensors of a camera off
+func (h *homeAssistant) clear(name string, classes []string) {
+	base := h.cameraTopic(name)
+	h.publish(base+"/motion", []byte("OFF"))
+	for _, class := range classes {
+		h.publish(base+"/objects/"+mqttTopicLevel(class), []byte("OFF"))
+		h.publish(base+"/objects/"+mqttTopicLevel(class)+"/count", []byte("0"))
+	}
+}
+
+// Send updates the states from motion_start, motion_update and inference_avg events. The counts are the objects
+// of the event so far, motionEnded resets them.
+func (h *homeAssistant) Send(event Event) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	classes, ok := h.cameras[event.CameraName]
+	if h.client == nil || !ok {
+		return nil
+	}
+	base := h.cameraTopic(event.CameraName)
+
+	switch data := event.Data.(type) {
+	case MotionEvent:
+		counts := make(map[string]int)
+		for _, object := range data.Objects {
+			counts[object.Class]++
+		}
+		h.publish(base+"/motion", []byte("ON"))
+		for _, class := range classes {
+			state := "OFF"
+			if counts[class] > 0 {
+				state = "ON"
+			}
+			h.publish(base+"/objects/"+mqttTopicLevel(class), []byte(state))
+			h.publish(base+"/objects/"+mqttTopicLevel(class)+"/count", []byte(fmt.Sprint(counts[class])))
+		}
+	case InferenceStatsEvent:
+		h.publish(base+"/inference_ms", []byte(fmt.Sprintf("%.1f", data.InferenceAvg)))
+	}
+	return nil
+}
+
+// motionEnded clears the motion and object sensors of a camera
+func (h *homeAssistant) motionEnded(name string) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if classes, ok := h.cameras[name]; h.client != nil && ok {
+		h.clear(name, classes)
+	}
+}
+
+// snapshot feeds the camera entity with the annotated frame of an event
+func (h *homeAssistant) snapshot(name string, frame *image.RGBA) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, ok := h.cameras[name]; h.client == nil || !ok {
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, frame, &jpeg.Options{Quality: 80}); err != nil {
+		Log("error", fmt.Sprintf("[%s] Error encoding Home Assistant snapshot: %v", name, err))
+		return
+	}
+	h.publish(h.cameraTopic(name)+"/snapshot", buf.Bytes())
+}
+
+// armed sets the armed state of a camera, it is on while detection is armed
+func (h *homeAssistant) armed(name string, state ArmState) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, ok := h.cameras[name]; h.client != nil && ok {
+		h.publishArmed(name, state)
+	}
+}
+
+func (h *homeAssistant) publishArmed(name string, state ArmState) {
+	payload := "OFF"
+	if state.Detection {
+		payload = "ON"
+	}
+	h.publish(h.cameraTopic(name)+"/armed", []byte(payload))
+}
+
+// handleArmCommand arms or disarms a camera from its switch, ON and OFF override the schedules like the arm and
+// disarm commands of the API
+func (h *homeAssistant) handleArmCommand(topic string, payload []byte) {
+	h.mutex.Lock()
+	level := strings.TrimSuffix(strings.TrimPrefix(topic, h.topic+"/"), "/armed/set")
+	var name string
+	for cameraName := range h.cameras {
+		if mqttTopicLevel(cameraName) == level {
+			name = cameraName
+		}
+	}
+	h.mutex.Unlock()
+
+	command := map[string]string{"ON": CommandArm, "OFF": CommandDisarm}[string(payload)]
+	if name == "" || command == "" {
+		Log("warning", fmt.Sprintf("Ignoring Home Assistant command %q on %s", payload, topic))
+		return
+	}
+	if _, err := h.engine.Control(name, command); err != nil {
+		Log("error", fmt.Sprintf("Home Assistant command %s for %s failed: %v", command, name, err))
+		return
+	}
+	Log("info", fmt.Sprintf("[%s] Ran Home Assistant command %s", name, command))
+}
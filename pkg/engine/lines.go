@@ -0,0 +1,141 @@
+package engine
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/8ff/firescrew/pkg/counters"
+	"github.com/8ff/firescrew/pkg/events"
+)
+
+// Line is a tripwire across the frame, tracked objects crossing it are counted. Looking from the first point to
+// the second, crossing from the left side to the right side is "in", the other way is "out".
+type Line struct {
+	Name      string        `json:"name"`
+	Points    [2][2]float64 `json:"points"`    // Start and end as [x, y] from 0 to 1, eg: [[0, 0.5], [1, 0.5]] across the middle
+	Direction string        `json:"direction"` // Crossings that count, both (default), in or out
+	Classes   []string      `json:"classes"`   // Classes the line counts, empty for every class
+	Anchor    string        `json:"anchor"`    // center (default) or bottom_center, which point of an object has to cross
+}
+
+// anchor returns the point of object that has to cross the line, relative to a width x height frame
+func (l Line) anchor(object TrackedObject, width, height int) [2]float64 {
+	x := float64(object.BBox.Min.X+object.BBox.Max.X) / 2 / float64(width)
+	y := float64(object.BBox.Min.Y+object.BBox.Max.Y) / 2 / float64(height)
+	if l.Anchor == "bottom_center" {
+		y = float64(object.BBox.Max.Y) / float64(height)
+	}
+	return [2]float64{x, y}
+}
+
+// crossing returns the direction the move from a to b crossed the line in, empty if it didn't
+func (l Line) crossing(a, b [2]float64) string {
+	start, end := l.Points[0], l.Points[1]
+	sideA, sideB := side(start, end, a), side(start, end, b)
+	if (sideA > 0) == (sideB > 0) {
+		return ""
+	}
+	// The move has to pass between the end points, not beside the line
+	if side(a, b, start)*side(a, b, end) > 0 {
+		return ""
+	}
+	if sideB > 0 {
+		return "in"
+	}
+	return "out"
+}
+
+// side is positive when p is right of the line from a to b, y points down
+func side(a, b, p [2]float64) float64 {
+	return (b[0]-a[0])*(p[1]-a[1]) - (b[1]-a[1])*(p[0]-a[0])
+}
+
+// checkLines sends line_crossed for every line the object crossed since its previous detection
+func (c *Camera) checkLines(object TrackedObject, now time.Time) {
+	if len(c.Config.Lines) == 0 || c.AnalysisParams.Width <= 0 || c.AnalysisParams.Height <= 0 {
+		return
+	}
+	if c.lineAnchors == nil {
+		c.lineAnchors = make(map[int]map[string][2]float64)
+	}
+	anchors := c.lineAnchors[object.TrackID]
+	if anchors == nil {
+		anchors = make(map[string][2]float64)
+		c.lineAnchors[object.TrackID] = anchors
+	}
+
+	for _, line := range c.Config.Lines {
+		if len(line.Classes) > 0 && !slices.Contains(line.Classes, object.Class) {
+			continue
+		}
+		point := line.anchor(object, c.AnalysisParams.Width, c.AnalysisParams.Height)
+		previous, ok := anchors[line.Name]
+		anchors[line.Name] = point
+		if !ok {
+			continue
+		}
+		direction := line.crossing(previous, point)
+		if direction == "" || (line.Direction != "both" && line.Direction != direction) {
+			continue
+		}
+		c.emitLineCrossed(line.Name, direction, object, now)
+	}
+}
+
+// pruneLines forgets the positions of tracks the tracker dropped
+func (c *Camera) pruneLines() {
+	for id := range c.lineAnchors {
+		if !c.tracker.Has(id) {
+			delete(c.lineAnchors, id)
+		}
+	}
+}
+
+// emitLineCrossed counts a crossing and sends it
+func (c *Camera) emitLineCrossed(line, direction string, object TrackedObject, now time.Time) {
+	event := LineCrossedEvent{
+		Header:     events.NewHeader(EventLineCrossed, c.Config.CameraName, now),
+		Line:       line,
+		Direction:  direction,
+		TrackID:    object.TrackID,
+		Class:      object.Class,
+		Confidence: object.Confidence,
+		BBox:       events.NewBox(object.BBox),
+	}
+
+	c.MotionMutex.Lock()
+	event.EventID = c.MotionVideo.ID
+	c.MotionMutex.Unlock()
+
+	if store := c.engine.counterStore(c.Config.HiResPath); store != nil {
+		if err := store.Add(c.Config.CameraName, line, object.Class, direction, now); err != nil {
+			Log("error", fmt.Sprintf("[%s] Error saving counters: %v", c.Config.CameraName, err))
+		}
+	}
+
+	Log("event", fmt.Sprintf("[%s] %s %s #%d %s %s", c.Config.CameraName, strings.ToUpper(EventLineCrossed), line, object.TrackID, object.Class, direction))
+	c.emitDetection(EventLineCrossed, event)
+}
+
+// counterStore returns the counters of the recordings folder path, cameras sharing a folder share the store.
+// A counters file that can't be read is logged once and counting stays off for that folder.
+func (e *Engine) counterStore(path string) *counters.Store {
+	e.countersMutex.Lock()
+	defer e.countersMutex.Unlock()
+
+	if store, ok := e.counters[path]; ok {
+		return store
+	}
+	if e.counters == nil {
+		e.counters = make(map[string]*counters.Store)
+	}
+	store, err := counters.Open(filepath.Join(path, counters.FileName))
+	if err != nil {
+		Log("error", fmt.Sprintf("Error loading counters, line crossings in %s aren't counted: %v", path, err))
+	}
+	e.counters[path] = store
+	return store
+}
@@ -0,0 +1,45 @@
+package engine
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Logger receives every log line of the engine, embedders can replace it to route logs elsewhere.
+// Debug lines only reach it when enabled with SetPrintDebug, secrets are masked with Redact before.
+var Logger = ConsoleLogger
+
+var printDebug atomic.Bool
+
+// SetPrintDebug enables or disables debug logging, New sets it from Config.PrintDebug
+func SetPrintDebug(enabled bool) {
+	printDebug.Store(enabled)
+}
+
+func Log(level, msg string) {
+	if level == "debug" && !printDebug.Load() {
+		return
+	}
+	Logger(level, Redact(msg))
+}
+
+// ConsoleLogger prints colored log lines to stdout
+func ConsoleLogger(level, msg string) {
+	switch level {
+	case "info":
+		fmt.Printf("\x1b[32m%s [INFO] %s\x1b[0m\n", time.Now().Format("15:04:05"), msg)
+	case "notice":
+		fmt.Printf("\x1b[35m%s [NOTICE] %s\x1b[0m\n", time.Now().Format("15:04:05"), msg)
+	case "event":
+		fmt.Printf("\x1b[34m%s [EVENT] %s\x1b[0m\n", time.Now().Format("15:04:05"), msg)
+	case "error":
+		fmt.Printf("\x1b[31m%s [ERROR] %s\x1b[0m\n", time.Now().Format("15:04:05"), msg)
+	case "warning":
+		fmt.Printf("\x1b[33m%s [WARNING] %s\x1b[0m\n", time.Now().Format("15:04:05"), msg)
+	case "debug":
+		fmt.Printf("\x1b[36m%s [DEBUG] %s\x1b[0m\n", time.Now().Format("15:04:05"), msg)
+	default:
+		fmt.Printf("%s [UNKNOWN] %s\n", time.Now().Format("15:04:05"), msg)
+	}
+}
@@ -0,0 +1,95 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/8ff/firescrew/pkg/mqttClient"
+)
+
+// mqttBroker returns the URL of the events.mqtt broker, empty if none is configured
+func mqttBroker(config Config) string {
+	mqttConfig := config.Events.Mqtt
+	if mqttConfig.Url != "" {
+		return mqttConfig.Url
+	}
+	if mqttConfig.Host != "" && mqttConfig.Port != 0 {
+		return fmt.Sprintf("tcp://%s:%d", mqttConfig.Host, mqttConfig.Port)
+	}
+	return ""
+}
+
+// mqttConnection returns the settings of the MQTT connection, the client is replaced on reload when they change
+func mqttConnection(config Config) mqttClient.Config {
+	mqttConfig := config.Events.Mqtt
+	return mqttClient.Config{
+		Broker:   mqttBroker(config),
+		ClientID: mqttConfig.ClientId,
+		User:     mqttConfig.User,
+		Pass:     mqttConfig.Pass,
+		TLS: &mqttClient.TLSConfig{
+			CaFile:             mqttConfig.Tls.CaFile,
+			CertFile:           mqttConfig.Tls.CertFile,
+			KeyFile:            mqttConfig.Tls.KeyFile,
+			InsecureSkipVerify: mqttConfig.Tls.InsecureSkipVerify,
+		},
+		AvailabilityTopic: mqttConfig.AvailabilityTopic,
+		QueueSize:         mqttConfig.QueueSize,
+	}
+}
+
+// newMqttClient creates the client shared by the mqtt sink and the command topic, nil if no broker is configured.
+// It connects once Start calls Connect, events sent before are queued.
+func newMqttClient(config Config, handleCommand func(topic string, payload []byte)) (*mqttClient.Client, error) {
+	connection := mqttConnection(config)
+	if connection.Broker == "" {
+		return nil, nil
+	}
+	connection.OnConnect = func() {
+		Log("info", fmt.Sprintf("Connected to MQTT broker %s", connection.Broker))
+	}
+	connection.OnConnectionLost = func(err error) {
+		Log("warning", fmt.Sprintf("Lost connection to MQTT broker %s, reconnecting: %v", connection.Broker, err))
+	}
+	connection.OnError = func(err error) {
+		Log("error", fmt.Sprintf("MQTT: %v", err))
+	}
+
+	client, err := mqttClient.New(connection)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create MQTT client: %v", err)
+	}
+	if topic := config.Api.CommandTopic; topic != "" {
+		client.Subscribe(topic, 1, handleCommand)
+		Log("info", fmt.Sprintf("Listening for commands on MQTT topic %s", topic))
+	}
+	return client, nil
+}
+
+// reloadMqtt returns the client for config, a new one if the connection settings changed. A kept client
+// follows a changed command topic.
+func (e *Engine) reloadMqtt(old, config Config) (*mqttClient.Client, error) {
+	if e.mqtt != nil && sameMqttConnection(mqttConnection(old), mqttConnection(config)) {
+		if old.Api.CommandTopic != config.Api.CommandTopic {
+			if old.Api.CommandTopic != "" {
+				e.mqtt.Unsubscribe(old.Api.CommandTopic)
+			}
+			if config.Api.CommandTopic != "" {
+				e.mqtt.Subscribe(config.Api.CommandTopic, 1, e.handleCommandMessage)
+				Log("info", fmt.Sprintf("Listening for commands on MQTT topic %s", config.Api.CommandTopic))
+			}
+		}
+		return e.mqtt, nil
+	}
+	return newMqttClient(config, e.handleCommandMessage)
+}
+
+func sameMqttConnection(a, b mqttClient.Config) bool {
+	return a.Broker == b.Broker && a.ClientID == b.ClientID && a.User == b.User && a.Pass == b.Pass && *a.TLS == *b.TLS &&
+		a.AvailabilityTopic == b.AvailabilityTopic && a.QueueSize == b.QueueSize
+}
+
+// mqttTopicLevel makes name usable as a single topic level
+func mqttTopicLevel(name string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(name)
+}
@@ -0,0 +1,121 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"time"
+)
+
+var pushoverUrl = "https://api.pushover.net/1/messages.json"
+
+// PushoverSink sends a notification when an event starts and when it ends. motion_start gets the annotated frame
+// and motion_end a GIF of the snapshots of the event.
+type PushoverSink struct {
+	AppToken string
+	UserKey  string
+	Timeout  time.Duration // 0 waits as long as it takes
+}
+
+func (s *PushoverSink) wants(event Event) bool {
+	return event.Type == EventMotionStart || event.Type == EventMotionEnd
+}
+
+func (s *PushoverSink) wantsSnapshot() bool {
+	return true
+}
+
+func (s *PushoverSink) wantsAnimation() bool {
+	return true
+}
+
+func (s *PushoverSink) Send(event Event) error {
+	msg := "Motion detected!"
+	if event.Type == EventMotionEnd {
+		msg = "Motion ended"
+	}
+	if event.CameraName != "" {
+		msg = fmt.Sprintf("[%s] %s", event.CameraName, msg)
+	}
+
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+
+	// Set up form fields
+	if err := w.WriteField("token", s.AppToken); err != nil {
+		return fmt.Errorf("WriteField Error: %v", err)
+	}
+	if err := w.WriteField("user", s.UserKey); err != nil {
+		return fmt.Errorf("WriteField Error: %v", err)
+	}
+	if err := w.WriteField("message", msg); err != nil {
+		return fmt.Errorf("WriteField Error: %v", err)
+	}
+
+	// Attach the snapshot, a GIF or a JPEG
+	if len(event.Snapshot) > 0 {
+		filename := "image.jpg"
+		if http.DetectContentType(event.Snapshot) == "image/gif" {
+			filename = "image.gif"
+		}
+		fw, err := w.CreateFormFile("attachment", filename)
+		if err != nil {
+			return fmt.Errorf("CreateFormFile Error: %v", err)
+		}
+		if _, err := fw.Write(event.Snapshot); err != nil {
+			return fmt.Errorf("copy File Error: %v", err)
+		}
+	}
+	w.Close()
+
+	req, err := http.NewRequest(http.MethodPost, pushoverUrl, &b)
+	if err != nil {
+		return fmt.Errorf("NewRequest Error: %v", err)
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	if err := doRequest(req, s.Timeout); err != nil {
+		return fmt.Errorf("Failed to send pushover notification: %s", err)
+	}
+	return nil
+}
+
+// CreateGIF creates a GIF file from a slice of *image.RGBA images
+func CreateGIF(images []image.RGBA, outputPath string, delay int) error {
+	outFile, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+	return writeGIF(outFile, images, delay)
+}
+
+// encodeGIF is CreateGIF in memory
+func encodeGIF(images []image.RGBA, delay int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeGIF(&buf, images, delay); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeGIF(w io.Writer, images []image.RGBA, delay int) error {
+	anim := &gif.GIF{}
+	for _, srcImg := range images {
+		// Convert image.RGBA to *image.Paletted
+		bounds := srcImg.Bounds()
+		palettedImage := image.NewPaletted(bounds, palette.Plan9)
+		draw.Draw(palettedImage, palettedImage.Rect, &srcImg, bounds.Min, draw.Over)
+
+		anim.Image = append(anim.Image, palettedImage)
+		anim.Delay = append(anim.Delay, delay)
+	}
+
+	return gif.EncodeAll(w, anim)
+}
@@ -0,0 +1,199 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/8ff/firescrew/pkg/mqttClient"
+)
+
+// Sink receives every event of the engine
+type Sink interface {
+	Send(event Event) error
+}
+
+// SinkFunc lets a plain function be used as a Sink
+type SinkFunc func(event Event) error
+
+func (f SinkFunc) Send(event Event) error {
+	return f(event)
+}
+
+// ConfigSinks returns the webhook, script and slack sinks of the events section of the config and the pushover
+// sink of notifications. The mqtt sink needs the connection of the engine.
+func ConfigSinks(config Config) []Sink {
+	var sinks []Sink
+	timeout := time.Duration(config.Events.Delivery.TimeoutSeconds) * time.Second
+	if config.Events.Webhook != "" {
+		sinks = append(sinks, &WebhookSink{Url: config.Events.Webhook, Timeout: timeout})
+	}
+	for _, webhookConfig := range config.Events.Webhooks {
+		webhook, err := NewWebhookSink(webhookConfig, timeout)
+		if err != nil {
+			Log("error", fmt.Sprintf("Webhook %s: %v", webhookConfig.Name, err))
+			continue
+		}
+		sinks = append(sinks, webhook)
+	}
+	if config.Events.ScriptPath != "" {
+		sinks = append(sinks, &ScriptSink{Path: config.Events.ScriptPath, Timeout: timeout})
+	}
+	if config.Events.Slack.Url != "" {
+		sinks = append(sinks, &SlackSink{Url: config.Events.Slack.Url, Timeout: timeout})
+	}
+	if config.Notifications.EnablePushoverAlerts {
+		sinks = append(sinks, &PushoverSink{AppToken: config.Notifications.PushoverAppToken, UserKey: config.Notifications.PushoverUserKey, Timeout: timeout})
+	}
+	return sinks
+}
+
+// configSinks returns the sinks of the config including the mqtt sink, which publishes through client, followed
+// by the sinks of Options
+func (e *Engine) configSinks(config Config, client *mqttClient.Client) []Sink {
+	sinks := ConfigSinks(config)
+	if client != nil && config.Events.Mqtt.Topic != "" {
+		mqttConfig := config.Events.Mqtt
+		timeout := time.Duration(config.Events.Delivery.TimeoutSeconds) * time.Second
+		sinks = append(sinks, &MqttSink{Client: client, Topic: mqttConfig.Topic, Qos: byte(mqttConfig.Qos), Retain: mqttConfig.Retain, CameraTopics: mqttConfig.CameraTopics, Timeout: timeout})
+	}
+	if client != nil && config.Events.Mqtt.Topic != "" && config.Events.Mqtt.HomeAssistant.Discovery {
+		sinks = append(sinks, e.homeAssistant)
+	}
+	return append(sinks, e.options.Sinks...)
+}
+
+// sinkName is the name arm.notifications uses for a sink of the config, other sinks have none
+func sinkName(sink Sink) string {
+	switch sink := sink.(type) {
+	case *queuedSink:
+		return sink.arm
+	case *WebhookSink:
+		return "webhook"
+	case *ScriptSink:
+		return "script"
+	case *SlackSink:
+		return "slack"
+	case *MqttSink:
+		return "mqtt"
+	case *PushoverSink:
+		return "pushover"
+	}
+	return ""
+}
+
+// queueName names the outbox of a sink of the config, every entry of events.webhooks has its own
+func queueName(sink Sink) string {
+	if webhook, ok := sink.(*WebhookSink); ok && webhook.Name != "" {
+		return "webhook-" + haId(webhook.Name)
+	}
+	return sinkName(sink)
+}
+
+// eventFilter is implemented by sinks that only take some events
+type eventFilter interface {
+	wants(event Event) bool
+}
+
+// snapshotSink is implemented by sinks that can attach the snapshot of an event
+type snapshotSink interface {
+	wantsSnapshot() bool
+}
+
+// animationSink is implemented by snapshot sinks that rather attach a GIF of the event where there is one
+type animationSink interface {
+	wantsAnimation() bool
+}
+
+// postJSON POSTs payload, an answer other than 2xx is an error
+func postJSON(url string, payload []byte, timeout time.Duration) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doRequest(req, timeout)
+}
+
+// doRequest sends req, an answer other than 2xx is an error
+func doRequest(req *http.Request, timeout time.Duration) error {
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body) // Lets the connection be reused
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", req.URL, resp.Status)
+	}
+	return nil
+}
+
+// ScriptSink runs the script at Path for every event and pipes the event JSON to its STDIN, it fails if the
+// script exits with an error
+type ScriptSink struct {
+	Path    string
+	Timeout time.Duration // The script is killed after it, 0 waits as long as it takes
+}
+
+func (s *ScriptSink) Send(event Event) error {
+	ctx := context.Background()
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, s.Path)
+	cmd.Stdin = bytes.NewReader(event.Payload)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("Script %s failed: %s: %s", s.Path, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// SlackSink posts the event to a slack webhook
+type SlackSink struct {
+	Url     string
+	Timeout time.Duration // 0 waits as long as it takes
+}
+
+func (s *SlackSink) Send(event Event) error {
+	slackMessage := map[string]interface{}{
+		"text": fmt.Sprintf("Event: %s\nPayload: %s", event.Type, string(event.Payload)),
+	}
+	slackPayload, _ := json.Marshal(slackMessage)
+	if err := postJSON(s.Url, slackPayload, s.Timeout); err != nil {
+		return fmt.Errorf("Failed to post to Slack: %s", err)
+	}
+	return nil
+}
+
+// MqttSink publishes the event JSON to Topic through the shared client. It fails while the broker is unreachable
+// or doesn't take the event within Timeout, so the event waits in the outbox of the sink instead of the memory
+// queue of the client.
+type MqttSink struct {
+	Client       *mqttClient.Client
+	Topic        string
+	Qos          byte
+	Retain       bool
+	CameraTopics bool          // Publish camera events to Topic/<camera>/<event type>
+	Timeout      time.Duration // For the broker to take the event, 0 uses the default of the client
+}
+
+func (s *MqttSink) Send(event Event) error {
+	topic := s.Topic
+	if s.CameraTopics && event.CameraName != "" {
+		topic = strings.Join([]string{s.Topic, mqttTopicLevel(event.CameraName), event.Type}, "/")
+	}
+	if err := s.Client.PublishWait(topic, event.Payload, s.Qos, s.Retain, s.Timeout); err != nil {
+		return fmt.Errorf("Failed to publish to mqtt: %s", err)
+	}
+	return nil
+}
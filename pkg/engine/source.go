@@ -0,0 +1,81 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"math"
+	"time"
+
+	"github.com/8ff/firescrew/pkg/rtspIngest"
+)
+
+// FrameSource feeds the analysis frames of a camera. Run sends frames until ctx is done or the feed fails,
+// after a failure it is called again. Errors can also be reported without returning by sending a FrameMsg
+// with Error set. Frames should be *image.RGBA of the analysis size, anything else is converted.
+type FrameSource interface {
+	Run(ctx context.Context, frames chan<- FrameMsg) error
+}
+
+// Recorder is implemented by frame sources that record the hi res stream themselves.
+// Sources without it are recorded with ffmpeg from the camera hiResDeviceUrl.
+type Recorder interface {
+	StartRecording(filename string) error
+	StopRecording()
+}
+
+// defaultSource returns the built in feed for the camera ingest mode
+func (c *Camera) defaultSource() FrameSource {
+	if c.Config.IngestMode == "native" {
+		return newNativeSource(c)
+	}
+	return &ffmpegSource{url: c.Config.DeviceUrl, fps: c.AnalysisParams.FPS, pool: c.framePool}
+}
+
+// ffmpegSource reads raw frames of the lo res stream from ffmpeg
+type ffmpegSource struct {
+	url  string
+	fps  float64
+	pool *framePool
+}
+
+func (s *ffmpegSource) Run(ctx context.Context, frames chan<- FrameMsg) error {
+	processRTSPFeed(ctx, s.url, s.fps, s.pool, frames) // Reports its errors on the channel
+	return nil
+}
+
+// nativeSource opens a single gortsplib connection to the hi res stream and uses it for both analysis frames and recording
+type nativeSource struct {
+	stream *rtspIngest.Stream
+	frames chan<- FrameMsg
+}
+
+func newNativeSource(c *Camera) *nativeSource {
+	s := &nativeSource{}
+	s.stream = rtspIngest.New(rtspIngest.Config{
+		Url:               c.Config.HiResDeviceUrl,
+		EveryNthFrame:     int(math.Max(1, math.Round(c.HiResStreamParams.FPS/c.AnalysisParams.FPS))),
+		PrebufferDuration: time.Duration(c.Config.PrebufferSeconds) * time.Second,
+		OnFrame: func(frame *image.RGBA) {
+			s.frames <- FrameMsg{Frame: frame}
+		},
+	})
+	return s
+}
+
+func (s *nativeSource) Run(ctx context.Context, frames chan<- FrameMsg) error {
+	s.frames = frames
+	err := s.stream.Run(ctx) // An open recording continues after the source reconnects
+	if err != nil {
+		return fmt.Errorf("Native RTSP ingest failed: %v", err)
+	}
+	return nil
+}
+
+func (s *nativeSource) StartRecording(filename string) error {
+	return s.stream.StartRecording(filename)
+}
+
+func (s *nativeSource) StopRecording() {
+	s.stream.StopRecording()
+}
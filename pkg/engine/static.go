@@ -0,0 +1,67 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/8ff/firescrew/pkg/events"
+	"github.com/8ff/firescrew/pkg/tracker"
+)
+
+// staticObject is a tracked object that stays put, like a parked car
+type staticObject struct {
+	object TrackedObject // Last detection
+	since  time.Time     // Since when it stays put
+}
+
+// updateStatic sends object_arrived when a tracked object became static and object_departed when a static object
+// moves again. A departed object may trigger again.
+func (c *Camera) updateStatic(object TrackedObject, track tracker.Track, now time.Time) {
+	state := c.staticObjects[object.TrackID]
+	switch {
+	case track.Static && state == nil:
+		if c.staticObjects == nil {
+			c.staticObjects = make(map[int]*staticObject)
+		}
+		state = &staticObject{object: object, since: track.StillSince}
+		c.staticObjects[object.TrackID] = state
+		c.emitObjectEvent(EventObjectArrived, state, now)
+	case track.Static:
+		state.object = object
+	case state != nil:
+		state.object = object
+		delete(c.staticObjects, object.TrackID)
+		delete(c.triggeredTracks, object.TrackID)
+		c.emitObjectEvent(EventObjectDeparted, state, now)
+	}
+}
+
+// expireStatic sends object_departed for static objects the tracker dropped, they weren't seen for staticMaxAge
+func (c *Camera) expireStatic(now time.Time) {
+	for id, state := range c.staticObjects {
+		if !c.tracker.Has(id) {
+			delete(c.staticObjects, id)
+			c.emitObjectEvent(EventObjectDeparted, state, now)
+		}
+	}
+}
+
+func (c *Camera) emitObjectEvent(eventType string, state *staticObject, now time.Time) {
+	event := ObjectEvent{
+		Header:      events.NewHeader(eventType, c.Config.CameraName, now),
+		TrackID:     state.object.TrackID,
+		Class:       state.object.Class,
+		Confidence:  state.object.Confidence,
+		BBox:        events.NewBox(state.object.BBox),
+		StaticSince: state.since,
+		Static:      now.Sub(state.since).Seconds(),
+	}
+
+	c.MotionMutex.Lock()
+	event.EventID = c.MotionVideo.ID
+	c.MotionMutex.Unlock()
+
+	Log("event", fmt.Sprintf("[%s] %s #%d %s (%.0fs)", c.Config.CameraName, strings.ToUpper(eventType), state.object.TrackID, state.object.Class, event.Static))
+	c.emitDetection(eventType, event)
+}
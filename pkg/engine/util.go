@@ -0,0 +1,56 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// sleepContext waits for d and reports false if ctx was done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func generateRandomString(length int) string {
+	const charset = "abcdefghijklmnopqrstuvwxyz" + "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	seededRand := rand.New(rand.NewSource(time.Now().UnixNano()))
+	b := make([]byte, length)
+	for i := range b {
+		b[i] = charset[seededRand.Intn(len(charset))]
+	}
+	return string(b)
+}
+
+// cloneRGBA returns a copy of img that doesn't share its pixel buffer
+func cloneRGBA(img *image.RGBA) *image.RGBA {
+	return &image.RGBA{
+		Pix:    append([]uint8(nil), img.Pix...),
+		Stride: img.Stride,
+		Rect:   img.Rect,
+	}
+}
+
+func saveJPEG(filename string, img *image.RGBA, quality int) {
+	file, err := os.Create(filename)
+	if err != nil {
+		Log("error", fmt.Sprintf("File create error: %s", err))
+		return
+	}
+	defer file.Close()
+
+	options := &jpeg.Options{Quality: quality} // Quality ranges from 1 to 100
+	err = jpeg.Encode(file, img, options)
+	if err != nil {
+		Log("error", fmt.Sprintf("JPEG encode error: %s", err))
+		return
+	}
+}
@@ -0,0 +1,789 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/8ff/firescrew/pkg/detector"
+	"github.com/8ff/firescrew/pkg/rtspIngest"
+	"github.com/8ff/firescrew/pkg/schedule"
+)
+
+// Diagnostic is a single problem found in a config
+type Diagnostic struct {
+	Path     string // JSON path of the setting, eg: cameras[1].ignoreAreasClasses[0].coordinates
+	Severity string // error or warning
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	if d.Path == "" {
+		return fmt.Sprintf("%s: %s", d.Severity, d.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", d.Severity, d.Path, d.Message)
+}
+
+type Diagnostics []Diagnostic
+
+func (diags *Diagnostics) Error(path, format string, args ...any) {
+	diags.add(Diagnostic{Path: path, Severity: "error", Message: fmt.Sprintf(format, args...)})
+}
+
+func (diags *Diagnostics) Warning(path, format string, args ...any) {
+	diags.add(Diagnostic{Path: path, Severity: "warning", Message: fmt.Sprintf(format, args...)})
+}
+
+// add skips duplicates, a top level setting inherited by several cameras is only reported once
+func (diags *Diagnostics) add(d Diagnostic) {
+	if !slices.Contains(*diags, d) {
+		*diags = append(*diags, d)
+	}
+}
+
+func (diags Diagnostics) HasErrors() bool {
+	for _, d := range diags {
+		if d.Severity == "error" {
+			return true
+		}
+	}
+	return false
+}
+
+// Err joins all errors into one, warnings are left out. It returns nil if there are no errors.
+func (diags Diagnostics) Err() error {
+	var errs []error
+	for _, d := range diags {
+		if d.Severity != "error" {
+			continue
+		}
+		if d.Path == "" {
+			errs = append(errs, errors.New(d.Message))
+		} else {
+			errs = append(errs, fmt.Errorf("%s: %s", d.Path, d.Message))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// joinPath appends key to a JSON path
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// cameraPath is the JSON path of camera i, legacy configs keep their camera settings at the top level
+func (config *Config) cameraPath(i int) string {
+	if config.legacy {
+		return ""
+	}
+	return fmt.Sprintf("cameras[%d]", i)
+}
+
+// Top level settings that cameras inherit, by camera key
+var inheritedPaths = map[string]string{
+	"hiResPath":                     "video.hiResPath",
+	"confidenceMinThreshold":        "motion.confidenceMinThreshold",
+	"eventGap":                      "motion.eventGap",
+	"trackIouThreshold":             "motion.trackIouThreshold",
+	"trackMaxAge":                   "motion.trackMaxAge",
+	"classFilters":                  "motion.classFilters",
+	"staticAfter":                   "motion.staticAfter",
+	"staticMaxAge":                  "motion.staticMaxAge",
+	"prebufferSeconds":              "motion.prebufferSeconds",
+	"analysisFps":                   "motion.analysisFps",
+	"ingestMode":                    "ingestMode",
+	"analysisWidth":                 "analysisWidth",
+	"pixelMotionAreaThreshold":      "pixelMotionAreaThreshold",
+	"motionSensitivity":             "motion.sensitivity",
+	"objectCenterMovementThreshold": "objectCenterMovementThreshold",
+	"objectAreaThreshold":           "objectAreaThreshold",
+	"arm.detection":                 "arm.detection",
+	"arm.recording":                 "arm.recording",
+	"arm.notifications":             "arm.notifications",
+}
+
+// settingPath is the JSON path of a camera setting. Settings the camera inherited point to the top level setting.
+func (config *Config) settingPath(i int, key string, inherited bool) string {
+	if topPath, ok := inheritedPaths[key]; ok && (inherited || config.legacy) {
+		return topPath
+	}
+	return joinPath(config.cameraPath(i), key)
+}
+
+// ValidateJSON parses a config file and checks everything Validate checks. Unlike json.Unmarshal it also reports
+// unknown keys and every value of the wrong type. The returned config is normalized.
+func ValidateJSON(data []byte) (Config, Diagnostics) {
+	var config Config
+	var diags Diagnostics
+
+	var raw any
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line := 1 + strings.Count(string(data[:syntaxErr.Offset]), "\n")
+			diags.Error("", "invalid JSON on line %d: %v", line, err)
+		} else {
+			diags.Error("", "invalid JSON: %v", err)
+		}
+		return config, diags
+	}
+
+	checkKeys("", raw, reflect.TypeOf(config), &diags)
+	if diags.HasErrors() {
+		return config, diags // Values of the wrong type, the config can't be decoded
+	}
+
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		diags.Error("", "%v", err)
+		return config, diags
+	}
+
+	config.applyDefaults()
+	return config, append(diags, config.Validate()...)
+}
+
+// checkKeys walks a decoded JSON value along the Go type it is decoded into
+func checkKeys(path string, value any, t reflect.Type, diags *Diagnostics) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Interface || value == nil {
+		return
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		switch t.Kind() {
+		case reflect.Struct:
+			fields := jsonFields(t)
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+
+			for _, key := range keys {
+				// encoding/json matches keys case insensitively
+				field, ok := fields[strings.ToLower(key)]
+				if !ok {
+					if suggestion := closestName(key, fields); suggestion != "" {
+						diags.Warning(joinPath(path, key), "unknown key, did you mean %s?", suggestion)
+					} else {
+						diags.Warning(joinPath(path, key), "unknown key")
+					}
+					continue
+				}
+				checkKeys(joinPath(path, key), v[key], field.Type, diags)
+			}
+		case reflect.Map:
+			for key, item := range v {
+				checkKeys(joinPath(path, key), item, t.Elem(), diags)
+			}
+		default:
+			diags.Error(path, "expected %s, got an object", typeName(t))
+		}
+	case []any:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			diags.Error(path, "expected %s, got a list", typeName(t))
+			return
+		}
+		for i, item := range v {
+			checkKeys(fmt.Sprintf("%s[%d]", path, i), item, t.Elem(), diags)
+		}
+	case string:
+		if t.Kind() != reflect.String {
+			diags.Error(path, "expected %s, got a string", typeName(t))
+		}
+	case bool:
+		if t.Kind() != reflect.Bool {
+			diags.Error(path, "expected %s, got a boolean", typeName(t))
+		}
+	case float64:
+		switch t.Kind() {
+		case reflect.Float32, reflect.Float64:
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if v != float64(int64(v)) {
+				diags.Error(path, "expected a whole number, got %v", v)
+			}
+		default:
+			diags.Error(path, "expected %s, got a number", typeName(t))
+		}
+	}
+}
+
+// jsonFields returns the fields of struct t by their lower case JSON name
+func jsonFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[strings.ToLower(name)] = field
+	}
+	return fields
+}
+
+// closestName returns the JSON name of the field that key is most likely a typo of, or "" if nothing is close
+func closestName(key string, fields map[string]reflect.StructField) string {
+	best, bestDistance := "", len(key)/3+1
+	for lower, field := range fields {
+		if distance := levenshtein(strings.ToLower(key), lower); distance <= bestDistance {
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "" {
+				name = field.Name
+			}
+			if distance < bestDistance || best == "" || name < best {
+				best, bestDistance = name, distance
+			}
+		}
+	}
+	return best
+}
+
+func levenshtein(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func typeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		return "an object"
+	case reflect.Slice, reflect.Array:
+		return "a list"
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	default:
+		return "a number"
+	}
+}
+
+// Validate checks a normalized config and returns every problem it finds
+func (config *Config) Validate() Diagnostics {
+	var diags Diagnostics
+
+	cameraNames := make(map[string]bool)
+	outputAddrs := make(map[string]string)
+	for i, camera := range config.Cameras {
+		path := config.cameraPath(i)
+
+		if camera.CameraName == "" {
+			diags.Error(joinPath(path, "cameraName"), "must be set")
+		} else if cameraNames[camera.CameraName] {
+			diags.Error(joinPath(path, "cameraName"), "duplicate camera name %s", camera.CameraName)
+		}
+		cameraNames[camera.CameraName] = true
+
+		switch camera.IngestMode {
+		case "ffmpeg":
+			checkStreamUrl(joinPath(path, "deviceUrl"), camera.DeviceUrl, &diags)
+		case "native":
+			// The lo res stream isn't used
+			if !rtspIngest.Available() {
+				diags.Error(config.settingPath(i, "ingestMode", camera.IngestMode == config.IngestMode), "%v", rtspIngest.ErrNoDecoder)
+			}
+		default:
+			diags.Error(config.settingPath(i, "ingestMode", camera.IngestMode == config.IngestMode), "must be either ffmpeg or native, got %q", camera.IngestMode)
+		}
+		checkStreamUrl(joinPath(path, "hiResDeviceUrl"), camera.HiResDeviceUrl, &diags)
+
+		if bypass := camera.LoStreamParamBypass; bypass.Width < 0 || bypass.Height < 0 || bypass.FPS < 0 {
+			diags.Error(joinPath(path, "loStreamParamBypass"), "width, height and fps can't be negative")
+		}
+		if bypass := camera.HiStreamParamBypass; bypass.Width < 0 || bypass.Height < 0 || bypass.FPS < 0 {
+			diags.Error(joinPath(path, "hiStreamParamBypass"), "width, height and fps can't be negative")
+		}
+
+		if camera.AnalysisWidth < 0 || camera.AnalysisHeight < 0 {
+			diags.Error(config.settingPath(i, "analysisWidth", camera.AnalysisWidth == config.AnalysisWidth && camera.AnalysisHeight == config.AnalysisHeight), "analysisWidth and analysisHeight can't be negative")
+		}
+		if camera.AnalysisFps < 0 {
+			diags.Error(config.settingPath(i, "analysisFps", camera.AnalysisFps == config.Motion.AnalysisFps), "can't be negative")
+		}
+
+		if camera.ConfidenceMinThreshold < 0 || camera.ConfidenceMinThreshold > 1 {
+			diags.Error(config.settingPath(i, "confidenceMinThreshold", camera.ConfidenceMinThreshold == config.Motion.ConfidenceMinThreshold), "must be between 0 and 1, got %v", camera.ConfidenceMinThreshold)
+		}
+		if camera.PixelMotionAreaThreshold < 0 {
+			diags.Error(config.settingPath(i, "pixelMotionAreaThreshold", camera.PixelMotionAreaThreshold == config.PixelMotionAreaThreshold), "can't be negative")
+		}
+		if camera.MotionSensitivity < 0 || camera.MotionSensitivity > 1 {
+			diags.Error(config.settingPath(i, "motionSensitivity", camera.MotionSensitivity == config.Motion.Sensitivity), "must be between 0 and 1, got %v", camera.MotionSensitivity)
+		}
+		if camera.ObjectCenterMovementThreshold < 0 {
+			diags.Error(config.settingPath(i, "objectCenterMovementThreshold", camera.ObjectCenterMovementThreshold == config.ObjectCenterMovementThreshold), "can't be negative")
+		}
+		if camera.ObjectAreaThreshold < 0 {
+			diags.Error(config.settingPath(i, "objectAreaThreshold", camera.ObjectAreaThreshold == config.ObjectAreaThreshold), "can't be negative")
+		}
+		if camera.TrackIouThreshold < 0 || camera.TrackIouThreshold > 1 {
+			diags.Error(config.settingPath(i, "trackIouThreshold", camera.TrackIouThreshold == config.Motion.TrackIouThreshold), "must be between 0 and 1, got %v", camera.TrackIouThreshold)
+		}
+		if camera.TrackMaxAge < 0 {
+			diags.Error(config.settingPath(i, "trackMaxAge", camera.TrackMaxAge == config.Motion.TrackMaxAge), "can't be negative")
+		}
+		if camera.StaticAfter < 0 {
+			diags.Error(config.settingPath(i, "staticAfter", camera.StaticAfter == config.Motion.StaticAfter), "can't be negative")
+		}
+		if camera.StaticMaxAge < 0 {
+			diags.Error(config.settingPath(i, "staticMaxAge", camera.StaticMaxAge == config.Motion.StaticMaxAge), "can't be negative")
+		}
+
+		eventGapPath := config.settingPath(i, "eventGap", camera.EventGap == config.Motion.EventGap)
+		if camera.EventGap < 0 {
+			diags.Error(eventGapPath, "can't be negative")
+		} else if camera.EventGap == 0 {
+			diags.Warning(eventGapPath, "is 0, every event ends as soon as the next motion is seen")
+		}
+		if camera.PrebufferSeconds < 0 {
+			diags.Error(config.settingPath(i, "prebufferSeconds", camera.PrebufferSeconds == config.Motion.PrebufferSeconds), "can't be negative")
+		}
+
+		hiResPath := config.settingPath(i, "hiResPath", camera.HiResPath == config.Video.HiResPath)
+		if camera.HiResPath == "" {
+			diags.Warning(hiResPath, "is not set, recordings are written to the working directory")
+		} else if info, err := os.Stat(camera.HiResPath); err != nil || !info.IsDir() {
+			diags.Warning(hiResPath, "%s is not a directory", camera.HiResPath)
+		}
+
+		for j, area := range camera.IgnoreAreasClasses {
+			areaPath := fmt.Sprintf("%s[%d]", joinPath(path, "ignoreAreasClasses"), j)
+			if len(area.Class) == 0 {
+				diags.Warning(joinPath(areaPath, "class"), "no classes, the area never ignores anything")
+			}
+
+			top, bottom, left, right, err := parseCoordinates(area.Coordinates)
+			coordinatesPath := joinPath(areaPath, "coordinates")
+			switch {
+			case err != nil:
+				diags.Error(coordinatesPath, "%v", err)
+			case top < 0 || bottom < 0 || left < 0 || right < 0:
+				diags.Error(coordinatesPath, "can't be negative")
+			case top > bottom:
+				diags.Error(coordinatesPath, "top %d is below bottom %d", top, bottom)
+			case left > right:
+				diags.Error(coordinatesPath, "left %d is right of right %d", left, right)
+			case top == bottom || left == right:
+				diags.Warning(coordinatesPath, "the area is empty and never matches")
+			default:
+				width, height := camera.LoStreamParamBypass.Width, camera.LoStreamParamBypass.Height
+				if width > 0 && height > 0 && (right > width || bottom > height) {
+					diags.Warning(coordinatesPath, "reaches outside the %dx%d lo res stream", width, height)
+				}
+			}
+		}
+
+		zoneNames := make(map[string]bool)
+		for j, zone := range camera.Zones {
+			zonePath := fmt.Sprintf("%s[%d]", joinPath(path, "zones"), j)
+			if zone.Name == "" {
+				diags.Error(joinPath(zonePath, "name"), "must be set")
+			} else if zoneNames[zone.Name] {
+				diags.Error(joinPath(zonePath, "name"), "duplicate zone name %s", zone.Name)
+			}
+			zoneNames[zone.Name] = true
+
+			if zone.Mode != "include" && zone.Mode != "exclude" {
+				diags.Error(joinPath(zonePath, "mode"), "must be either include or exclude, got %q", zone.Mode)
+			}
+			if len(zone.Points) < 3 {
+				diags.Error(joinPath(zonePath, "points"), "a polygon needs at least 3 points, got %d", len(zone.Points))
+			}
+			for k, point := range zone.Points {
+				if point[0] < 0 || point[0] > 1 || point[1] < 0 || point[1] > 1 {
+					diags.Error(fmt.Sprintf("%s[%d]", joinPath(zonePath, "points"), k), "coordinates must be between 0 and 1, got %v", point)
+				}
+			}
+			switch zone.Containment {
+			case "center", "bottom_center":
+			case "overlap":
+				if zone.MinOverlap < 0 || zone.MinOverlap > 1 {
+					diags.Error(joinPath(zonePath, "minOverlap"), "must be between 0 and 1, got %v", zone.MinOverlap)
+				}
+			default:
+				diags.Error(joinPath(zonePath, "containment"), "must be either center, bottom_center or overlap, got %q", zone.Containment)
+			}
+			if zone.DwellSeconds < 0 {
+				diags.Error(joinPath(zonePath, "dwellSeconds"), "can't be negative")
+			} else if zone.DwellSeconds > 0 && zone.Mode == "exclude" {
+				diags.Warning(joinPath(zonePath, "dwellSeconds"), "exclude zones don't send zone events")
+			}
+			for _, class := range filterClasses(zone.ClassFilters) {
+				validateClassFilter(&diags, joinPath(zonePath, "classFilters."+class), zone.ClassFilters[class])
+				if !zone.appliesTo(class) {
+					diags.Warning(joinPath(zonePath, "classFilters."+class), "the zone doesn't apply to %s", class)
+				}
+			}
+		}
+
+		for _, class := range filterClasses(camera.ClassFilters) {
+			topFilter, ok := config.Motion.ClassFilters[class]
+			filterPath := joinPath(config.settingPath(i, "classFilters", ok && topFilter == camera.ClassFilters[class]), class)
+			validateClassFilter(&diags, filterPath, camera.ClassFilters[class])
+			if len(camera.LookForClasses) > 0 && !slices.Contains(camera.LookForClasses, class) {
+				diags.Warning(filterPath, "%s is not in lookForClasses, it is never detected", class)
+			}
+		}
+
+		lineNames := make(map[string]bool)
+		for j, line := range camera.Lines {
+			linePath := fmt.Sprintf("%s[%d]", joinPath(path, "lines"), j)
+			if line.Name == "" {
+				diags.Error(joinPath(linePath, "name"), "must be set")
+			} else if lineNames[line.Name] {
+				diags.Error(joinPath(linePath, "name"), "duplicate line name %s", line.Name)
+			}
+			lineNames[line.Name] = true
+
+			for k, point := range line.Points {
+				if point[0] < 0 || point[0] > 1 || point[1] < 0 || point[1] > 1 {
+					diags.Error(fmt.Sprintf("%s[%d]", joinPath(linePath, "points"), k), "coordinates must be between 0 and 1, got %v", point)
+				}
+			}
+			if line.Points[0] == line.Points[1] {
+				diags.Error(joinPath(linePath, "points"), "start and end are the same point")
+			}
+			if line.Direction != "both" && line.Direction != "in" && line.Direction != "out" {
+				diags.Error(joinPath(linePath, "direction"), "must be either both, in or out, got %q", line.Direction)
+			}
+			if line.Anchor != "center" && line.Anchor != "bottom_center" {
+				diags.Error(joinPath(linePath, "anchor"), "must be either center or bottom_center, got %q", line.Anchor)
+			}
+		}
+
+		checkArmName(config.settingPath(i, "arm.detection", camera.Arm.Detection == config.Arm.Detection), camera.Arm.Detection, config.Schedules, &diags)
+		checkArmName(config.settingPath(i, "arm.recording", camera.Arm.Recording == config.Arm.Recording), camera.Arm.Recording, config.Schedules, &diags)
+		sinks := make([]string, 0, len(camera.Arm.Notifications))
+		for sink := range camera.Arm.Notifications {
+			sinks = append(sinks, sink)
+		}
+		sort.Strings(sinks)
+		for _, sink := range sinks {
+			name := camera.Arm.Notifications[sink]
+			topName, ok := config.Arm.Notifications[sink]
+			sinkPath := joinPath(config.settingPath(i, "arm.notifications", ok && topName == name), sink)
+			if !slices.Contains(notificationSinks, sink) {
+				diags.Error(sinkPath, "unknown sink %q, expected one of %s", sink, strings.Join(notificationSinks, ", "))
+				continue
+			}
+			checkArmName(sinkPath, name, config.Schedules, &diags)
+		}
+
+		if camera.EnableOutputStream {
+			if camera.OutputStreamAddr == "" {
+				diags.Error(joinPath(path, "outputStreamAddr"), "must be set when enableOutputStream is true")
+			} else if other, ok := outputAddrs[camera.OutputStreamAddr]; ok {
+				diags.Error(joinPath(path, "outputStreamAddr"), "%s is already used by camera %s", camera.OutputStreamAddr, other)
+			} else {
+				outputAddrs[camera.OutputStreamAddr] = camera.CameraName
+			}
+		}
+	}
+
+	if backends := detector.Backends(); !slices.Contains(backends, config.Motion.Detector) {
+		diags.Error("motion.detector", "unknown detector %q, available: %s", config.Motion.Detector, strings.Join(backends, ", "))
+	}
+	if config.Motion.Detector == "onnx" && config.Motion.OnnxModel == "" {
+		diags.Error("motion.onnxModel", "must be set for the onnx detector")
+	}
+	if config.Motion.Detector == "mock" && len(config.Motion.MockPredictions) == 0 {
+		diags.Warning("motion.mockPredictions", "is empty, the mock detector never finds anything")
+	}
+	if config.Motion.FrameQueueSize < 0 {
+		diags.Error("motion.frameQueueSize", "can't be negative")
+	}
+
+	mqttConfig := config.Events.Mqtt
+	if mqttConfig.Url != "" || mqttConfig.Host != "" || mqttConfig.Topic != "" {
+		if mqttConfig.Url != "" {
+			checkMqttUrl(*config, &diags)
+		} else {
+			if mqttConfig.Host == "" {
+				diags.Error("events.mqtt.host", "must be set to send events to mqtt")
+			}
+			if mqttConfig.Port <= 0 || mqttConfig.Port > 65535 {
+				diags.Error("events.mqtt.port", "must be a port number, got %d", mqttConfig.Port)
+			}
+		}
+		if mqttConfig.Topic == "" && config.Api.CommandTopic == "" {
+			diags.Error("events.mqtt.topic", "must be set to send events to mqtt")
+		}
+		if mqttConfig.Pass != "" && mqttConfig.Password != "" && mqttConfig.Pass != mqttConfig.Password {
+			diags.Warning("events.mqtt.password", "differs from pass, pass is used")
+		}
+		if mqttConfig.Qos < 0 || mqttConfig.Qos > 2 {
+			diags.Error("events.mqtt.qos", "must be 0, 1 or 2, got %d", mqttConfig.Qos)
+		}
+		if mqttConfig.QueueSize < 0 {
+			diags.Error("events.mqtt.queueSize", "can't be negative")
+		}
+	}
+	checkHttpUrl("events.webhookUrl", config.Events.Webhook, &diags)
+	checkHttpUrl("events.slack.url", config.Events.Slack.Url, &diags)
+	webhookNames := make(map[string]string)
+	for i, webhook := range config.Events.Webhooks {
+		webhookPath := fmt.Sprintf("events.webhooks[%d]", i)
+		if webhook.Url == "" {
+			diags.Error(joinPath(webhookPath, "url"), "must be set")
+		}
+		checkHttpUrl(joinPath(webhookPath, "url"), webhook.Url, &diags)
+		if other, ok := webhookNames[haId(webhook.Name)]; ok {
+			diags.Error(joinPath(webhookPath, "name"), "%q is already used by webhook %q", webhook.Name, other)
+		} else {
+			webhookNames[haId(webhook.Name)] = webhook.Name
+		}
+		if !slices.Contains([]string{"POST", "PUT", "PATCH"}, webhook.Method) {
+			diags.Error(joinPath(webhookPath, "method"), "must be POST, PUT or PATCH, got %q", webhook.Method)
+		}
+		if webhook.Snapshot != "" && webhook.Snapshot != "multipart" && webhook.Snapshot != "base64" {
+			diags.Error(joinPath(webhookPath, "snapshot"), "must be multipart or base64, got %q", webhook.Snapshot)
+		}
+		if webhook.Template != "" {
+			if _, err := template.New(webhook.Name).Funcs(webhookFuncs).Parse(webhook.Template); err != nil {
+				diags.Error(joinPath(webhookPath, "template"), "%v", err)
+			}
+		}
+		for j, eventType := range webhook.EventTypes {
+			if !slices.Contains(eventTypes, eventType) {
+				diags.Warning(fmt.Sprintf("%s[%d]", joinPath(webhookPath, "eventTypes"), j), "unknown event type %q, expected one of %s", eventType, strings.Join(eventTypes, ", "))
+			}
+		}
+		for j, name := range webhook.Cameras {
+			if !cameraNames[name] {
+				diags.Warning(fmt.Sprintf("%s[%d]", joinPath(webhookPath, "cameras"), j), "no camera is called %q", name)
+			}
+		}
+	}
+	if config.Events.ScriptPath != "" {
+		if info, err := os.Stat(config.Events.ScriptPath); err != nil {
+			diags.Warning("events.scriptPath", "%v", err)
+		} else if info.Mode()&0111 == 0 {
+			diags.Warning("events.scriptPath", "%s is not executable", config.Events.ScriptPath)
+		}
+	}
+	delivery := config.Events.Delivery
+	if delivery.QueueSize < 0 {
+		diags.Error("events.delivery.queueSize", "can't be negative")
+	}
+	if delivery.TimeoutSeconds < 0 {
+		diags.Error("events.delivery.timeoutSeconds", "can't be negative")
+	}
+	if delivery.RetryMaxSeconds < 0 {
+		diags.Error("events.delivery.retryMaxSeconds", "can't be negative")
+	}
+	if delivery.MaxAgeHours < 0 {
+		diags.Error("events.delivery.maxAgeHours", "can't be negative")
+	}
+
+	names := make([]string, 0, len(config.Schedules))
+	for name := range config.Schedules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		schedulePath := joinPath("schedules", name)
+		if name == "always" || name == "never" {
+			diags.Error(schedulePath, "%s is reserved, pick another name", name)
+		}
+		for _, problem := range schedule.Check(config.Schedules[name]) {
+			diags.Error(joinPath(schedulePath, problem.Path), "%s", problem.Message)
+		}
+	}
+
+	if config.Api.Addr != "" && config.Api.Token == "" {
+		diags.Warning("api.token", "is not set, the API only serves /api/status")
+	}
+	if config.Api.CommandTopic != "" && mqttBroker(*config) == "" {
+		diags.Error("api.commandTopic", "needs the broker of events.mqtt")
+	}
+	if config.Api.CommandTopic != "" && config.Api.Token == "" {
+		diags.Error("api.commandTopic", "needs api.token, commands without it are rejected")
+	}
+	if mqttConfig.HomeAssistant.Discovery && (mqttBroker(*config) == "" || mqttConfig.Topic == "") {
+		diags.Error("events.mqtt.homeAssistant.discovery", "needs the broker and topic of events.mqtt")
+	}
+	if mqttConfig.HomeAssistant.AllowArm {
+		diags.Warning("events.mqtt.homeAssistant.allowArm", "lets anyone who can publish to the broker arm and disarm cameras, it takes no token")
+	}
+
+	// Check if pushover tokens are provided if enabled
+	if config.Notifications.EnablePushoverAlerts {
+		if config.Notifications.PushoverAppToken == "" {
+			diags.Error("notifications.pushoverAppToken", "must be set when enablePushoverAlerts is true")
+		}
+		if config.Notifications.PushoverUserKey == "" {
+			diags.Error("notifications.pushoverUserKey", "must be set when enablePushoverAlerts is true")
+		}
+	}
+
+	return diags
+}
+
+func checkStreamUrl(path, rawUrl string, diags *Diagnostics) {
+	if rawUrl == "" {
+		diags.Error(path, "must be set")
+		return
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Scheme == "" {
+		diags.Error(path, "must be a URL like rtsp://host:554/stream")
+	}
+}
+
+func checkHttpUrl(path, rawUrl string, diags *Diagnostics) {
+	if rawUrl == "" {
+		return
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		diags.Error(path, "must be a http(s) URL")
+	}
+}
+
+// checkMqttUrl checks events.mqtt.url and the TLS files it uses
+func checkMqttUrl(config Config, diags *Diagnostics) {
+	mqttConfig := config.Events.Mqtt
+	u, err := url.Parse(mqttConfig.Url)
+	if err != nil || u.Host == "" || !slices.Contains([]string{"mqtt", "tcp", "mqtts", "ssl", "tls", "ws", "wss"}, u.Scheme) {
+		diags.Error("events.mqtt.url", "must be a mqtt://, mqtts://, tcp://, ssl://, ws:// or wss:// URL")
+		return
+	}
+	if mqttConfig.Host != "" || mqttConfig.Port != 0 {
+		diags.Warning("events.mqtt.host", "is ignored, url is used")
+	}
+
+	tlsFiles := map[string]string{"caFile": mqttConfig.Tls.CaFile, "certFile": mqttConfig.Tls.CertFile, "keyFile": mqttConfig.Tls.KeyFile}
+	secure := slices.Contains([]string{"mqtts", "ssl", "tls", "wss"}, u.Scheme)
+	for _, key := range []string{"caFile", "certFile", "keyFile"} {
+		path := joinPath("events.mqtt.tls", key)
+		if tlsFiles[key] == "" {
+			continue
+		}
+		if !secure {
+			diags.Warning(path, "is only used with mqtts://, ssl:// and wss:// URLs")
+		} else if _, err := os.Stat(tlsFiles[key]); err != nil {
+			diags.Error(path, "%v", err)
+		}
+	}
+	if (mqttConfig.Tls.CertFile == "") != (mqttConfig.Tls.KeyFile == "") {
+		diags.Error("events.mqtt.tls", "certFile and keyFile must be set together")
+	}
+}
+
+// checkArmName reports references to schedules that don't exist
+func checkArmName(path, name string, schedules map[string]schedule.Config, diags *Diagnostics) {
+	if !validArmName(name, schedules) {
+		diags.Error(path, "unknown schedule %q, expected always, never or one of the schedules", name)
+	}
+}
+
+// ProbeStreams checks that the streams of every camera can be opened with ffprobe, which takes a few seconds per stream
+func ProbeStreams(config Config) Diagnostics {
+	var diags Diagnostics
+	if _, err := CheckFFmpegAndFFprobe(); err != nil {
+		diags.Error("", "%v", err)
+		return diags
+	}
+
+	for i, camera := range config.Cameras {
+		path := config.cameraPath(i)
+		streams := [][2]string{{"hiResDeviceUrl", camera.HiResDeviceUrl}}
+		if camera.IngestMode != "native" {
+			streams = append([][2]string{{"deviceUrl", camera.DeviceUrl}}, streams...)
+		}
+
+		for _, stream := range streams {
+			if stream[1] == "" {
+				continue // Already reported by Validate
+			}
+			info, err := getStreamInfo(stream[1])
+			if err != nil {
+				diags.Error(joinPath(path, stream[0]), "unreachable: %v", err)
+				continue
+			}
+
+			codec := ""
+			for _, s := range info.Streams {
+				if s.CodecType == "video" {
+					codec = s.CodecName
+					break
+				}
+			}
+			if codec == "" {
+				diags.Error(joinPath(path, stream[0]), "no video stream found")
+			} else if camera.IngestMode == "native" && codec != "h264" {
+				diags.Error(joinPath(path, stream[0]), "native ingest only supports h264, got: %s", codec)
+			}
+		}
+	}
+	return diags
+}
+
+// filterClasses returns the classes of a class filter table, sorted so diagnostics come in a stable order
+func filterClasses(filters map[string]ClassFilter) []string {
+	classes := make([]string, 0, len(filters))
+	for class := range filters {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	return classes
+}
+
+func validateClassFilter(diags *Diagnostics, path string, filter ClassFilter) {
+	if filter.MinConfidence < 0 || filter.MinConfidence > 1 {
+		diags.Error(joinPath(path, "minConfidence"), "must be between 0 and 1, got %v", filter.MinConfidence)
+	}
+	if filter.MinArea < 0 || filter.MinArea > 1 {
+		diags.Error(joinPath(path, "minArea"), "must be between 0 and 1, got %v", filter.MinArea)
+	}
+	if filter.MaxArea < 0 || filter.MaxArea > 1 {
+		diags.Error(joinPath(path, "maxArea"), "must be between 0 and 1, got %v", filter.MaxArea)
+	} else if filter.MaxArea > 0 && filter.MaxArea < filter.MinArea {
+		diags.Error(joinPath(path, "maxArea"), "is below minArea %v", filter.MinArea)
+	}
+	if filter.MinAspectRatio < 0 {
+		diags.Error(joinPath(path, "minAspectRatio"), "can't be negative")
+	}
+	if filter.MaxAspectRatio < 0 {
+		diags.Error(joinPath(path, "maxAspectRatio"), "can't be negative")
+	} else if filter.MaxAspectRatio > 0 && filter.MaxAspectRatio < filter.MinAspectRatio {
+		diags.Error(joinPath(path, "maxAspectRatio"), "is below minAspectRatio %v", filter.MinAspectRatio)
+	}
+}
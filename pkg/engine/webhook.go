@@ -0,0 +1,221 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+// Headers of signed webhook requests
+const (
+	WebhookTimestampHeader = "X-Firescrew-Timestamp"
+	WebhookSignatureHeader = "X-Firescrew-Signature"
+)
+
+// WebhookSink sends the event JSON, or a body rendered from Template, to Url. It can be limited to some events
+// and attach a snapshot of the camera. Only Url is required, the zero values POST the event JSON.
+type WebhookSink struct {
+	Url         string
+	Name        string // Of an events.webhooks entry, each of them has its own outbox
+	Method      string // Default POST
+	Headers     map[string]string
+	Secret      string             // Signs every request, see WebhookSignature
+	Template    *template.Template // Renders the body from webhookData, nil sends the event JSON
+	ContentType string             // Of the body, default application/json
+	EventTypes  []string           // Only these events, empty sends every event
+	Classes     []string           // Only events with an object of these classes
+	Cameras     []string           // Only events of these cameras
+	Snapshot    string             // multipart attaches the snapshot of the event as file, base64 adds it to the body
+	Timeout     time.Duration      // 0 waits as long as it takes
+}
+
+// webhookData is what webhook templates render, eg: {"text": "{{.Type}} on {{.CameraName}}: {{.Event.id}}"}
+type webhookData struct {
+	Type       string
+	CameraName string
+	Event      map[string]any // The event JSON
+	Payload    string         // The event JSON as text
+	Snapshot   string         // Base64 JPEG when snapshot is base64
+}
+
+var webhookFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// NewWebhookSink creates the sink of an events.webhooks entry
+func NewWebhookSink(config WebhookConfig, timeout time.Duration) (*WebhookSink, error) {
+	sink := &WebhookSink{
+		Url:         config.Url,
+		Name:        config.Name,
+		Method:      config.Method,
+		Headers:     config.Headers,
+		Secret:      config.Secret,
+		ContentType: config.ContentType,
+		EventTypes:  config.EventTypes,
+		Classes:     config.Classes,
+		Cameras:     config.Cameras,
+		Snapshot:    config.Snapshot,
+		Timeout:     timeout,
+	}
+	if config.Template != "" {
+		tmpl, err := template.New(config.Name).Funcs(webhookFuncs).Parse(config.Template)
+		if err != nil {
+			return nil, err
+		}
+		sink.Template = tmpl
+	}
+	return sink, nil
+}
+
+// wants reports if the filters let event through, it is checked before the event is queued
+func (s *WebhookSink) wants(event Event) bool {
+	if len(s.EventTypes) > 0 && !slices.Contains(s.EventTypes, event.Type) {
+		return false
+	}
+	if len(s.Cameras) > 0 && !slices.Contains(s.Cameras, event.CameraName) {
+		return false
+	}
+	if len(s.Classes) > 0 {
+		for _, class := range eventClasses(event.Payload) {
+			if slices.Contains(s.Classes, class) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// eventClasses returns the classes of an event JSON, from its class field or its objects
+func eventClasses(payload []byte) []string {
+	var event struct {
+		Class   string `json:"class"`
+		Objects []struct {
+			Class string `json:"class"`
+		} `json:"objects"`
+	}
+	json.Unmarshal(payload, &event)
+
+	var classes []string
+	if event.Class != "" {
+		classes = append(classes, event.Class)
+	}
+	for _, object := range event.Objects {
+		classes = append(classes, object.Class)
+	}
+	return classes
+}
+
+func (s *WebhookSink) wantsSnapshot() bool {
+	return s.Snapshot != ""
+}
+
+// Send posts event, retries of the same event send the same body
+func (s *WebhookSink) Send(event Event) error {
+	body, contentType, err := s.body(event, event.Snapshot)
+	if err != nil {
+		return fmt.Errorf("Failed to render webhook body: %s", err)
+	}
+
+	method := s.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequest(method, s.Url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Failed to post to webhook: %s", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	for key, value := range s.Headers {
+		req.Header.Set(key, value)
+	}
+	if s.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(WebhookTimestampHeader, timestamp)
+		req.Header.Set(WebhookSignatureHeader, WebhookSignature(s.Secret, timestamp, body))
+	}
+	if err := doRequest(req, s.Timeout); err != nil {
+		return fmt.Errorf("Failed to post to webhook: %s", err)
+	}
+	return nil
+}
+
+// WebhookSignature returns the signature header of a request: sha256= followed by the hex HMAC-SHA256 of
+// "<timestamp>.<body>" keyed with secret. Receivers compute the same and reject requests with old timestamps.
+func WebhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// body returns the request body with its content type
+func (s *WebhookSink) body(event Event, snapshot []byte) ([]byte, string, error) {
+	contentType := s.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+
+	body := event.Payload
+	encoded := ""
+	if s.Snapshot == "base64" && snapshot != nil {
+		encoded = base64.StdEncoding.EncodeToString(snapshot)
+	}
+	if s.Template != nil {
+		data := webhookData{Type: event.Type, CameraName: event.CameraName, Payload: string(event.Payload), Snapshot: encoded}
+		json.Unmarshal(event.Payload, &data.Event)
+		var buf bytes.Buffer
+		if err := s.Template.Execute(&buf, data); err != nil {
+			return nil, "", err
+		}
+		body = buf.Bytes()
+	} else if encoded != "" {
+		// Added as last field, the event JSON is an object
+		trimmed := bytes.TrimSpace(event.Payload)
+		if len(trimmed) < 2 || trimmed[len(trimmed)-1] != '}' {
+			return nil, "", fmt.Errorf("%s event is not a JSON object", event.Type)
+		}
+		separator := ","
+		if bytes.Equal(bytes.Join(bytes.Fields(trimmed), nil), []byte("{}")) {
+			separator = ""
+		}
+		body = append(trimmed[:len(trimmed)-1:len(trimmed)-1], []byte(separator+`"snapshot":"`+encoded+`"}`)...)
+	}
+	if s.Snapshot != "multipart" || snapshot == nil {
+		return body, contentType, nil
+	}
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	// Derived from the parts instead of random, retries send the same body
+	sum := sha256.New()
+	sum.Write(body)
+	sum.Write(snapshot)
+	writer.SetBoundary(hex.EncodeToString(sum.Sum(nil)))
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="event"`)
+	header.Set("Content-Type", contentType)
+	part, _ := writer.CreatePart(header)
+	part.Write(body)
+	header = make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="snapshot"; filename="snapshot.jpg"`)
+	header.Set("Content-Type", "image/jpeg")
+	part, _ = writer.CreatePart(header)
+	part.Write(snapshot)
+	writer.Close()
+	return buf.Bytes(), writer.FormDataContentType(), nil
+}
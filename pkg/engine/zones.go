@@ -0,0 +1,263 @@
+package engine
+
+import (
+	"fmt"
+	"image"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/8ff/firescrew/pkg/events"
+)
+
+// Zone is a named polygon of the frame. Include zones limit events to objects inside them, objects inside an
+// exclude zone are ignored. Coordinates are relative to the frame size so zones don't depend on the resolution.
+type Zone struct {
+	Name         string                 `json:"name"`
+	Mode         string                 `json:"mode"`         // include or exclude
+	Classes      []string               `json:"classes"`      // Classes the zone applies to, empty for every class
+	Points       [][2]float64           `json:"points"`       // Polygon corners as [x, y] from 0 to 1, eg: [[0, 0.5], [1, 0.5], [1, 1], [0, 1]] is the bottom half
+	Containment  string                 `json:"containment"`  // center (default), bottom_center or overlap, which part of an object has to be inside
+	MinOverlap   float64                `json:"minOverlap"`   // Share of the object box inside the zone for overlap, default 0.5
+	DwellSeconds float64                `json:"dwellSeconds"` // Send zone_dwell when an object stays in the zone this long, 0 disables it
+	ClassFilters map[string]ClassFilter `json:"classFilters"` // Replace the class filters of the camera for detections in the zone
+}
+
+// objectZoneState tracks the zones a single object is in
+type objectZoneState struct {
+	object   TrackedObject // Last detection
+	lastSeen time.Time
+	zones    map[string]*zonePresence // By zone name
+}
+
+// names returns the zones the object is in, sorted
+func (state *objectZoneState) names() []string {
+	names := make([]string, 0, len(state.zones))
+	for name := range state.zones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type zonePresence struct {
+	entered time.Time
+	dwelled bool // zone_dwell was sent
+}
+
+func (z Zone) appliesTo(class string) bool {
+	return len(z.Classes) == 0 || slices.Contains(z.Classes, class)
+}
+
+// contains reports if box, in pixels of a width x height frame, is inside the zone
+func (z Zone) contains(box image.Rectangle, width, height int) bool {
+	if width <= 0 || height <= 0 {
+		return false
+	}
+	left, right := float64(box.Min.X)/float64(width), float64(box.Max.X)/float64(width)
+	top, bottom := float64(box.Min.Y)/float64(height), float64(box.Max.Y)/float64(height)
+
+	switch z.Containment {
+	case "bottom_center":
+		return pointInPolygon((left+right)/2, bottom, z.Points)
+	case "overlap":
+		area := (right - left) * (bottom - top)
+		if area <= 0 {
+			return pointInPolygon(left, top, z.Points)
+		}
+		return polygonArea(clipPolygon(z.Points, left, top, right, bottom))/area >= z.MinOverlap
+	default:
+		return pointInPolygon((left+right)/2, (top+bottom)/2, z.Points)
+	}
+}
+
+// zonesOf returns the names of the zones object is in and whether it passes them: it must not be in an exclude
+// zone and, if include zones apply to its class, it must be in one of them
+func (c *Camera) zonesOf(object TrackedObject) ([]string, bool) {
+	var names []string
+	hasInclude, included, excluded := false, false, false
+	for _, zone := range c.Config.Zones {
+		if !zone.appliesTo(object.Class) {
+			continue
+		}
+		inside := zone.contains(object.BBox, c.AnalysisParams.Width, c.AnalysisParams.Height)
+		if zone.Mode == "include" {
+			hasInclude = true
+			included = included || inside
+		}
+		if inside {
+			names = append(names, zone.Name)
+			excluded = excluded || zone.Mode == "exclude"
+		}
+	}
+	return names, !excluded && (!hasInclude || included)
+}
+
+// updateZones sends zone_enter, zone_exit and zone_dwell for a detection of a tracked object. Exclude zones
+// don't send events, objects inside them are ignored.
+func (c *Camera) updateZones(object TrackedObject, now time.Time) {
+	state := c.objectZones[object.TrackID]
+	if state == nil {
+		if len(object.Zones) == 0 {
+			return
+		}
+		if c.objectZones == nil {
+			c.objectZones = make(map[int]*objectZoneState)
+		}
+		state = &objectZoneState{zones: make(map[string]*zonePresence)}
+		c.objectZones[object.TrackID] = state
+	}
+	state.object = object
+	state.lastSeen = now
+
+	for _, name := range object.Zones {
+		if state.zones[name] == nil {
+			state.zones[name] = &zonePresence{entered: now}
+			c.emitZoneEvent(EventZoneEnter, name, object, state.zones[name], now)
+		}
+	}
+
+	for _, name := range state.names() {
+		if !slices.Contains(object.Zones, name) {
+			c.emitZoneEvent(EventZoneExit, name, object, state.zones[name], now)
+			delete(state.zones, name)
+		}
+	}
+
+	for _, zone := range c.Config.Zones {
+		presence := state.zones[zone.Name]
+		if presence != nil && zone.DwellSeconds > 0 && !presence.dwelled && now.Sub(presence.entered).Seconds() >= zone.DwellSeconds {
+			presence.dwelled = true
+			c.emitZoneEvent(EventZoneDwell, zone.Name, object, presence, now)
+		}
+	}
+
+	if len(state.zones) == 0 {
+		delete(c.objectZones, object.TrackID)
+	}
+}
+
+// followingObjects reports if an object that isn't static is in a zone, detection keeps running until it left
+func (c *Camera) followingObjects() bool {
+	for _, state := range c.objectZones {
+		if !state.object.Static {
+			return true
+		}
+	}
+	return false
+}
+
+// expireZones sends zone_exit for objects that weren't detected for objectLostTimeout
+func (c *Camera) expireZones(now time.Time) {
+	for id, state := range c.objectZones {
+		if now.Sub(state.lastSeen) < objectLostTimeout {
+			continue
+		}
+		for _, name := range state.names() {
+			c.emitZoneEvent(EventZoneExit, name, state.object, state.zones[name], now)
+		}
+		delete(c.objectZones, id)
+	}
+}
+
+// emitZoneEvent sends a zone event and adds it to the metadata of the running motion event
+func (c *Camera) emitZoneEvent(eventType, zone string, object TrackedObject, presence *zonePresence, now time.Time) {
+	event := ZoneEvent{
+		Header:     events.NewHeader(eventType, c.Config.CameraName, now),
+		Zone:       zone,
+		TrackID:    object.TrackID,
+		Class:      object.Class,
+		Confidence: object.Confidence,
+		BBox:       events.NewBox(object.BBox),
+		EnteredAt:  presence.entered,
+		Dwell:      now.Sub(presence.entered).Seconds(),
+	}
+
+	c.MotionMutex.Lock()
+	if c.MotionVideo.ID != "" {
+		event.EventID = c.MotionVideo.ID
+		c.MotionVideo.ZoneEvents = append(c.MotionVideo.ZoneEvents, event)
+	}
+	c.MotionMutex.Unlock()
+
+	Log("event", fmt.Sprintf("[%s] %s %s #%d %s (%.0fs)", c.Config.CameraName, strings.ToUpper(eventType), zone, object.TrackID, object.Class, event.Dwell))
+	c.emitDetection(eventType, event)
+}
+
+// inIgnoreArea reports if the center of object is in one of the ignore areas of its class
+func (c *Camera) inIgnoreArea(object TrackedObject) bool {
+	for _, area := range c.Config.IgnoreAreasClasses {
+		if slices.Contains(area.Class, object.Class) &&
+			object.Center.X > area.Left && object.Center.X < area.Right && object.Center.Y > area.Top && object.Center.Y < area.Bottom {
+			return true
+		}
+	}
+	return false
+}
+
+// pointInPolygon casts a ray to the right of the point and counts the edges it crosses
+func pointInPolygon(x, y float64, points [][2]float64) bool {
+	inside := false
+	for i, j := 0, len(points)-1; i < len(points); j, i = i, i+1 {
+		xi, yi := points[i][0], points[i][1]
+		xj, yj := points[j][0], points[j][1]
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// clipPolygon cuts the polygon down to the rectangle (Sutherland-Hodgman)
+func clipPolygon(points [][2]float64, left, top, right, bottom float64) [][2]float64 {
+	edges := []struct {
+		inside    func(p [2]float64) bool
+		intersect func(a, b [2]float64) [2]float64
+	}{
+		{func(p [2]float64) bool { return p[0] >= left }, func(a, b [2]float64) [2]float64 { return atX(a, b, left) }},
+		{func(p [2]float64) bool { return p[0] <= right }, func(a, b [2]float64) [2]float64 { return atX(a, b, right) }},
+		{func(p [2]float64) bool { return p[1] >= top }, func(a, b [2]float64) [2]float64 { return atY(a, b, top) }},
+		{func(p [2]float64) bool { return p[1] <= bottom }, func(a, b [2]float64) [2]float64 { return atY(a, b, bottom) }},
+	}
+
+	result := points
+	for _, edge := range edges {
+		input := result
+		result = nil
+		for i, current := range input {
+			previous := input[(i+len(input)-1)%len(input)]
+			switch {
+			case edge.inside(current) && !edge.inside(previous):
+				result = append(result, edge.intersect(previous, current), current)
+			case edge.inside(current):
+				result = append(result, current)
+			case edge.inside(previous):
+				result = append(result, edge.intersect(previous, current))
+			}
+		}
+	}
+	return result
+}
+
+// atX is the point of segment a-b at x
+func atX(a, b [2]float64, x float64) [2]float64 {
+	return [2]float64{x, a[1] + (b[1]-a[1])*(x-a[0])/(b[0]-a[0])}
+}
+
+// atY is the point of segment a-b at y
+func atY(a, b [2]float64, y float64) [2]float64 {
+	return [2]float64{a[0] + (b[0]-a[0])*(y-a[1])/(b[1]-a[1]), y}
+}
+
+// polygonArea uses the shoelace formula
+func polygonArea(points [][2]float64) float64 {
+	area := 0.0
+	for i, j := 0, len(points)-1; i < len(points); j, i = i, i+1 {
+		area += (points[j][0] + points[i][0]) * (points[j][1] - points[i][1])
+	}
+	if area < 0 {
+		area = -area
+	}
+	return area / 2
+}
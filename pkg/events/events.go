@@ -0,0 +1,195 @@
+// Package events defines the JSON of every event firescrew sends to its sinks. Every event carries Version, which changes whenever a field is removed or changes its meaning. Added fields
+// don't change it. Schema is the JSON Schema of these events, consumers can validate what they receive with it.
+package events
+
+import (
+	_ "embed"
+	"image"
+	"time"
+)
+
+const Version = 1
+
+// Event types
+const (
+	TypeMotionStart     = "motion_start"
+	TypeMotionUpdate    = "motion_update"
+	TypeMotionEnd       = "motion_end"
+	TypeInference       = "inference_avg"
+	TypeError           = "error"
+	TypeAnalysisFps     = "analysis_fps_changed"
+	TypeConfigReloaded  = "config_reloaded"
+	TypeZoneEnter       = "zone_enter"
+	TypeZoneExit        = "zone_exit"
+	TypeZoneDwell       = "zone_dwell"
+	TypeLineCrossed     = "line_crossed"
+	TypeObjectArrived   = "object_arrived"
+	TypeObjectDeparted  = "object_departed"
+	TypeScheduleChanged = "schedule_changed"
+)
+
+//go:embed schema.json
+var Schema []byte
+
+// Header starts every event, CameraName is empty for events of the whole process like config_reloaded
+type Header struct {
+	SchemaVersion int       `json:"schema_version"`
+	Type          string    `json:"type"`
+	Timestamp     time.Time `json:"timestamp"`
+	CameraName    string    `json:"camera_name"`
+}
+
+// NewHeader returns the header of an event of the current version
+func NewHeader(eventType, cameraName string, timestamp time.Time) Header {
+	return Header{SchemaVersion: Version, Type: eventType, Timestamp: timestamp, CameraName: cameraName}
+}
+
+// Box is a rectangle in pixels of the analysed frame
+type Box struct {
+	Left   int `json:"left"`
+	Top    int `json:"top"`
+	Right  int `json:"right"`
+	Bottom int `json:"bottom"`
+}
+
+func NewBox(rect image.Rectangle) Box {
+	return Box{Left: rect.Min.X, Top: rect.Min.Y, Right: rect.Max.X, Bottom: rect.Max.Y}
+}
+
+// Object is a detection that triggered or joined an event, one per tracked object
+type Object struct {
+	TrackID    int      `json:"track_id"`
+	Class      string   `json:"class"`
+	Confidence float32  `json:"confidence"`
+	BBox       Box      `json:"bbox"`
+	Area       float64  `json:"area"`
+	Zones      []string `json:"zones"` // Zones the object was in when it was detected
+}
+
+// MotionEvent is sent when an event starts (motion_start) and for every new object while it runs (motion_update)
+type MotionEvent struct {
+	Header
+	ID                  string    `json:"id"`
+	MotionStart         time.Time `json:"motion_start"`
+	MotionTriggeredLast time.Time `json:"motion_triggered_last"`
+	Objects             []Object  `json:"objects"`        // Every object of the event so far
+	MotionRegions       []Box     `json:"motion_regions"` // Moving areas of the frame
+}
+
+// ClassSummary sums up the objects of one class in an event
+type ClassSummary struct {
+	Count         int     `json:"count"`
+	MaxConfidence float32 `json:"max_confidence"`
+}
+
+// MotionEndEvent is sent once an event ended and its clip is final, after recoding it to mp4
+type MotionEndEvent struct {
+	Header
+	ID           string                  `json:"id"`
+	MotionStart  time.Time               `json:"motion_start"`
+	MotionEnd    time.Time               `json:"motion_end"`
+	Duration     float64                 `json:"duration_seconds"`
+	Manual       bool                    `json:"manual"`   // Recorded on request of the control API
+	Recorded     bool                    `json:"recorded"` // False while recording was disarmed, there is no clip, snapshot or metadata then
+	ClipPath     string                  `json:"clip_path"`
+	Snapshots    []string                `json:"snapshots"` // Paths of the snapshots
+	MetadataPath string                  `json:"metadata_path"`
+	Objects      []Object                `json:"objects"`
+	Classes      map[string]ClassSummary `json:"classes"` // By class
+}
+
+// InferenceEvent is sent every few detections with the inference times in ms
+type InferenceEvent struct {
+	Header
+	InferenceAvg float64 `json:"inference_avg"`
+	InferenceMin float64 `json:"inference_min"`
+	InferenceMax float64 `json:"inference_max"`
+	Ceiling      int     `json:"ceiling"` // Inference time the analysis fps allows
+	AnalysisFps  float64 `json:"analysis_fps"`
+	TargetFps    float64 `json:"analysis_fps_target"`
+	LatencyAvg   float64 `json:"decision_latency_avg"` // Time from reading a frame off the feed to finishing detection
+	Dropped      uint64  `json:"dropped_frames"`       // Frames dropped by the frame queue since start
+}
+
+// ErrorEvent is sent when part of a camera pipeline fails, eg: the feed or the detector
+type ErrorEvent struct {
+	Header
+	Source  string `json:"source"` // feed, detector, recording, recode or metadata
+	Message string `json:"message"`
+	EventID string `json:"event_id"` // Motion event running at the time, empty if there is none
+}
+
+// AnalysisFpsChangedEvent is sent when adaptive analysis changes the analysis fps
+type AnalysisFpsChangedEvent struct {
+	Header
+	OldFps       float64 `json:"old_fps"`
+	NewFps       float64 `json:"new_fps"`
+	TargetFps    float64 `json:"target_fps"`
+	InferenceAvg float64 `json:"inference_avg"`
+	Reason       string  `json:"reason"`
+}
+
+// ConfigReloadedEvent is sent when a reload applied a new config
+type ConfigReloadedEvent struct {
+	Header
+	Changed         []string `json:"changed"`           // JSON paths of the settings that changed, eg: cameras[0].confidenceMinThreshold
+	Restarted       []string `json:"restarted_cameras"` // Cameras whose streams changed
+	Added           []string `json:"added_cameras"`
+	Removed         []string `json:"removed_cameras"`
+	RestartRequired []string `json:"restart_required"` // Changed settings that only apply after restarting firescrew
+}
+
+// ZoneEvent is sent when a tracked object enters a zone (zone_enter), leaves it or is lost (zone_exit) and when it
+// stayed longer than the dwellSeconds of the zone (zone_dwell)
+type ZoneEvent struct {
+	Header
+	Zone       string    `json:"zone"`
+	TrackID    int       `json:"track_id"`
+	Class      string    `json:"class"`
+	Confidence float32   `json:"confidence"`
+	BBox       Box       `json:"bbox"`
+	EnteredAt  time.Time `json:"entered_at"`
+	Dwell      float64   `json:"dwell_seconds"` // Time spent in the zone so far
+	EventID    string    `json:"event_id"`      // Motion event running at the time, empty if there is none
+}
+
+// LineCrossedEvent is sent when a tracked object crosses a line, Direction is in or out
+type LineCrossedEvent struct {
+	Header
+	Line       string  `json:"line"`
+	Direction  string  `json:"direction"`
+	TrackID    int     `json:"track_id"`
+	Class      string  `json:"class"`
+	Confidence float32 `json:"confidence"`
+	BBox       Box     `json:"bbox"`
+	EventID    string  `json:"event_id"` // Motion event running at the time, empty if there is none
+}
+
+// ObjectEvent is sent when a tracked object stayed put long enough to become static (object_arrived) and when a
+// static object moves again or wasn't seen for staticMaxAge (object_departed)
+type ObjectEvent struct {
+	Header
+	TrackID     int       `json:"track_id"`
+	Class       string    `json:"class"`
+	Confidence  float32   `json:"confidence"`
+	BBox        Box       `json:"bbox"`
+	StaticSince time.Time `json:"static_since"`
+	Static      float64   `json:"static_seconds"` // Time the object stayed put
+	EventID     string    `json:"event_id"`       // Motion event running at the time, empty if there is none
+}
+
+// ArmState is what the schedules and the control API arm on a camera
+type ArmState struct {
+	Detection     bool            `json:"detection"`
+	Recording     bool            `json:"recording"`
+	Notifications map[string]bool `json:"notifications"` // By sink
+	Override      string          `json:"override"`      // armed or disarmed through the control API, empty follows the schedules
+}
+
+// ScheduleChangedEvent is sent when a schedule arms or disarms part of a camera, and on startup for cameras that
+// use schedules
+type ScheduleChangedEvent struct {
+	Header
+	Armed   ArmState `json:"armed"`
+	Changed []string `json:"changed"` // What was armed or disarmed, eg: detection or notifications.mqtt. Empty on startup
+}
@@ -0,0 +1,202 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSchemaMatchesTypes checks that every JSON key of the event types is in the schema and required, and that
+// the schema lists nothing the types don't have
+func TestSchemaMatchesTypes(t *testing.T) {
+	var schema struct {
+		Defs map[string]struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+			Required   []string                   `json:"required"`
+		} `json:"$defs"`
+	}
+	if err := json.Unmarshal(Schema, &schema); err != nil {
+		t.Fatalf("Schema is not valid JSON: %v", err)
+	}
+
+	types := map[string]any{
+		"box":                  Box{},
+		"object":               Object{},
+		"motion":               MotionEvent{},
+		"motion_end":           MotionEndEvent{},
+		"inference":            InferenceEvent{},
+		"error":                ErrorEvent{},
+		"analysis_fps_changed": AnalysisFpsChangedEvent{},
+		"config_reloaded":      ConfigReloadedEvent{},
+		"zone":                 ZoneEvent{},
+		"line_crossed":         LineCrossedEvent{},
+		"object_event":         ObjectEvent{},
+		"arm_state":            ArmState{},
+		"schedule_changed":     ScheduleChangedEvent{},
+	}
+	for name, value := range types {
+		data, _ := json.Marshal(value)
+		var fields map[string]any
+		json.Unmarshal(data, &fields)
+		keys := make([]string, 0, len(fields))
+		for key := range fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		def, ok := schema.Defs[name]
+		if !ok {
+			t.Errorf("%s is missing in the schema", name)
+			continue
+		}
+		properties := make([]string, 0, len(def.Properties))
+		for key := range def.Properties {
+			properties = append(properties, key)
+		}
+		sort.Strings(properties)
+		required := slices.Clone(def.Required)
+		sort.Strings(required)
+
+		if !slices.Equal(keys, properties) {
+			t.Errorf("%s: expected the properties %v, the schema has %v", name, keys, properties)
+		}
+		if !slices.Equal(keys, required) {
+			t.Errorf("%s: expected %v to be required, the schema requires %v", name, keys, required)
+		}
+	}
+}
+
+func TestHeaderHasCurrentVersion(t *testing.T) {
+	data, _ := json.Marshal(MotionEvent{Header: NewHeader(TypeMotionStart, "front", time.Now())})
+	var event map[string]any
+	json.Unmarshal(data, &event)
+	if event["schema_version"] != float64(Version) || event["type"] != "motion_start" || event["camera_name"] != "front" {
+		t.Errorf("Unexpected header %s", data)
+	}
+}
+
+// validate checks value against the parts of JSON Schema that schema.json uses
+func validate(schema map[string]any, defs map[string]any, value any) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		return validate(defs[strings.TrimPrefix(ref, "#/$defs/")].(map[string]any), defs, value)
+	}
+	if oneOf, ok := schema["oneOf"].([]any); ok {
+		matches := 0
+		for _, option := range oneOf {
+			if validate(option.(map[string]any), defs, value) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("matches %d of oneOf", matches)
+		}
+		return nil
+	}
+	if expected, ok := schema["const"]; ok && fmt.Sprint(expected) != fmt.Sprint(value) {
+		return fmt.Errorf("expected %v, got %v", expected, value)
+	}
+	if enum, ok := schema["enum"].([]any); ok && !slices.Contains(enum, value) {
+		return fmt.Errorf("%v is not one of %v", value, enum)
+	}
+	if minimum, ok := schema["minimum"].(float64); ok {
+		if number, ok := value.(float64); ok && number < minimum {
+			return fmt.Errorf("%v is below %v", number, minimum)
+		}
+	}
+
+	if kind, ok := schema["type"].(string); ok {
+		valid := map[string]bool{
+			"object":  fmt.Sprintf("%T", value) == "map[string]interface {}",
+			"array":   fmt.Sprintf("%T", value) == "[]interface {}",
+			"string":  fmt.Sprintf("%T", value) == "string",
+			"boolean": fmt.Sprintf("%T", value) == "bool",
+			"number":  fmt.Sprintf("%T", value) == "float64",
+		}
+		if number, ok := value.(float64); ok {
+			valid["integer"] = number == float64(int64(number))
+		}
+		if !valid[kind] {
+			return fmt.Errorf("expected %s, got %v", kind, value)
+		}
+	}
+
+	switch value := value.(type) {
+	case map[string]any:
+		required, _ := schema["required"].([]any)
+		for _, key := range required {
+			if _, ok := value[key.(string)]; !ok {
+				return fmt.Errorf("%s is missing", key)
+			}
+		}
+		properties, _ := schema["properties"].(map[string]any)
+		for key, field := range value {
+			property, ok := properties[key].(map[string]any)
+			if !ok {
+				property, ok = schema["additionalProperties"].(map[string]any)
+			}
+			if !ok {
+				continue
+			}
+			if err := validate(property, defs, field); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+		}
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range value {
+				if err := validate(items, defs, item); err != nil {
+					return fmt.Errorf("[%d]: %w", i, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// TestEventsMatchSchema validates an event of every type against the schema
+func TestEventsMatchSchema(t *testing.T) {
+	var schema map[string]any
+	if err := json.Unmarshal(Schema, &schema); err != nil {
+		t.Fatalf("Schema is not valid JSON: %v", err)
+	}
+	defs := schema["$defs"].(map[string]any)
+
+	now := time.Now()
+	box := NewBox(image.Rect(10, 20, 110, 220))
+	objects := []Object{{TrackID: 1, Class: "person", Confidence: 0.9, BBox: box, Area: 20000, Zones: []string{"yard"}}}
+	samples := []any{
+		MotionEvent{Header: NewHeader(TypeMotionStart, "front", now), ID: "abc", MotionStart: now, MotionTriggeredLast: now, Objects: objects, MotionRegions: []Box{box}},
+		MotionEvent{Header: NewHeader(TypeMotionUpdate, "front", now), ID: "abc", Objects: []Object{}, MotionRegions: []Box{}},
+		MotionEndEvent{Header: NewHeader(TypeMotionEnd, "front", now), ID: "abc", Duration: 12.5, Recorded: true, ClipPath: "clip_abc.mp4", Snapshots: []string{}, Objects: objects, Classes: map[string]ClassSummary{"person": {Count: 1, MaxConfidence: 0.9}}},
+		InferenceEvent{Header: NewHeader(TypeInference, "front", now), InferenceAvg: 30.5, Ceiling: 200, Dropped: 3},
+		ErrorEvent{Header: NewHeader(TypeError, "front", now), Source: "feed", Message: "EOF"},
+		AnalysisFpsChangedEvent{Header: NewHeader(TypeAnalysisFps, "front", now), OldFps: 5, NewFps: 2.5, TargetFps: 5, Reason: "slow"},
+		ConfigReloadedEvent{Header: NewHeader(TypeConfigReloaded, "", now), Changed: []string{"motion.eventGap"}, Restarted: []string{}, Added: []string{"back"}, Removed: []string{}, RestartRequired: []string{}},
+		ZoneEvent{Header: NewHeader(TypeZoneDwell, "front", now), Zone: "yard", TrackID: 1, Class: "person", BBox: box, EnteredAt: now, Dwell: 30},
+		LineCrossedEvent{Header: NewHeader(TypeLineCrossed, "front", now), Line: "gate", Direction: "in", TrackID: 1, Class: "car", BBox: box},
+		ObjectEvent{Header: NewHeader(TypeObjectArrived, "front", now), TrackID: 2, Class: "car", BBox: box, StaticSince: now, Static: 60},
+		ScheduleChangedEvent{Header: NewHeader(TypeScheduleChanged, "front", now), Armed: ArmState{Detection: true, Notifications: map[string]bool{"mqtt": false}}, Changed: []string{}},
+	}
+	for _, sample := range samples {
+		data, _ := json.Marshal(sample)
+		var value any
+		json.Unmarshal(data, &value)
+		if err := validate(schema, defs, value); err != nil {
+			t.Errorf("%T does not match the schema: %v\n%s", sample, err, data)
+		}
+	}
+
+	// A bbox in the shape of image.Rectangle is rejected
+	var zone map[string]any
+	data, _ := json.Marshal(samples[7])
+	json.Unmarshal(data, &zone)
+	zone["bbox"] = map[string]any{"Min": map[string]any{"X": 1, "Y": 2}, "Max": map[string]any{"X": 3, "Y": 4}}
+	if err := validate(schema, defs, zone); err == nil {
+		t.Error("Expected a bbox without left, top, right and bottom to be rejected")
+	}
+}
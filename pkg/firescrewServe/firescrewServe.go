@@ -15,6 +15,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/8ff/firescrew/pkg/counters"
 	"github.com/tj/go-naturaldate"
 )
 
@@ -79,7 +80,8 @@ func loadData(folder string) ([]FileData, error) {
 			return err
 		}
 
-		if !info.IsDir() && filepath.Ext(path) == ".json" {
+		// Only event metadata, other JSON files like the counters live in the same folder
+		if !info.IsDir() && strings.HasPrefix(info.Name(), "meta_") && filepath.Ext(path) == ".json" {
 			file, err := os.Open(path)
 			if err != nil {
 				return err
@@ -130,6 +132,33 @@ func loadData(folder string) ([]FileData, error) {
 	return data, nil
 }
 
+// loadCounters merges the line crossing counters of every counters file in folder, cameras with their own
+// hiResPath keep them in sub folders
+func loadCounters(folder string) ([]counters.Counter, error) {
+	var data []counters.Counter
+
+	err := filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() && info.Name() == counters.FileName {
+			fileCounters, err := counters.Load(path)
+			if err != nil {
+				return err
+			}
+			data = append(data, fileCounters...)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
 func ParseDateRangePrompt(prompt string) (time.Time, time.Time, error) {
 	// Regular expression to match "from ... to ..." or "between ... and ..."
 	re := regexp.MustCompile(`(?i)(from|between)\s+(.*?)\s+(to|and)\s+(.*)`)
@@ -311,6 +340,36 @@ func promptHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(ret)
 }
 
+// countersHandler returns the line crossing counters with their hourly and daily buckets, the camera, line,
+// class and direction parameters filter them
+func countersHandler(w http.ResponseWriter, r *http.Request) {
+	type retObj struct {
+		Success  bool               `json:"success"`
+		Error    string             `json:"error"`
+		Counters []counters.Counter `json:"counters"`
+	}
+
+	data, err := loadCounters(mediaPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	filteredData := []counters.Counter{}
+	for _, counter := range data {
+		if (query.Get("camera") == "" || counter.Camera == query.Get("camera")) &&
+			(query.Get("line") == "" || counter.Line == query.Get("line")) &&
+			(query.Get("class") == "" || counter.Class == query.Get("class")) &&
+			(query.Get("direction") == "" || counter.Direction == query.Get("direction")) {
+			filteredData = append(filteredData, counter)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(retObj{Success: true, Counters: filteredData})
+}
+
 func singular(word string) string {
 	irregularPlurals := map[string]string{
 		"people": "person",
@@ -490,6 +549,7 @@ func Serve(path string, addr string) error {
 
 	// Serve API
 	http.HandleFunc("/api", promptHandler)
+	http.HandleFunc("/api/counters", countersHandler)
 
 	Log("info", fmt.Sprintf("Serving files from %s at %s", mediaPath, addr))
 
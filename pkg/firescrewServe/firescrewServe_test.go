@@ -1,8 +1,14 @@
 package firescrewServe
 
 import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
+
+	"github.com/8ff/firescrew/pkg/counters"
 )
 
 func TestParseDateRangePrompt(t *testing.T) {
@@ -64,3 +70,39 @@ func TestParseDateRangePrompt(t *testing.T) {
 		}
 	}
 }
+
+func TestCountersHandler(t *testing.T) {
+	folder := t.TempDir()
+	os.MkdirAll(filepath.Join(folder, "front"), 0755)
+	os.WriteFile(filepath.Join(folder, "meta_abc.json"), []byte(`{"ID": "abc", "MotionStart": "2023-08-14T20:30:00Z"}`), 0644)
+
+	now := time.Date(2023, 8, 14, 20, 30, 0, 0, time.Local)
+	for _, dir := range []string{folder, filepath.Join(folder, "front")} {
+		store, err := counters.Open(filepath.Join(dir, counters.FileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		store.Add(filepath.Base(dir), "gate", "car", "in", now)
+		store.Add(filepath.Base(dir), "gate", "person", "out", now)
+	}
+	mediaPath = folder + "/"
+
+	// The counters files must not be mistaken for event metadata
+	data, err := loadData(mediaPath)
+	if err != nil || len(data) != 1 {
+		t.Fatalf("Expected the one metadata file, got %v, %v", data, err)
+	}
+
+	recorder := httptest.NewRecorder()
+	countersHandler(recorder, httptest.NewRequest("GET", "/api/counters?camera=front&class=car", nil))
+	var ret struct {
+		Success  bool
+		Counters []counters.Counter
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&ret); err != nil {
+		t.Fatal(err)
+	}
+	if !ret.Success || len(ret.Counters) != 1 || ret.Counters[0].Camera != "front" || ret.Counters[0].Hourly["2023-08-14T20"] != 1 {
+		t.Errorf("Unexpected counters: %+v", ret)
+	}
+}
@@ -0,0 +1,98 @@
+// Package frameQueue is a bounded latest-wins queue between a producer that must never block (a camera feed)
+// and a consumer that may be slow (detection). When the queue is full the oldest item is dropped.
+package frameQueue
+
+import "sync"
+
+type Queue[T any] struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	items   []T // Ring buffer
+	head    int
+	count   int
+	dropped uint64
+	closed  bool
+	onDrop  func(T)
+}
+
+// New creates a queue holding at most size items, onDrop (optional) is called with every item pushed out
+func New[T any](size int, onDrop func(T)) *Queue[T] {
+	if size < 1 {
+		size = 1
+	}
+	q := &Queue[T]{items: make([]T, size), onDrop: onDrop}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+// Push adds an item without blocking, dropping the oldest one if the queue is full
+func (q *Queue[T]) Push(item T) {
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		if q.onDrop != nil {
+			q.onDrop(item)
+		}
+		return
+	}
+
+	var dropped T
+	isDropped := false
+	if q.count == len(q.items) {
+		dropped = q.items[q.head]
+		isDropped = true
+		q.head = (q.head + 1) % len(q.items)
+		q.count--
+		q.dropped++
+	}
+
+	q.items[(q.head+q.count)%len(q.items)] = item
+	q.count++
+	q.mutex.Unlock()
+	q.cond.Signal()
+
+	if isDropped && q.onDrop != nil {
+		q.onDrop(dropped)
+	}
+}
+
+// Pop blocks until an item is available, ok is false once the queue is closed and empty
+func (q *Queue[T]) Pop() (item T, ok bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for q.count == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.count == 0 {
+		return item, false
+	}
+
+	var zero T
+	item = q.items[q.head]
+	q.items[q.head] = zero
+	q.head = (q.head + 1) % len(q.items)
+	q.count--
+	return item, true
+}
+
+// Close wakes up waiting consumers, items already queued can still be popped
+func (q *Queue[T]) Close() {
+	q.mutex.Lock()
+	q.closed = true
+	q.mutex.Unlock()
+	q.cond.Broadcast()
+}
+
+// Dropped returns how many items were pushed out so far
+func (q *Queue[T]) Dropped() uint64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.dropped
+}
+
+func (q *Queue[T]) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.count
+}
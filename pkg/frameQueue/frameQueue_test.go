@@ -0,0 +1,61 @@
+package frameQueue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatestWins(t *testing.T) {
+	var dropped []int
+	q := New(3, func(item int) { dropped = append(dropped, item) })
+
+	for i := 1; i <= 5; i++ {
+		q.Push(i)
+	}
+
+	if q.Dropped() != 2 || len(dropped) != 2 || dropped[0] != 1 || dropped[1] != 2 {
+		t.Errorf("Expected 1 and 2 to be dropped, got %v (count %d)", dropped, q.Dropped())
+	}
+
+	for _, expected := range []int{3, 4, 5} {
+		item, ok := q.Pop()
+		if !ok || item != expected {
+			t.Errorf("Expected %d, got %d (%v)", expected, item, ok)
+		}
+	}
+	if q.Len() != 0 {
+		t.Errorf("Expected an empty queue, got %d items", q.Len())
+	}
+}
+
+func TestPopBlocksUntilPushOrClose(t *testing.T) {
+	q := New[int](1, nil)
+
+	result := make(chan int)
+	go func() {
+		item, _ := q.Pop()
+		result <- item
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	q.Push(42)
+	if item := <-result; item != 42 {
+		t.Errorf("Expected 42, got %d", item)
+	}
+
+	closed := make(chan bool)
+	go func() {
+		_, ok := q.Pop()
+		closed <- ok
+	}()
+
+	q.Close()
+	select {
+	case ok := <-closed:
+		if ok {
+			t.Error("Expected Pop to report a closed queue")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Pop didn't return after Close")
+	}
+}
@@ -0,0 +1,270 @@
+// Package motion finds moving areas in camera frames.
+// Frames are downscaled to a small grayscale image, blurred and compared against a running average of the
+// previous frames, so noise and slow lighting changes end up in the background while anything that moves shows
+// up, slow movers included. Changed pixels are cleaned up with a morphological opening, which removes specks
+// like rain and IR noise, and a closing, which joins the parts of one object. Connected components of what is
+// left are the motion regions.
+package motion
+
+import (
+	"image"
+)
+
+type Config struct {
+	Sensitivity  float64 // 0 to 1, higher reacts to smaller brightness changes. Default 0.5
+	Width        int     // Width frames are downscaled to, the height keeps the aspect ratio. Default 160
+	LearningRate float64 // Share of each frame blended into the background. Default 0.05
+}
+
+// Region is a connected moving area
+type Region struct {
+	Box  image.Rectangle // In frame pixels
+	Area int             // Changed frame pixels inside Box
+}
+
+// Detector keeps the background model of a single feed, it is not safe for concurrent use
+type Detector struct {
+	config    Config
+	threshold float32
+
+	frameBounds   image.Rectangle
+	width, height int
+	gray          []float32 // Current frame, downscaled
+	blurred       []float32
+	background    []float32
+	mask, scratch []bool
+	labels        []int
+	queue         []int
+}
+
+// Above this share of changed pixels the whole scene changed, eg: lights turned on or the camera switched to IR
+const sceneChangeShare = 0.5
+
+func New(config Config) *Detector {
+	if config.Width <= 0 {
+		config.Width = 160
+	}
+	if config.LearningRate <= 0 || config.LearningRate > 1 {
+		config.LearningRate = 0.05
+	}
+	d := &Detector{config: config}
+	d.SetSensitivity(config.Sensitivity)
+	return d
+}
+
+// SetSensitivity changes the sensitivity, the background model is kept
+func (d *Detector) SetSensitivity(sensitivity float64) {
+	if sensitivity <= 0 || sensitivity > 1 {
+		sensitivity = 0.5
+	}
+	d.config.Sensitivity = sensitivity
+	// Brightness difference a pixel needs to count as changed, 0.5 gives 30 out of 255
+	d.threshold = float32(5 + (1-sensitivity)*50)
+}
+
+// Reset drops the background model, the next frame starts a new one
+func (d *Detector) Reset() {
+	d.background = nil
+}
+
+// Detect adds frame to the background model and returns the regions that moved compared to it. The first frame,
+// or the first after the frame size changed, only starts the model and returns nothing.
+func (d *Detector) Detect(frame *image.RGBA) []Region {
+	bounds := frame.Bounds()
+	if bounds.Empty() {
+		return nil
+	}
+	if bounds != d.frameBounds {
+		d.resize(bounds)
+	}
+
+	d.downscale(frame)
+	d.blur()
+
+	if d.background == nil {
+		d.background = make([]float32, len(d.blurred))
+		copy(d.background, d.blurred)
+		return nil
+	}
+
+	changed := 0
+	for i, value := range d.blurred {
+		diff := value - d.background[i]
+		if diff < 0 {
+			diff = -diff
+		}
+		d.mask[i] = diff > d.threshold
+		if d.mask[i] {
+			changed++
+		}
+	}
+
+	if float64(changed) > sceneChangeShare*float64(len(d.mask)) {
+		copy(d.background, d.blurred)
+		return nil
+	}
+
+	// Moving pixels are learned slowly, an object that stops becomes background eventually
+	rate := float32(d.config.LearningRate)
+	for i, value := range d.blurred {
+		if d.mask[i] {
+			d.background[i] += rate / 10 * (value - d.background[i])
+		} else {
+			d.background[i] += rate * (value - d.background[i])
+		}
+	}
+
+	// Opening, then closing
+	d.erode()
+	d.dilate()
+	d.dilate()
+	d.erode()
+
+	return d.regions()
+}
+
+// TotalArea sums the area of regions
+func TotalArea(regions []Region) int {
+	total := 0
+	for _, region := range regions {
+		total += region.Area
+	}
+	return total
+}
+
+func (d *Detector) resize(bounds image.Rectangle) {
+	d.frameBounds = bounds
+	d.width = min(d.config.Width, bounds.Dx())
+	d.height = max(1, bounds.Dy()*d.width/bounds.Dx())
+
+	size := d.width * d.height
+	d.gray = make([]float32, size)
+	d.blurred = make([]float32, size)
+	d.mask = make([]bool, size)
+	d.scratch = make([]bool, size)
+	d.labels = make([]int, size)
+	d.background = nil
+}
+
+// downscale averages the luma of the frame pixels covered by each model pixel
+func (d *Detector) downscale(frame *image.RGBA) {
+	counts := make([]int32, len(d.gray))
+	for i := range d.gray {
+		d.gray[i] = 0
+	}
+
+	bounds := frame.Bounds()
+	frameWidth, frameHeight := bounds.Dx(), bounds.Dy()
+	for y := 0; y < frameHeight; y++ {
+		row := y * d.height / frameHeight * d.width
+		offset := frame.PixOffset(bounds.Min.X, bounds.Min.Y+y)
+		for x := 0; x < frameWidth; x++ {
+			pix := frame.Pix[offset+x*4 : offset+x*4+3]
+			i := row + x*d.width/frameWidth
+			d.gray[i] += float32(299*int(pix[0])+587*int(pix[1])+114*int(pix[2])) / 1000
+			counts[i]++
+		}
+	}
+
+	for i, count := range counts {
+		if count > 0 {
+			d.gray[i] /= float32(count)
+		}
+	}
+}
+
+// blur is a 3x3 box blur, edge pixels average what is inside the image
+func (d *Detector) blur() {
+	for y := 0; y < d.height; y++ {
+		for x := 0; x < d.width; x++ {
+			var sum float32
+			count := 0
+			for ny := max(0, y-1); ny <= min(d.height-1, y+1); ny++ {
+				for nx := max(0, x-1); nx <= min(d.width-1, x+1); nx++ {
+					sum += d.gray[ny*d.width+nx]
+					count++
+				}
+			}
+			d.blurred[y*d.width+x] = sum / float32(count)
+		}
+	}
+}
+
+// erode keeps pixels whose 3x3 neighbourhood is set completely
+func (d *Detector) erode() {
+	d.morph(true)
+}
+
+// dilate sets pixels with any set pixel in their 3x3 neighbourhood
+func (d *Detector) dilate() {
+	d.morph(false)
+}
+
+func (d *Detector) morph(erode bool) {
+	for y := 0; y < d.height; y++ {
+		for x := 0; x < d.width; x++ {
+			result := erode
+			for ny := max(0, y-1); ny <= min(d.height-1, y+1) && result == erode; ny++ {
+				for nx := max(0, x-1); nx <= min(d.width-1, x+1); nx++ {
+					if d.mask[ny*d.width+nx] != erode {
+						result = !erode
+						break
+					}
+				}
+			}
+			d.scratch[y*d.width+x] = result
+		}
+	}
+	d.mask, d.scratch = d.scratch, d.mask
+}
+
+// regions labels the 8-connected components of the mask and scales their boxes to frame pixels
+func (d *Detector) regions() []Region {
+	for i := range d.labels {
+		d.labels[i] = 0
+	}
+
+	frameWidth, frameHeight := d.frameBounds.Dx(), d.frameBounds.Dy()
+	pixelArea := float64(frameWidth*frameHeight) / float64(d.width*d.height)
+
+	var regions []Region
+	for start, set := range d.mask {
+		if !set || d.labels[start] != 0 {
+			continue
+		}
+
+		label := len(regions) + 1
+		box := image.Rect(start%d.width, start/d.width, start%d.width+1, start/d.width+1)
+		count := 0
+		d.labels[start] = label
+		d.queue = append(d.queue[:0], start)
+		for len(d.queue) > 0 {
+			i := d.queue[len(d.queue)-1]
+			d.queue = d.queue[:len(d.queue)-1]
+			x, y := i%d.width, i/d.width
+			count++
+			box = box.Union(image.Rect(x, y, x+1, y+1))
+
+			for ny := max(0, y-1); ny <= min(d.height-1, y+1); ny++ {
+				for nx := max(0, x-1); nx <= min(d.width-1, x+1); nx++ {
+					n := ny*d.width + nx
+					if d.mask[n] && d.labels[n] == 0 {
+						d.labels[n] = label
+						d.queue = append(d.queue, n)
+					}
+				}
+			}
+		}
+
+		regions = append(regions, Region{
+			Box: image.Rect(
+				d.frameBounds.Min.X+box.Min.X*frameWidth/d.width,
+				d.frameBounds.Min.Y+box.Min.Y*frameHeight/d.height,
+				d.frameBounds.Min.X+box.Max.X*frameWidth/d.width,
+				d.frameBounds.Min.Y+box.Max.Y*frameHeight/d.height,
+			),
+			Area: int(float64(count) * pixelArea),
+		})
+	}
+	return regions
+}
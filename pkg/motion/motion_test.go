@@ -0,0 +1,70 @@
+package motion
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+	"testing"
+)
+
+func frame(background uint8, square image.Rectangle) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 320, 240))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.Gray{background}}, image.Point{}, draw.Src)
+	draw.Draw(img, square, &image.Uniform{color.White}, image.Point{}, draw.Src)
+	return img
+}
+
+func TestMovingObjectIsOneRegion(t *testing.T) {
+	d := New(Config{})
+	if regions := d.Detect(frame(50, image.Rectangle{})); regions != nil {
+		t.Fatalf("The first frame only starts the model, got %v", regions)
+	}
+
+	// A person sized object walking in slowly, a few pixels per frame
+	var regions []Region
+	for x := 100; x < 130; x += 3 {
+		regions = d.Detect(frame(50, image.Rect(x, 80, x+30, 180)))
+	}
+	if len(regions) != 1 {
+		t.Fatalf("Expected one region, got %v", regions)
+	}
+	if !regions[0].Box.Overlaps(image.Rect(127, 80, 157, 180)) || regions[0].Area < 1000 {
+		t.Errorf("Region doesn't cover the object: %v", regions[0])
+	}
+}
+
+func TestNoiseIsIgnored(t *testing.T) {
+	d := New(Config{})
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 10; i++ {
+		img := frame(50, image.Rectangle{})
+		// Single pixel speckles like rain or IR noise
+		for j := 0; j < 300; j++ {
+			img.Set(random.Intn(320), random.Intn(240), color.White)
+		}
+		if regions := d.Detect(img); len(regions) != 0 {
+			t.Fatalf("Frame %d: expected no regions, got %v", i, regions)
+		}
+	}
+}
+
+func TestSceneChangeResetsBackground(t *testing.T) {
+	d := New(Config{})
+	d.Detect(frame(20, image.Rectangle{}))
+	if regions := d.Detect(frame(200, image.Rectangle{})); len(regions) != 0 {
+		t.Fatalf("Lights turning on must not be motion, got %v", regions)
+	}
+	if regions := d.Detect(frame(200, image.Rect(10, 10, 60, 60))); len(regions) != 1 {
+		t.Errorf("Expected motion on the new background, got %v", regions)
+	}
+}
+
+func TestFrameSizeChange(t *testing.T) {
+	d := New(Config{})
+	d.Detect(frame(50, image.Rectangle{}))
+	small := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	if regions := d.Detect(small); regions != nil {
+		t.Errorf("A new frame size starts a new model, got %v", regions)
+	}
+}
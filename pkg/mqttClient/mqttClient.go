@@ -0,0 +1,307 @@
+// Package mqttClient keeps one MQTT connection open for a whole process. It reconnects on its own, queues
+// messages while the broker is away and announces whether the process is alive on an availability topic, with
+// a birth message on every connect and a last will the broker publishes when the connection drops.
+package mqttClient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	Online  = "online"
+	Offline = "offline"
+)
+
+var publishTimeout = 30 * time.Second // How long a publish may take before it counts as failed
+var closeTimeout = time.Second        // How long Close waits for the offline message
+
+type TLSConfig struct {
+	CaFile             string // PEM file of the CA that signed the broker certificate, empty uses the system roots
+	CertFile           string // PEM client certificate, for brokers that require one
+	KeyFile            string
+	InsecureSkipVerify bool // Accept any broker certificate
+}
+
+type Config struct {
+	Broker            string // tcp://, ssl://, ws:// or wss:// URL, eg: ssl://broker:8883
+	ClientID          string // Empty lets the broker pick one
+	User              string
+	Pass              string
+	TLS               *TLSConfig // Used for ssl:// and wss://, nil verifies the broker with the system roots
+	AvailabilityTopic string     // Gets online on every connect and offline when the process goes away, retained. Empty disables it
+	QueueSize         int        // Messages kept while disconnected, the oldest are dropped when it is full. Default 1000
+
+	OnConnect        func()          // After every connect, once the queued messages were handed to the broker
+	OnConnectionLost func(err error) // The client reconnects on its own
+	OnError          func(err error) // A publish or subscribe failed
+}
+
+type message struct {
+	topic   string
+	payload []byte
+	qos     byte
+	retain  bool
+}
+
+type subscription struct {
+	qos     byte
+	handler func(topic string, payload []byte)
+}
+
+type Client struct {
+	config Config
+	client mqtt.Client
+
+	mutex         sync.Mutex
+	connected     bool
+	closed        bool
+	queue         []message
+	dropped       uint64
+	subscriptions map[string]subscription
+}
+
+// New checks config and prepares the client, Connect opens the connection. Messages published before are queued.
+func New(config Config) (*Client, error) {
+	u, err := url.Parse(config.Broker)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid broker URL %q", config.Broker)
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 1000
+	}
+
+	c := &Client{config: config, subscriptions: make(map[string]subscription)}
+	opts := mqtt.NewClientOptions().AddBroker(config.Broker)
+	opts.SetClientID(config.ClientID)
+	if config.User != "" {
+		opts.SetUsername(config.User)
+		opts.SetPassword(config.Pass)
+	}
+	if u.Scheme == "ssl" || u.Scheme == "tls" || u.Scheme == "mqtts" || u.Scheme == "wss" {
+		tlsConfig, err := newTLSConfig(config.TLS)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	if config.AvailabilityTopic != "" {
+		opts.SetWill(config.AvailabilityTopic, Offline, 1, true)
+	}
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetMaxReconnectInterval(time.Minute)
+	opts.SetOrderMatters(false) // Handlers may block, eg: a command waiting for a camera
+	opts.SetOnConnectHandler(func(mqtt.Client) { c.onConnect() })
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		c.mutex.Lock()
+		c.connected = false
+		c.mutex.Unlock()
+		if config.OnConnectionLost != nil {
+			config.OnConnectionLost(err)
+		}
+	})
+	c.client = mqtt.NewClient(opts)
+	return c, nil
+}
+
+func newTLSConfig(config *TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if config == nil {
+		return tlsConfig, nil
+	}
+	tlsConfig.InsecureSkipVerify = config.InsecureSkipVerify
+	if config.CaFile != "" {
+		pem, err := os.ReadFile(config.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CaFile)
+		}
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Connect connects in the background and keeps retrying until Close
+func (c *Client) Connect() {
+	c.client.Connect()
+}
+
+// onConnect announces the client, restores the subscriptions and sends what was queued meanwhile
+func (c *Client) onConnect() {
+	c.mutex.Lock()
+	if c.config.AvailabilityTopic != "" {
+		c.publish(message{topic: c.config.AvailabilityTopic, payload: []byte(Online), qos: 1, retain: true})
+	}
+	for topic, sub := range c.subscriptions {
+		c.subscribe(topic, sub)
+	}
+	for _, msg := range c.queue {
+		c.publish(msg)
+	}
+	c.queue = nil
+	c.connected = true
+	c.mutex.Unlock()
+
+	if c.config.OnConnect != nil {
+		c.config.OnConnect()
+	}
+}
+
+// Publish sends a message, or queues it while the client is disconnected
+func (c *Client) Publish(topic string, payload []byte, qos byte, retain bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	msg := message{topic: topic, payload: payload, qos: qos, retain: retain}
+	if c.connected {
+		c.publish(msg)
+	} else {
+		c.enqueue(msg)
+	}
+}
+
+func (c *Client) enqueue(msg message) {
+	if c.closed {
+		return
+	}
+	if len(c.queue) >= c.config.QueueSize {
+		c.queue = c.queue[1:]
+		c.dropped++
+	}
+	c.queue = append(c.queue, msg)
+}
+
+// PublishWait sends a message and waits until the broker took it, for QoS 1 and 2 until it acknowledged it.
+// Unlike Publish it doesn't queue, a message that didn't make it is an error for the caller to retry.
+// A timeout of 0 waits as long as Publish does.
+func (c *Client) PublishWait(topic string, payload []byte, qos byte, retain bool, timeout time.Duration) error {
+	c.mutex.Lock()
+	if !c.connected {
+		c.mutex.Unlock()
+		return errors.New("not connected to the broker")
+	}
+	token := c.client.Publish(topic, qos, retain, payload)
+	c.mutex.Unlock()
+
+	if timeout <= 0 {
+		timeout = publishTimeout
+	}
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("publishing to %s timed out", topic)
+	}
+	if token.Error() != nil {
+		return fmt.Errorf("publishing to %s: %w", topic, token.Error())
+	}
+	return nil
+}
+
+// publish hands msg to paho, a message the connection lost before it went out is queued again
+func (c *Client) publish(msg message) {
+	token := c.client.Publish(msg.topic, msg.qos, msg.retain, msg.payload)
+	go func() {
+		if !token.WaitTimeout(publishTimeout) {
+			c.reportError(fmt.Errorf("publishing to %s timed out", msg.topic))
+			return
+		}
+		if errors.Is(token.Error(), mqtt.ErrNotConnected) {
+			c.mutex.Lock()
+			c.enqueue(msg)
+			c.mutex.Unlock()
+			return
+		}
+		if token.Error() != nil {
+			c.reportError(fmt.Errorf("publishing to %s: %w", msg.topic, token.Error()))
+		}
+	}()
+}
+
+// Subscribe calls handler for every message on topic, the subscription is restored after reconnects.
+// Handlers run concurrently.
+func (c *Client) Subscribe(topic string, qos byte, handler func(topic string, payload []byte)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	sub := subscription{qos: qos, handler: handler}
+	c.subscriptions[topic] = sub
+	if c.connected {
+		c.subscribe(topic, sub)
+	}
+}
+
+// Unsubscribe stops the handler of topic
+func (c *Client) Unsubscribe(topic string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.subscriptions, topic)
+	if c.connected {
+		c.client.Unsubscribe(topic)
+	}
+}
+
+func (c *Client) subscribe(topic string, sub subscription) {
+	token := c.client.Subscribe(topic, sub.qos, func(_ mqtt.Client, msg mqtt.Message) {
+		sub.handler(msg.Topic(), msg.Payload())
+	})
+	go func() {
+		if token.WaitTimeout(publishTimeout) && token.Error() != nil {
+			c.reportError(fmt.Errorf("subscribing to %s: %w", topic, token.Error()))
+		}
+	}()
+}
+
+func (c *Client) reportError(err error) {
+	if c.config.OnError != nil {
+		c.config.OnError(err)
+	}
+}
+
+// Connected reports if the client is connected to the broker right now
+func (c *Client) Connected() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.connected
+}
+
+// Queued returns how many messages wait for the broker, Dropped how many were dropped from the full queue
+func (c *Client) Queued() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.queue)
+}
+
+func (c *Client) Dropped() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.dropped
+}
+
+// Close announces that the client goes offline and disconnects, queued messages are dropped
+func (c *Client) Close() {
+	c.mutex.Lock()
+	connected := c.connected
+	c.connected = false
+	c.closed = true
+	c.queue = nil
+	c.mutex.Unlock()
+
+	if connected && c.config.AvailabilityTopic != "" {
+		c.client.Publish(c.config.AvailabilityTopic, 1, true, Offline).WaitTimeout(closeTimeout)
+	}
+	c.client.Disconnect(250)
+}
@@ -0,0 +1,199 @@
+package mqttClient
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// fakeBroker accepts MQTT connections and reports what clients send
+type fakeBroker struct {
+	listener   net.Listener
+	connects   chan *packets.ConnectPacket
+	publishes  chan *packets.PublishPacket
+	subscribes chan string
+	conns      chan net.Conn
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{
+		listener:   listener,
+		connects:   make(chan *packets.ConnectPacket, 10),
+		publishes:  make(chan *packets.PublishPacket, 100),
+		subscribes: make(chan string, 10),
+		conns:      make(chan net.Conn, 10),
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			b.conns <- conn
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := packet.(type) {
+		case *packets.ConnectPacket:
+			b.connects <- p
+			packets.NewControlPacket(packets.Connack).Write(conn)
+		case *packets.PublishPacket:
+			b.publishes <- p
+			if p.Qos == 1 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				ack.Write(conn)
+			}
+		case *packets.SubscribePacket:
+			b.subscribes <- p.Topics[0]
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+			ack.ReturnCodes = p.Qoss
+			ack.Write(conn)
+		case *packets.PingreqPacket:
+			packets.NewControlPacket(packets.Pingresp).Write(conn)
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+func (b *fakeBroker) expectPublish(t *testing.T, topic, payload string, retain bool) {
+	t.Helper()
+	select {
+	case p := <-b.publishes:
+		if p.TopicName != topic || string(p.Payload) != payload || p.Retain != retain {
+			t.Fatalf("expected %s=%s (retain %t), got %s=%s (retain %t)", topic, payload, retain, p.TopicName, p.Payload, p.Retain)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s=%s was not published", topic, payload)
+	}
+}
+
+func TestQueueIsFlushedAfterBirth(t *testing.T) {
+	broker := newFakeBroker(t)
+	c, err := New(Config{Broker: "tcp://" + broker.listener.Addr().String(), ClientID: "test", AvailabilityTopic: "fs/availability", QueueSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Published before the connection is up, the oldest doesn't fit the queue
+	c.Publish("fs/events", []byte("1"), 0, false)
+	c.Publish("fs/events", []byte("2"), 1, false)
+	c.Publish("fs/events", []byte("3"), 0, true)
+	if c.Queued() != 2 || c.Dropped() != 1 {
+		t.Fatalf("expected 2 queued and 1 dropped, got %d and %d", c.Queued(), c.Dropped())
+	}
+
+	c.Connect()
+	connect := <-broker.connects
+	if connect.ClientIdentifier != "test" || !connect.WillFlag || connect.WillTopic != "fs/availability" || string(connect.WillMessage) != Offline || !connect.WillRetain {
+		t.Fatalf("expected a retained offline last will, got %+v", connect)
+	}
+	broker.expectPublish(t, "fs/availability", Online, true)
+	broker.expectPublish(t, "fs/events", "2", false)
+	broker.expectPublish(t, "fs/events", "3", true)
+
+	c.Publish("fs/events", []byte("4"), 0, false)
+	broker.expectPublish(t, "fs/events", "4", false)
+
+	c.Close()
+	broker.expectPublish(t, "fs/availability", Offline, true)
+}
+
+func TestSubscriptionsSurviveReconnects(t *testing.T) {
+	broker := newFakeBroker(t)
+	c, err := New(Config{Broker: "tcp://" + broker.listener.Addr().String(), AvailabilityTopic: "fs/availability"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	received := make(chan string, 1)
+	c.Subscribe("fs/command", 1, func(topic string, payload []byte) {
+		received <- string(payload)
+	})
+	c.Connect()
+	conn := <-broker.conns
+	if topic := <-broker.subscribes; topic != "fs/command" {
+		t.Fatalf("expected a subscription to fs/command, got %s", topic)
+	}
+	broker.expectPublish(t, "fs/availability", Online, true)
+
+	msg := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	msg.TopicName = "fs/command"
+	msg.Payload = []byte("arm")
+	msg.Write(conn)
+	select {
+	case payload := <-received:
+		if payload != "arm" {
+			t.Fatalf("expected arm, got %s", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler was not called")
+	}
+
+	// The broker drops the connection, the client comes back and subscribes again
+	conn.Close()
+	<-broker.conns
+	if topic := <-broker.subscribes; topic != "fs/command" {
+		t.Fatalf("expected a subscription to fs/command after reconnecting, got %s", topic)
+	}
+	broker.expectPublish(t, "fs/availability", Online, true)
+	for i := 0; !c.Connected(); i++ {
+		if i == 100 {
+			t.Fatal("client did not reconnect")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestPublishWaitReportsTheBroker(t *testing.T) {
+	broker := newFakeBroker(t)
+	c, err := New(Config{Broker: "tcp://" + broker.listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.PublishWait("fs/events", []byte("1"), 1, false, time.Second); err == nil {
+		t.Fatal("expected an error before the client connected")
+	}
+	if c.Queued() != 0 {
+		t.Fatalf("expected nothing to be queued, got %d", c.Queued())
+	}
+
+	c.Connect()
+	for i := 0; !c.Connected(); i++ {
+		if i == 100 {
+			t.Fatal("client did not connect")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err := c.PublishWait("fs/events", []byte("2"), 1, false, 5*time.Second); err != nil {
+		t.Fatalf("expected the acknowledged publish to succeed, got %v", err)
+	}
+	broker.expectPublish(t, "fs/events", "2", false)
+
+	// The broker never completes QoS 2
+	if err := c.PublishWait("fs/events", []byte("3"), 2, false, 200*time.Millisecond); err == nil {
+		t.Fatal("expected the unacknowledged publish to time out")
+	}
+}
@@ -0,0 +1,323 @@
+// Package outbox delivers messages to one destination in the background, one at a time and in order. A failed
+// delivery is retried with exponential backoff until it succeeds or the message is too old. With a folder every
+// message is written there first and removed once delivered, so nothing is lost when the destination is down for
+// long or the process restarts.
+package outbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	Dir        string        // Messages wait here until they are delivered, empty keeps them in memory only
+	QueueSize  int           // Messages kept in memory, default 100. Without Dir the oldest are dropped, with Dir the rest wait on disk
+	MinBackoff time.Duration // Wait before the first retry, doubled after every failure. Default 1s
+	MaxBackoff time.Duration // Default 5m
+	MaxAge     time.Duration // Messages that couldn't be delivered in this time are dropped, 0 retries forever
+
+	Deliver func(message Message) error // Called by a single goroutine, an error retries the message
+	OnError func(err error)             // Reading or writing Dir failed, or a message was dropped
+}
+
+// Message is what the outbox stores and hands to Deliver
+type Message struct {
+	Type       string    `json:"type"`
+	CameraName string    `json:"camera_name"`
+	Payload    []byte    `json:"payload"`
+	Attachment []byte    `json:"attachment,omitempty"` // Stored and delivered with the payload, eg: an image
+	Created    time.Time `json:"created"`
+	Data       any       `json:"-"` // Only kept in memory, nil for messages loaded from Dir
+
+	file string // In Dir, empty if the message isn't stored
+}
+
+// Stats are the delivery counters of an outbox since it was created
+type Stats struct {
+	Queued        int       `json:"queued"`    // Waiting for delivery, in memory and on disk
+	Delivered     uint64    `json:"delivered"` // Messages delivered
+	Failed        uint64    `json:"failed"`    // Delivery attempts that failed
+	Dropped       uint64    `json:"dropped"`   // Messages given up on: too old, or the queue was full and the new one couldn't be stored
+	LastDelivered time.Time `json:"last_delivered"`
+	LastError     string    `json:"last_error"`
+	LastErrorAt   time.Time `json:"last_error_at"`
+}
+
+type Outbox struct {
+	config Config
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	queue   []Message // In memory, oldest first
+	current *Message  // Being delivered
+	spilled int       // Stored in Dir but not in memory, loaded once the queue is empty
+	seq     uint64
+	stats   Stats
+	closing bool
+
+	closed chan struct{} // Closed by Close, cuts the backoff of a failed message short
+	stop   chan struct{} // Closed when Close gives up waiting
+	done   chan struct{} // Closed when the delivery goroutine ended
+}
+
+// New creates the outbox and starts delivering, messages left in Dir by an earlier run go first
+func New(config Config) (*Outbox, error) {
+	if config.QueueSize <= 0 {
+		config.QueueSize = 100
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = time.Second
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = 5 * time.Minute
+	}
+	config.MaxBackoff = max(config.MaxBackoff, config.MinBackoff)
+
+	o := &Outbox{config: config, closed: make(chan struct{}), stop: make(chan struct{}), done: make(chan struct{})}
+	o.cond = sync.NewCond(&o.mutex)
+	if config.Dir != "" {
+		if err := os.MkdirAll(config.Dir, 0755); err != nil {
+			return nil, err
+		}
+		files, err := o.files()
+		if err != nil {
+			return nil, err
+		}
+		o.spilled = len(files)
+	}
+	go o.run()
+	return o, nil
+}
+
+// Push queues a message without blocking
+func (o *Outbox) Push(message Message) {
+	if message.Created.IsZero() {
+		message.Created = time.Now()
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.config.Dir != "" {
+		if err := o.store(&message); err != nil {
+			o.report(fmt.Errorf("storing %s message: %w", message.Type, err))
+		}
+	}
+
+	// Once messages wait on disk the newer ones queue up behind them
+	if message.file != "" && (o.spilled > 0 || len(o.queue) >= o.config.QueueSize) {
+		o.spilled++
+		o.cond.Signal()
+		return
+	}
+	if len(o.queue) >= o.config.QueueSize {
+		// Only happens with Dir when storing failed, the dropped message must not be loaded again
+		dropped := o.queue[0]
+		o.report(fmt.Errorf("queue full, dropped %s message of %s", dropped.Type, dropped.Created.Format(time.RFC3339)))
+		o.queue = o.queue[1:]
+		o.remove(dropped.file)
+		o.stats.Dropped++
+	}
+	o.queue = append(o.queue, message)
+	o.cond.Signal()
+}
+
+// store writes message to Dir, files are named by creation time so they sort in delivery order
+func (o *Outbox) store(message *Message) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	o.seq++
+	name := fmt.Sprintf("%019d-%06d.json", message.Created.UnixNano(), o.seq%1000000)
+	path := filepath.Join(o.config.Dir, name)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	message.file = name
+	return nil
+}
+
+// files lists the stored messages, oldest first
+func (o *Outbox) files() ([]string, error) {
+	entries, err := os.ReadDir(o.config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			files = append(files, entry.Name())
+		}
+	}
+	return files, nil
+}
+
+// load moves the oldest stored messages into the empty queue, the caller holds mutex
+func (o *Outbox) load() {
+	files, err := o.files()
+	if err != nil {
+		o.report(fmt.Errorf("loading messages: %w", err))
+		o.spilled = 0
+		return
+	}
+	loaded := 0
+	for _, name := range files {
+		if len(o.queue) == o.config.QueueSize {
+			break
+		}
+		loaded++
+		var message Message
+		data, err := os.ReadFile(filepath.Join(o.config.Dir, name))
+		if err == nil {
+			err = json.Unmarshal(data, &message)
+		}
+		if err != nil {
+			o.report(fmt.Errorf("dropping unreadable message %s: %w", name, err))
+			o.remove(name)
+			o.stats.Dropped++
+			continue
+		}
+		message.file = name
+		o.queue = append(o.queue, message)
+	}
+	o.spilled = len(files) - loaded
+}
+
+func (o *Outbox) remove(file string) {
+	if file == "" {
+		return
+	}
+	if err := os.Remove(filepath.Join(o.config.Dir, file)); err != nil && !os.IsNotExist(err) {
+		o.report(fmt.Errorf("removing message %s: %w", file, err))
+	}
+}
+
+func (o *Outbox) report(err error) {
+	if o.config.OnError != nil {
+		o.config.OnError(err)
+	}
+}
+
+func (o *Outbox) run() {
+	defer close(o.done)
+	for {
+		message, ok := o.next()
+		if !ok {
+			return
+		}
+		if !o.deliver(message) {
+			return
+		}
+	}
+}
+
+// next blocks until there is a message, ok is false once the outbox is closing and nothing is left
+func (o *Outbox) next() (message Message, ok bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for {
+		select {
+		case <-o.stop:
+			return message, false
+		default:
+		}
+		if len(o.queue) == 0 && o.spilled > 0 {
+			o.load()
+		}
+		if len(o.queue) > 0 {
+			message = o.queue[0]
+			o.queue = o.queue[1:]
+			o.current = &message
+			return message, true
+		}
+		if o.closing {
+			return message, false
+		}
+		o.cond.Wait()
+	}
+}
+
+// deliver tries message until it is delivered or dropped, false means the outbox is closing and it was kept
+func (o *Outbox) deliver(message Message) bool {
+	backoff := o.config.MinBackoff
+	for {
+		err := o.config.Deliver(message)
+
+		o.mutex.Lock()
+		if err == nil {
+			o.stats.Delivered++
+			o.stats.LastDelivered = time.Now()
+			o.current = nil
+			o.remove(message.file)
+			o.mutex.Unlock()
+			return true
+		}
+		o.stats.Failed++
+		o.stats.LastError = err.Error()
+		o.stats.LastErrorAt = time.Now()
+		if o.config.MaxAge > 0 && time.Since(message.Created) > o.config.MaxAge {
+			o.report(fmt.Errorf("dropped %s message of %s, it couldn't be delivered in %s", message.Type, message.Created.Format(time.RFC3339), o.config.MaxAge))
+			o.stats.Dropped++
+			o.current = nil
+			o.remove(message.file)
+			o.mutex.Unlock()
+			return true
+		}
+		closing := o.closing
+		o.mutex.Unlock()
+		if closing {
+			return false // Kept in Dir for the next start
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-o.closed:
+			return false
+		}
+		backoff = min(2*backoff, o.config.MaxBackoff)
+	}
+}
+
+// Stats returns the delivery counters
+func (o *Outbox) Stats() Stats {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	stats := o.stats
+	stats.Queued = len(o.queue) + o.spilled
+	if o.current != nil {
+		stats.Queued++
+	}
+	return stats
+}
+
+// Close keeps delivering for up to timeout and then stops, at the latest once the running attempt returns. A
+// failure stops it right away. Messages that weren't delivered stay in Dir for the next start, without Dir they
+// are lost. Stats can still be read afterwards. Closing again only waits for the first Close to finish.
+func (o *Outbox) Close(timeout time.Duration) {
+	o.mutex.Lock()
+	if o.closing {
+		o.mutex.Unlock()
+		<-o.done
+		return
+	}
+	o.closing = true
+	o.cond.Broadcast()
+	o.mutex.Unlock()
+	close(o.closed)
+
+	select {
+	case <-o.done:
+	case <-time.After(timeout):
+		close(o.stop)
+		<-o.done
+	}
+}
@@ -0,0 +1,163 @@
+package outbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is a destination that fails while down is set
+type recorder struct {
+	mutex       sync.Mutex
+	down        bool
+	delivered   []string
+	attachments []string
+}
+
+func (r *recorder) deliver(message Message) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.down {
+		return errors.New("down")
+	}
+	r.delivered = append(r.delivered, string(message.Payload))
+	r.attachments = append(r.attachments, string(message.Attachment))
+	return nil
+}
+
+func (r *recorder) setDown(down bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.down = down
+}
+
+func (r *recorder) result() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return strings.Join(r.delivered, " ")
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	for i := 0; !condition(); i++ {
+		if i == 200 {
+			t.Fatal("Timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRetriesInOrder(t *testing.T) {
+	destination := &recorder{down: true}
+	o, err := New(Config{MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond, Deliver: destination.deliver})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer o.Close(time.Second)
+
+	for _, payload := range []string{"a", "b", "c"} {
+		o.Push(Message{Type: "test", Payload: []byte(payload)})
+	}
+	waitFor(t, func() bool { return o.Stats().Failed >= 3 })
+	destination.setDown(false)
+	waitFor(t, func() bool { return o.Stats().Delivered == 3 })
+
+	if destination.result() != "a b c" {
+		t.Errorf("Expected a b c, got %s", destination.result())
+	}
+	if stats := o.Stats(); stats.Queued != 0 || stats.Dropped != 0 || stats.LastError != "down" {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestFullQueueDropsOldest(t *testing.T) {
+	destination := &recorder{down: true}
+	o, _ := New(Config{QueueSize: 2, MinBackoff: time.Hour, Deliver: destination.deliver})
+
+	o.Push(Message{Type: "test", Payload: []byte("a")})
+	waitFor(t, func() bool { return o.Stats().Failed == 1 })
+	for _, payload := range []string{"b", "c", "d"} {
+		o.Push(Message{Type: "test", Payload: []byte(payload)})
+	}
+	o.Close(0)
+
+	// a is stuck retrying, b was pushed out by d
+	if stats := o.Stats(); stats.Queued != 3 || stats.Dropped != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestMessagesSurviveRestarts(t *testing.T) {
+	dir := t.TempDir()
+	destination := &recorder{down: true}
+	config := Config{Dir: dir, QueueSize: 2, MinBackoff: time.Hour, Deliver: destination.deliver}
+	o, err := New(config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, payload := range []string{"a", "b", "c", "d", "e"} {
+		o.Push(Message{Type: "test", Payload: []byte(payload), Attachment: []byte(payload + ".jpg")})
+	}
+	waitFor(t, func() bool { return o.Stats().Failed == 1 })
+	o.Close(0)
+	if stats := o.Stats(); stats.Queued != 5 || stats.Dropped != 0 {
+		t.Errorf("Expected every message to be kept, got %+v", stats)
+	}
+
+	destination.setDown(false)
+	o, err = New(config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer o.Close(time.Second)
+	waitFor(t, func() bool { return o.Stats().Delivered == 5 })
+	if destination.result() != "a b c d e" {
+		t.Errorf("Expected a b c d e, got %s", destination.result())
+	}
+	if attachments := strings.Join(destination.attachments, " "); attachments != "a.jpg b.jpg c.jpg d.jpg e.jpg" {
+		t.Errorf("Expected the attachments to be stored, got %s", attachments)
+	}
+	if files, _ := o.files(); len(files) != 0 {
+		t.Errorf("Expected the delivered messages to be removed, got %v", files)
+	}
+}
+
+func TestFailedStoreDropsStoredMessage(t *testing.T) {
+	dir := t.TempDir()
+	destination := &recorder{down: true}
+	config := Config{Dir: dir, QueueSize: 2, MinBackoff: time.Hour, Deliver: destination.deliver}
+	o, err := New(config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	o.Push(Message{Type: "test", Payload: []byte("a")})
+	waitFor(t, func() bool { return o.Stats().Failed == 1 })
+	o.Push(Message{Type: "test", Payload: []byte("b")})
+	o.Push(Message{Type: "test", Payload: []byte("c")})
+
+	// A folder where the file of d goes makes storing it fail, d pushes b out of the full queue
+	created := time.Now()
+	os.Mkdir(filepath.Join(dir, fmt.Sprintf("%019d-%06d.json.tmp", created.UnixNano(), 4)), 0755)
+	o.Push(Message{Type: "test", Payload: []byte("d"), Created: created})
+	o.Close(0)
+	if stats := o.Stats(); stats.Queued != 3 || stats.Dropped != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	// d only lived in memory, b must not come back
+	destination.setDown(false)
+	o, err = New(config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer o.Close(time.Second)
+	waitFor(t, func() bool { return o.Stats().Delivered == 2 })
+	if destination.result() != "a c" {
+		t.Errorf("Expected a c, got %s", destination.result())
+	}
+}
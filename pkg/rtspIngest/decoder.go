@@ -0,0 +1,16 @@
+//go:build libav
+
+package rtspIngest
+
+import (
+	"github.com/8ff/firescrew/pkg/h264_codec"
+)
+
+func newFrameDecoder() (frameDecoder, error) {
+	return h264_codec.NewH264Decoder()
+}
+
+// Available reports if this build can decode frames in process
+func Available() bool {
+	return true
+}
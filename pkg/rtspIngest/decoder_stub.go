@@ -0,0 +1,12 @@
+//go:build !libav
+
+package rtspIngest
+
+func newFrameDecoder() (frameDecoder, error) {
+	return nil, ErrNoDecoder
+}
+
+// Available reports if this build can decode frames in process
+func Available() bool {
+	return false
+}
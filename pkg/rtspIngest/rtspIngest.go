@@ -0,0 +1,331 @@
+// Package rtspIngest reads a H264 RTSP stream in process with gortsplib.
+// Every access unit is fanned out to a frame decoder (analysis frames) and to a MPEG-TS muxer (recording),
+// so a camera only needs a single connection and no ffmpeg subprocess.
+package rtspIngest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"sync"
+	"time"
+
+	"github.com/8ff/firescrew/pkg/mpeg_codec"
+	"github.com/bluenviron/gortsplib/v3"
+	"github.com/bluenviron/gortsplib/v3/pkg/formats"
+	"github.com/bluenviron/gortsplib/v3/pkg/url"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/pion/rtp"
+)
+
+// ErrNoDecoder is returned when the binary was built without the libav frame decoder
+var ErrNoDecoder = errors.New("native ingest requires a build with -tags libav (libavcodec, libavutil and libswscale)")
+
+type Config struct {
+	Url               string
+	EveryNthFrame     int                     // Only every Nth decoded frame is passed to OnFrame, 1 = every frame
+	PrebufferDuration time.Duration           // How much video is kept in memory and written at the start of every recording
+	OnFrame           func(frame *image.RGBA) // Called with a private copy of every selected frame
+}
+
+// frameDecoder turns H264 NALUs into frames, Decode returns nil until a full frame is available
+type frameDecoder interface {
+	Decode(nalu []byte) (image.Image, error)
+	Close()
+}
+
+type accessUnit struct {
+	nalus [][]byte
+	pts   time.Duration
+	idr   bool
+	time  time.Time
+}
+
+// client is one connection to the camera, see gortsplibClient
+type client interface {
+	// Setup connects and sets up the H264 media, onAccessUnit gets every access unit once playing
+	Setup(onAccessUnit func(au [][]byte, pts time.Duration)) (sps, pps []byte, err error)
+	Play() error
+	Wait() error // Returns when the connection failed or was closed
+	Close()
+}
+
+// Stream is a single RTSP connection shared by analysis and recording
+type Stream struct {
+	config     Config
+	newClient  func(url string) client
+	newDecoder func() (frameDecoder, error)
+
+	mutex     sync.Mutex
+	prebuffer []accessUnit
+	muxer     *mpeg_codec.MpegtsMuxer
+	sps       []byte
+	pps       []byte
+	connected bool          // Run connected again, the next access unit starts new timestamps
+	ptsOffset time.Duration // Added to the timestamps of the connection, so they continue those of the last one
+	lastPTS   time.Duration
+	lastTime  time.Time
+}
+
+func New(config Config) *Stream {
+	if config.EveryNthFrame < 1 {
+		config.EveryNthFrame = 1
+	}
+	return &Stream{config: config, newClient: newGortsplibClient, newDecoder: newFrameDecoder}
+}
+
+// Run connects to the camera and blocks until the stream fails or ctx is done.
+// It can be called again to reconnect, an open recording continues with the new connection.
+func (s *Stream) Run(ctx context.Context) error {
+	decoder, err := s.newDecoder()
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	frameCount := 0
+	stopped := false
+	failed := make(chan error, 1) // The client can't be closed from its own callback, Run closes it
+	c := s.newClient(s.config.Url)
+	sps, pps, err := c.Setup(func(au [][]byte, pts time.Duration) {
+		if stopped {
+			return
+		}
+
+		// Packet payloads are reused by gortsplib, keep a private copy
+		nalus := make([][]byte, len(au))
+		for i, nalu := range au {
+			nalus[i] = append([]byte(nil), nalu...)
+		}
+		s.storeAccessUnit(nalus, pts)
+
+		for _, nalu := range nalus {
+			img, err := decoder.Decode(nalu)
+			if err != nil {
+				stopped = true
+				failed <- err
+				return
+			}
+
+			// wait for a frame
+			if img == nil {
+				continue
+			}
+
+			frameCount++
+			if frameCount%s.config.EveryNthFrame != 0 {
+				continue
+			}
+
+			// The decoder reuses its buffer for the next frame
+			if s.config.OnFrame != nil {
+				s.config.OnFrame(copyFrame(img))
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	s.mutex.Lock()
+	s.sps, s.pps = sps, pps
+	s.prebuffer = nil
+	s.connected = true
+	s.mutex.Unlock()
+
+	// if SPS and PPS are present into the SDP, send them to the decoder
+	if sps != nil {
+		decoder.Decode(sps)
+	}
+	if pps != nil {
+		decoder.Decode(pps)
+	}
+
+	if err := c.Play(); err != nil {
+		return err
+	}
+
+	waited := make(chan error, 1)
+	go func() { waited <- c.Wait() }()
+	select {
+	case err = <-waited:
+	case err = <-failed:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return err
+}
+
+// storeAccessUnit adds an access unit to the prebuffer and writes it to the open recording
+func (s *Stream) storeAccessUnit(nalus [][]byte, pts time.Duration) {
+	now := time.Now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Timestamps start over with every connection, a recording open across a reconnect needs them to go on
+	if s.connected {
+		s.connected = false
+		if !s.lastTime.IsZero() {
+			s.ptsOffset = s.lastPTS + max(now.Sub(s.lastTime), time.Millisecond) - pts // Must increase for the muxer
+		}
+	}
+	pts += s.ptsOffset
+	s.lastPTS, s.lastTime = pts, now
+
+	unit := accessUnit{nalus: nalus, pts: pts, idr: h264.IDRPresent(nalus), time: now}
+	s.prebuffer = append(s.prebuffer, unit)
+
+	// Keep the buffer starting at an IDR that is at least PrebufferDuration old, so recordings start with a decodable frame
+	cut := 0
+	for i := range s.prebuffer {
+		if now.Sub(s.prebuffer[i].time) < s.config.PrebufferDuration {
+			break
+		}
+		if s.prebuffer[i].idr || !s.prebuffer[cut].idr {
+			cut = i
+		}
+	}
+	if cut > 0 {
+		s.prebuffer = append([]accessUnit(nil), s.prebuffer[cut:]...)
+	}
+
+	if s.muxer != nil {
+		s.muxer.EncodeAndStore(unit.nalus, unit.pts)
+	}
+}
+
+// StartRecording opens filename and writes the prebuffer followed by the live stream to it
+func (s *Stream) StartRecording(filename string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.muxer != nil {
+		return nil
+	}
+
+	muxer, err := mpeg_codec.NewMPEGTSMuxer(filename, s.sps, s.pps)
+	if err != nil {
+		return err
+	}
+
+	// Write prebuffered data
+	for _, unit := range s.prebuffer {
+		if err := muxer.EncodeAndStore(unit.nalus, unit.pts); err != nil {
+			muxer.Close()
+			return err
+		}
+	}
+
+	s.muxer = muxer
+	return nil
+}
+
+// StopRecording flushes and closes the open recording, if any
+func (s *Stream) StopRecording() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.muxer != nil {
+		s.muxer.Close()
+		s.muxer = nil
+	}
+}
+
+// gortsplibClient reads the H264 media of an RTSP URL over TCP
+type gortsplibClient struct {
+	url    string
+	client gortsplib.Client
+}
+
+func newGortsplibClient(address string) client {
+	return &gortsplibClient{url: address}
+}
+
+func (g *gortsplibClient) Setup(onAccessUnit func(au [][]byte, pts time.Duration)) ([]byte, []byte, error) {
+	u, err := url.Parse(g.url)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	transport := gortsplib.TransportTCP
+	g.client.Transport = &transport
+	err = g.client.Start(u.Scheme, u.Host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sps, pps, err := g.setup(u, onAccessUnit)
+	if err != nil {
+		g.client.Close()
+		return nil, nil, err
+	}
+	return sps, pps, nil
+}
+
+func (g *gortsplibClient) setup(u *url.URL, onAccessUnit func(au [][]byte, pts time.Duration)) ([]byte, []byte, error) {
+	// find published medias
+	medias, baseURL, _, err := g.client.Describe(u)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// find the H264 media and format
+	var forma *formats.H264
+	medi := medias.FindFormat(&forma)
+	if medi == nil {
+		return nil, nil, fmt.Errorf("no H264 media found at %s", g.url)
+	}
+
+	// setup RTP/H264 -> H264 decoder
+	rtpDec, err := forma.CreateDecoder2()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, err = g.client.Setup(medi, baseURL, 0, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	g.client.OnPacketRTP(medi, forma, func(pkt *rtp.Packet) {
+		// extract access unit from RTP packets
+		// DecodeUntilMarker is necessary for the DTS extractor of the muxer to work
+		au, pts, err := rtpDec.DecodeUntilMarker(pkt)
+		if err != nil {
+			return // Waiting for more packets or a packet was lost, both recover on their own
+		}
+		onAccessUnit(au, pts)
+	})
+	return forma.SPS, forma.PPS, nil
+}
+
+func (g *gortsplibClient) Play() error {
+	_, err := g.client.Play(nil)
+	return err
+}
+
+func (g *gortsplibClient) Wait() error {
+	return g.client.Wait()
+}
+
+func (g *gortsplibClient) Close() {
+	g.client.Close()
+}
+
+func copyFrame(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok {
+		return &image.RGBA{
+			Pix:    append([]uint8(nil), rgba.Pix...),
+			Stride: rgba.Stride,
+			Rect:   rgba.Rect,
+		}
+	}
+
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba
+}
@@ -0,0 +1,162 @@
+package rtspIngest
+
+import (
+	"context"
+	"errors"
+	"image"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asticode/go-astits"
+)
+
+// fakeClient stands in for the camera, the test sends the access units
+type fakeClient struct {
+	onAccessUnit func(au [][]byte, pts time.Duration)
+	playing      chan struct{}
+	closed       chan struct{}
+	once         sync.Once
+}
+
+func (c *fakeClient) Setup(onAccessUnit func(au [][]byte, pts time.Duration)) ([]byte, []byte, error) {
+	c.onAccessUnit = onAccessUnit
+	return nil, nil, nil
+}
+
+func (c *fakeClient) Play() error {
+	close(c.playing)
+	return nil
+}
+
+func (c *fakeClient) Wait() error {
+	<-c.closed
+	return errors.New("connection lost")
+}
+
+func (c *fakeClient) Close() {
+	c.once.Do(func() { close(c.closed) })
+}
+
+type fakeDecoder struct {
+	err error
+}
+
+func (d fakeDecoder) Decode(nalu []byte) (image.Image, error) {
+	return nil, d.err
+}
+
+func (d fakeDecoder) Close() {}
+
+// Every access unit is a keyframe, so the muxer takes its timestamps as they are
+var keyframe = [][]byte{
+	{0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78, 0x02, 0x27, 0xe5, 0x84, 0x00, 0x00, 0x03, 0x00,
+		0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc6, 0x58}, // SPS
+	{0x68, 0xee, 0x3c, 0x80},             // PPS
+	{0x65, 0x88, 0x84, 0x00, 0x33, 0xff}, // IDR
+}
+
+func newTestStream(decoder fakeDecoder) (*Stream, chan *fakeClient) {
+	stream := New(Config{Url: "rtsp://camera/stream"})
+	stream.newDecoder = func() (frameDecoder, error) { return decoder, nil }
+	clients := make(chan *fakeClient, 1)
+	stream.newClient = func(string) client {
+		c := &fakeClient{playing: make(chan struct{}), closed: make(chan struct{})}
+		clients <- c
+		return c
+	}
+	return stream, clients
+}
+
+func TestRecordingSurvivesReconnect(t *testing.T) {
+	stream, clients := newTestStream(fakeDecoder{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	run := func() (*fakeClient, chan error) {
+		done := make(chan error, 1)
+		go func() { done <- stream.Run(ctx) }()
+		c := <-clients
+		<-c.playing
+		return c, done
+	}
+	send := func(c *fakeClient) {
+		for i := 0; i < 3; i++ {
+			c.onAccessUnit(keyframe, time.Duration(i)*40*time.Millisecond)
+		}
+	}
+
+	filename := filepath.Join(t.TempDir(), "clip.ts")
+	first, done := run()
+	if err := stream.StartRecording(filename); err != nil {
+		t.Fatalf("Unexpected error starting the recording: %v", err)
+	}
+	send(first)
+
+	// The connection drops, the camera reconnects and its timestamps start over
+	first.Close()
+	if err := <-done; err == nil {
+		t.Fatal("Expected Run to report the lost connection")
+	}
+	second, done := run()
+	send(second)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected Run to stop with ctx, got %v", err)
+	}
+	stream.StopRecording()
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatalf("Unexpected error opening the recording: %v", err)
+	}
+	defer f.Close()
+	var timestamps []int64
+	demuxer := astits.NewDemuxer(context.Background(), f)
+	for {
+		data, err := demuxer.NextData()
+		if errors.Is(err, astits.ErrNoMorePackets) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error reading the recording: %v", err)
+		}
+		if data.PES != nil {
+			timestamps = append(timestamps, data.PES.Header.OptionalHeader.PTS.Base)
+		}
+	}
+	if len(timestamps) != 6 {
+		t.Fatalf("Expected both connections in the recording, got %d frames", len(timestamps))
+	}
+	for i := 1; i < len(timestamps); i++ {
+		if timestamps[i] <= timestamps[i-1] {
+			t.Errorf("Expected the timestamps to go on after the reconnect, got %v", timestamps)
+			break
+		}
+	}
+}
+
+func TestDecodeErrorStopsRun(t *testing.T) {
+	stream, clients := newTestStream(fakeDecoder{err: errors.New("broken frame")})
+	done := make(chan error, 1)
+	go func() { done <- stream.Run(context.Background()) }()
+	c := <-clients
+	<-c.playing
+
+	c.onAccessUnit(keyframe, 0)
+	c.onAccessUnit(keyframe, 40*time.Millisecond) // Ignored once the stream failed
+	select {
+	case err := <-done:
+		if err == nil || err.Error() != "broken frame" {
+			t.Errorf("Expected the decode error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Run to return after the decode error")
+	}
+	select {
+	case <-c.closed:
+	default:
+		t.Error("Expected Run to close the connection")
+	}
+}
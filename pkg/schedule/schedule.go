@@ -0,0 +1,148 @@
+// Package schedule tells if a point in time falls into weekly time windows, eg: weekdays from 09:00 to 17:00
+// plus every night from 22:00 to 06:00. Windows are evaluated in the timezone of the schedule.
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // Timezones work in containers without a zoneinfo database
+)
+
+// Window is a time range on some days of the week. A window that ends before it starts runs over midnight,
+// the part after midnight belongs to the day it started on.
+type Window struct {
+	Days  []string `json:"days"`  // mon, tue, wed, thu, fri, sat, sun, weekdays, weekends or daily. Empty is daily
+	Start string   `json:"start"` // HH:MM, empty is 00:00
+	End   string   `json:"end"`   // HH:MM, empty or 24:00 is the end of the day
+}
+
+type Config struct {
+	Timezone string   `json:"timezone"` // IANA name, eg: Europe/Berlin. Empty uses the local time of the host
+	Windows  []Window `json:"windows"`  // The schedule is active during any of them
+}
+
+type Schedule struct {
+	location *time.Location
+	windows  []window
+}
+
+type window struct {
+	days       [7]bool // By time.Weekday
+	start, end int     // Minutes since midnight
+}
+
+var dayNames = map[string][]time.Weekday{
+	"sun":      {time.Sunday},
+	"mon":      {time.Monday},
+	"tue":      {time.Tuesday},
+	"wed":      {time.Wednesday},
+	"thu":      {time.Thursday},
+	"fri":      {time.Friday},
+	"sat":      {time.Saturday},
+	"weekdays": {time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	"weekends": {time.Saturday, time.Sunday},
+	"daily":    {time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday},
+}
+
+// Problem is something wrong with a Config, Path is relative to the config, eg: windows[1].start
+type Problem struct {
+	Path    string
+	Message string
+}
+
+func (p Problem) Error() string {
+	return p.Path + ": " + p.Message
+}
+
+// New checks config and prepares it for Active, the error is the first problem Check finds
+func New(config Config) (*Schedule, error) {
+	s, problems := parse(config)
+	if len(problems) > 0 {
+		return nil, problems[0]
+	}
+	return s, nil
+}
+
+// Check returns every problem of config
+func Check(config Config) []Problem {
+	_, problems := parse(config)
+	return problems
+}
+
+func parse(config Config) (*Schedule, []Problem) {
+	var problems []Problem
+	location, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		problems = append(problems, Problem{"timezone", fmt.Sprintf("unknown timezone %q", config.Timezone)})
+	}
+
+	s := &Schedule{location: location}
+	for i, w := range config.Windows {
+		path := fmt.Sprintf("windows[%d]", i)
+		var parsed window
+		days := w.Days
+		if len(days) == 0 {
+			days = []string{"daily"}
+		}
+		for _, day := range days {
+			weekdays, ok := dayNames[strings.ToLower(day)]
+			if !ok {
+				problems = append(problems, Problem{path + ".days", fmt.Sprintf("unknown day %q, expected mon..sun, weekdays, weekends or daily", day)})
+			}
+			for _, weekday := range weekdays {
+				parsed.days[weekday] = true
+			}
+		}
+
+		var errStart, errEnd error
+		if parsed.start, errStart = parseClock(w.Start, 0); errStart != nil {
+			problems = append(problems, Problem{path + ".start", errStart.Error()})
+		}
+		if parsed.end, errEnd = parseClock(w.End, 24*60); errEnd != nil {
+			problems = append(problems, Problem{path + ".end", errEnd.Error()})
+		}
+		if errStart == nil && errEnd == nil && parsed.start == parsed.end {
+			problems = append(problems, Problem{path, "starts and ends at the same time"})
+		}
+		s.windows = append(s.windows, parsed)
+	}
+	return s, problems
+}
+
+// Active reports if t falls into one of the windows
+func (s *Schedule) Active(t time.Time) bool {
+	t = t.In(s.location)
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+
+	for _, w := range s.windows {
+		if w.start < w.end {
+			if w.days[today] && minute >= w.start && minute < w.end {
+				return true
+			}
+			continue
+		}
+		// Runs over midnight
+		if (w.days[today] && minute >= w.start) || (w.days[yesterday] && minute < w.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseClock turns HH:MM into minutes since midnight
+func parseClock(value string, empty int) (int, error) {
+	if value == "" {
+		return empty, nil
+	}
+	hours, minutes, ok := strings.Cut(value, ":")
+	h, errH := strconv.Atoi(hours)
+	m, errM := strconv.Atoi(minutes)
+	if !ok || errH != nil || errM != nil || h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("expected HH:MM, got %q", value)
+	}
+	return h*60 + m, nil
+}
@@ -0,0 +1,72 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindows(t *testing.T) {
+	s, err := New(Config{Timezone: "America/New_York", Windows: []Window{
+		{Days: []string{"weekdays"}, Start: "09:00", End: "17:00"},
+		{Days: []string{"fri", "sat"}, Start: "22:00", End: "06:00"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newYork, _ := time.LoadLocation("America/New_York")
+	tests := []struct {
+		time   time.Time
+		active bool
+	}{
+		{time.Date(2023, 8, 14, 9, 0, 0, 0, newYork), true},   // Monday
+		{time.Date(2023, 8, 14, 16, 59, 0, 0, newYork), true}, // Monday
+		{time.Date(2023, 8, 14, 17, 0, 0, 0, newYork), false}, // Monday, the end is not part of the window
+		{time.Date(2023, 8, 19, 12, 0, 0, 0, newYork), false}, // Saturday
+		{time.Date(2023, 8, 18, 23, 0, 0, 0, newYork), true},  // Friday night
+		{time.Date(2023, 8, 19, 5, 59, 0, 0, newYork), true},  // Still Friday night
+		{time.Date(2023, 8, 20, 3, 0, 0, 0, newYork), true},   // Saturday night
+		{time.Date(2023, 8, 21, 3, 0, 0, 0, newYork), false},  // Sunday night isn't listed
+		{time.Date(2023, 8, 14, 13, 0, 0, 0, time.UTC), true}, // 09:00 in New York
+	}
+	for _, test := range tests {
+		if active := s.Active(test.time); active != test.active {
+			t.Errorf("%s: expected %v, got %v", test.time, test.active, active)
+		}
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	tests := map[string]Config{
+		`timezone: unknown timezone "Mars/Olympus"`:                                              {Timezone: "Mars/Olympus"},
+		`windows[0].days: unknown day "someday", expected mon..sun, weekdays, weekends or daily`: {Windows: []Window{{Days: []string{"someday"}}}},
+		`windows[0].start: expected HH:MM, got "25:00"`:                                          {Windows: []Window{{Start: "25:00"}}},
+		`windows[1]: starts and ends at the same time`:                                           {Windows: []Window{{}, {Start: "08:00", End: "08:00"}}},
+	}
+	for expected, config := range tests {
+		if _, err := New(config); err == nil || err.Error() != expected {
+			t.Errorf("Expected %s, got %v", expected, err)
+		}
+	}
+}
+
+func TestCheckReportsEveryProblem(t *testing.T) {
+	problems := Check(Config{Timezone: "Mars/Olympus", Windows: []Window{
+		{Days: []string{"mon", "someday"}, Start: "8"},
+		{Start: "09:00", End: "24:30"},
+	}})
+	expected := []string{
+		`timezone: unknown timezone "Mars/Olympus"`,
+		`windows[0].days: unknown day "someday", expected mon..sun, weekdays, weekends or daily`,
+		`windows[0].start: expected HH:MM, got "8"`,
+		`windows[1].end: expected HH:MM, got "24:30"`,
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got %v", len(expected), problems)
+	}
+	for i, problem := range problems {
+		if problem.Error() != expected[i] {
+			t.Errorf("Expected %s, got %s", expected[i], problem.Error())
+		}
+	}
+}
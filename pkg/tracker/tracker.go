@@ -0,0 +1,358 @@
+// Package tracker follows detected objects across frames and gives each one a persistent track ID (SORT style).
+// Every track predicts where its box moves with a constant velocity Kalman filter, detections are matched to
+// the predictions of tracks of the same class by IoU, highest first. At low analysis fps boxes may not overlap
+// between frames, detections left over after that can match the closest track within a center distance.
+//
+// Tracks whose box stays put become static, like a parked car. Detection may not run while nothing moves, so
+// tracks that settled are kept much longer than others and are matched again when the object is seen in place.
+package tracker
+
+import (
+	"image"
+	"math"
+	"sort"
+	"time"
+)
+
+type Config struct {
+	IouThreshold float64       // Minimum IoU between a detection and a predicted box to match. Default 0.3
+	MaxDistance  float64       // Unmatched detections match a track whose center is closer than this, in pixels. 0 disables it
+	MaxAreaDiff  float64       // And whose area differs less than this, in pixels. 0 doesn't check the area
+	MaxAge       time.Duration // Tracks without a detection for this long are dropped. Default 30s
+	StaticAfter  time.Duration // Tracks whose box stays put this long become static. Default 5m
+	StaticMaxAge time.Duration // Tracks that settled are dropped after this long without a detection. Default 24h
+	StillIou     float64       // Minimum IoU of a detection with the box where the track settled to count as staying put. Default 0.7
+}
+
+// Tracks that stayed put at least this long are kept for StaticMaxAge, they may be parking
+var settleTime = 10 * time.Second
+
+type Detection struct {
+	Box        image.Rectangle
+	Class      string
+	Confidence float32
+}
+
+type Track struct {
+	ID         int
+	Class      string
+	Box        image.Rectangle // Last detection
+	Confidence float32
+	Hits       int // Detections matched to the track
+	Age        int // Updates since the track was created
+	Misses     int // Updates in a row without a detection
+	FirstSeen  time.Time
+	LastSeen   time.Time
+	Static     bool      // The box stayed put for StaticAfter
+	StillSince time.Time // Since when the box stays put
+
+	filters [4]kalman       // Center x, center y, width, height
+	updated time.Time       // Time the filters are at
+	anchor  image.Rectangle // Box when it started staying put
+}
+
+// Tracker is not safe for concurrent use
+type Tracker struct {
+	config Config
+	tracks []*Track
+	nextID int
+}
+
+func New(config Config) *Tracker {
+	t := &Tracker{}
+	t.SetConfig(config)
+	return t
+}
+
+// SetConfig changes the config, running tracks are kept
+func (t *Tracker) SetConfig(config Config) {
+	if config.IouThreshold <= 0 || config.IouThreshold > 1 {
+		config.IouThreshold = 0.3
+	}
+	if config.MaxAge <= 0 {
+		config.MaxAge = 30 * time.Second
+	}
+	if config.StaticAfter <= 0 {
+		config.StaticAfter = 5 * time.Minute
+	}
+	if config.StaticMaxAge <= 0 {
+		config.StaticMaxAge = 24 * time.Hour
+	}
+	if config.StillIou <= 0 || config.StillIou > 1 {
+		config.StillIou = 0.7
+	}
+	t.config = config
+}
+
+// Update matches the detections of a frame taken at now to the tracks and returns the track of every detection,
+// in the same order. Detections that don't match a track start a new one.
+func (t *Tracker) Update(detections []Detection, now time.Time) []Track {
+	// Drop expired tracks
+	alive := t.tracks[:0]
+	for _, track := range t.tracks {
+		maxAge := t.config.MaxAge
+		if track.settled() {
+			maxAge = max(maxAge, t.config.StaticMaxAge)
+		}
+		if now.Sub(track.LastSeen) <= maxAge {
+			alive = append(alive, track)
+		}
+	}
+	t.tracks = alive
+
+	predicted := make([]image.Rectangle, len(t.tracks))
+	for i, track := range t.tracks {
+		predicted[i] = track.predict(now)
+		track.Age++
+	}
+
+	matches := make([]*Track, len(detections))
+	matched := make(map[*Track]bool)
+
+	// Pairs of the same class by IoU, highest first
+	type pair struct {
+		detection int
+		track     int
+		score     float64
+	}
+	var pairs []pair
+	for d, detection := range detections {
+		for i, track := range t.tracks {
+			if track.Class != detection.Class {
+				continue
+			}
+			// A settled track that wasn't seen for a while is only continued by a detection in the same place
+			threshold := t.config.IouThreshold
+			if now.Sub(track.LastSeen) > t.config.MaxAge {
+				threshold = max(threshold, t.config.StillIou)
+			}
+			if iou := IoU(detection.Box, predicted[i]); iou >= threshold {
+				pairs = append(pairs, pair{d, i, iou})
+			}
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].score > pairs[j].score })
+	for _, p := range pairs {
+		if matches[p.detection] == nil && !matched[t.tracks[p.track]] {
+			matches[p.detection] = t.tracks[p.track]
+			matched[t.tracks[p.track]] = true
+		}
+	}
+
+	// Left over detections by center distance, closest first
+	if t.config.MaxDistance > 0 {
+		pairs = pairs[:0]
+		for d, detection := range detections {
+			if matches[d] != nil {
+				continue
+			}
+			for i, track := range t.tracks {
+				if track.Class != detection.Class || matched[track] || now.Sub(track.LastSeen) > t.config.MaxAge {
+					continue
+				}
+				if t.config.MaxAreaDiff > 0 && math.Abs(area(detection.Box)-area(predicted[i])) >= t.config.MaxAreaDiff {
+					continue
+				}
+				if distance := centerDistance(detection.Box, predicted[i]); distance < t.config.MaxDistance {
+					pairs = append(pairs, pair{d, i, distance})
+				}
+			}
+		}
+		sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].score < pairs[j].score })
+		for _, p := range pairs {
+			if matches[p.detection] == nil && !matched[t.tracks[p.track]] {
+				matches[p.detection] = t.tracks[p.track]
+				matched[t.tracks[p.track]] = true
+			}
+		}
+	}
+
+	for _, track := range t.tracks {
+		if !matched[track] {
+			track.Misses++
+		}
+	}
+
+	result := make([]Track, len(detections))
+	for d, detection := range detections {
+		track := matches[d]
+		if track == nil {
+			t.nextID++
+			track = newTrack(t.nextID, detection, now)
+			t.tracks = append(t.tracks, track)
+		} else {
+			track.correct(detection, now, t.config)
+		}
+		result[d] = *track
+	}
+	return result
+}
+
+// Tracks returns the tracks that haven't expired
+func (t *Tracker) Tracks() []Track {
+	tracks := make([]Track, len(t.tracks))
+	for i, track := range t.tracks {
+		tracks[i] = *track
+	}
+	return tracks
+}
+
+// Has reports if the track with id is still followed
+func (t *Tracker) Has(id int) bool {
+	for _, track := range t.tracks {
+		if track.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func newTrack(id int, detection Detection, now time.Time) *Track {
+	track := &Track{
+		ID:         id,
+		Class:      detection.Class,
+		Box:        detection.Box,
+		Confidence: detection.Confidence,
+		Hits:       1,
+		FirstSeen:  now,
+		LastSeen:   now,
+		StillSince: now,
+		updated:    now,
+		anchor:     detection.Box,
+	}
+
+	track.resetFilters(detection.Box)
+	return track
+}
+
+// resetFilters starts the filters at box with an unknown velocity
+func (track *Track) resetFilters(box image.Rectangle) {
+	// Noise scales with the object size, a box is measured within a few percent and may move about half its size per second
+	size := math.Max(float64(max(box.Dx(), box.Dy())), 1)
+	for i, value := range boxState(box) {
+		track.filters[i] = newKalman(value, size)
+	}
+}
+
+// settled reports if the box stayed put long enough that the object may be parking
+func (track *Track) settled() bool {
+	return track.Static || track.LastSeen.Sub(track.StillSince) >= settleTime
+}
+
+// predict moves the filters to now and returns the predicted box. Settled tracks are expected where they are,
+// small velocities would add up over the long gaps between their detections.
+func (track *Track) predict(now time.Time) image.Rectangle {
+	if track.settled() {
+		track.updated = now
+		return track.Box
+	}
+	dt := now.Sub(track.updated).Seconds()
+	if dt > 0 {
+		for i := range track.filters {
+			track.filters[i].predict(dt)
+		}
+		track.updated = now
+	}
+	return stateBox(track.filters[0].position, track.filters[1].position, track.filters[2].position, track.filters[3].position)
+}
+
+func (track *Track) correct(detection Detection, now time.Time, config Config) {
+	still := IoU(detection.Box, track.anchor) >= config.StillIou
+	if !still && track.settled() {
+		track.resetFilters(detection.Box) // Moving again, the filters stood still while the track was settled
+	} else {
+		for i, value := range boxState(detection.Box) {
+			track.filters[i].correct(value)
+		}
+	}
+
+	if still {
+		track.Static = track.Static || now.Sub(track.StillSince) >= config.StaticAfter
+	} else {
+		track.anchor = detection.Box
+		track.StillSince = now
+		track.Static = false
+	}
+	track.Box = detection.Box
+	track.Confidence = detection.Confidence
+	track.Hits++
+	track.Misses = 0
+	track.LastSeen = now
+}
+
+func boxState(box image.Rectangle) [4]float64 {
+	return [4]float64{
+		float64(box.Min.X+box.Max.X) / 2,
+		float64(box.Min.Y+box.Max.Y) / 2,
+		float64(box.Dx()),
+		float64(box.Dy()),
+	}
+}
+
+func stateBox(x, y, width, height float64) image.Rectangle {
+	width, height = math.Max(width, 1), math.Max(height, 1)
+	return image.Rect(int(math.Round(x-width/2)), int(math.Round(y-height/2)), int(math.Round(x+width/2)), int(math.Round(y+height/2)))
+}
+
+// IoU is the intersection over union of two boxes
+func IoU(a, b image.Rectangle) float64 {
+	intersection := area(a.Intersect(b))
+	if intersection == 0 {
+		return 0
+	}
+	return intersection / (area(a) + area(b) - intersection)
+}
+
+func area(box image.Rectangle) float64 {
+	return float64(box.Dx() * box.Dy())
+}
+
+func centerDistance(a, b image.Rectangle) float64 {
+	return math.Hypot(float64(a.Min.X+a.Max.X-b.Min.X-b.Max.X)/2, float64(a.Min.Y+a.Max.Y-b.Min.Y-b.Max.Y)/2)
+}
+
+// kalman is a constant velocity Kalman filter of a single value
+type kalman struct {
+	position, velocity float64
+	p                  [2][2]float64 // Covariance
+	q                  float64       // Process noise, acceleration variance
+	r                  float64       // Measurement noise variance
+}
+
+func newKalman(value, size float64) kalman {
+	k := kalman{
+		position: value,
+		q:        (0.5 * size) * (0.5 * size),
+		r:        (0.05 * size) * (0.05 * size),
+	}
+	k.p = [2][2]float64{{k.r, 0}, {0, size * size}} // The velocity is unknown
+	return k
+}
+
+func (k *kalman) predict(dt float64) {
+	k.position += k.velocity * dt
+
+	// P = F P F' + Q
+	p00 := k.p[0][0] + dt*(k.p[1][0]+k.p[0][1]) + dt*dt*k.p[1][1]
+	p01 := k.p[0][1] + dt*k.p[1][1]
+	p10 := k.p[1][0] + dt*k.p[1][1]
+	p11 := k.p[1][1]
+	k.p = [2][2]float64{
+		{p00 + k.q*dt*dt*dt/3, p01 + k.q*dt*dt/2},
+		{p10 + k.q*dt*dt/2, p11 + k.q*dt},
+	}
+}
+
+func (k *kalman) correct(value float64) {
+	s := k.p[0][0] + k.r
+	gain0, gain1 := k.p[0][0]/s, k.p[1][0]/s
+	residual := value - k.position
+	k.position += gain0 * residual
+	k.velocity += gain1 * residual
+
+	// P = (I - K H) P
+	k.p = [2][2]float64{
+		{(1 - gain0) * k.p[0][0], (1 - gain0) * k.p[0][1]},
+		{k.p[1][0] - gain1*k.p[0][0], k.p[1][1] - gain1*k.p[0][1]},
+	}
+}
@@ -0,0 +1,106 @@
+package tracker
+
+import (
+	"image"
+	"testing"
+	"time"
+)
+
+func TestStationaryObjectKeepsItsTrack(t *testing.T) {
+	tr := New(Config{})
+	now := time.Unix(0, 0)
+
+	var first []Track
+	for i := 0; i < 20; i++ {
+		tracks := tr.Update([]Detection{
+			{Box: image.Rect(100+i%2, 100, 200, 160), Class: "car", Confidence: 0.8},
+			{Box: image.Rect(110, 100, 200, 160), Class: "truck", Confidence: 0.5}, // Same box, other class
+		}, now.Add(time.Duration(i)*time.Second))
+		if i == 0 {
+			first = tracks
+			continue
+		}
+		if tracks[0].ID != first[0].ID || tracks[1].ID != first[1].ID {
+			t.Fatalf("Frame %d: tracks changed from %d/%d to %d/%d", i, first[0].ID, first[1].ID, tracks[0].ID, tracks[1].ID)
+		}
+	}
+	if first[0].ID == first[1].ID {
+		t.Error("Different classes must not share a track")
+	}
+	if tracks := tr.Tracks(); tracks[0].Hits != 20 || tracks[0].Age != 19 {
+		t.Errorf("Expected 20 hits over 19 updates, got %d/%d", tracks[0].Hits, tracks[0].Age)
+	}
+}
+
+func TestCrossingPathsKeepIdentity(t *testing.T) {
+	tr := New(Config{})
+	now := time.Unix(0, 0)
+
+	// Two people walking towards each other, they overlap in the middle
+	var left, right int
+	for i := 0; i <= 10; i++ {
+		x := i * 20
+		tracks := tr.Update([]Detection{
+			{Box: image.Rect(x, 100, x+40, 200), Class: "person"},
+			{Box: image.Rect(200-x, 110, 240-x, 210), Class: "person"},
+		}, now.Add(time.Duration(i)*200*time.Millisecond))
+		if i == 0 {
+			left, right = tracks[0].ID, tracks[1].ID
+			continue
+		}
+		if tracks[0].ID != left || tracks[1].ID != right {
+			t.Fatalf("Step %d: identities swapped, expected %d/%d, got %d/%d", i, left, right, tracks[0].ID, tracks[1].ID)
+		}
+	}
+}
+
+func TestExpiryAndDistanceFallback(t *testing.T) {
+	tr := New(Config{MaxAge: 5 * time.Second, MaxDistance: 100})
+	now := time.Unix(0, 0)
+
+	id := tr.Update([]Detection{{Box: image.Rect(0, 0, 20, 40), Class: "person"}}, now)[0].ID
+
+	// One analysed frame per 2s, the boxes don't overlap anymore
+	next := tr.Update([]Detection{{Box: image.Rect(60, 0, 80, 40), Class: "person"}}, now.Add(2*time.Second))
+	if next[0].ID != id {
+		t.Errorf("Expected the close detection to continue track %d, got %d", id, next[0].ID)
+	}
+
+	later := tr.Update([]Detection{{Box: image.Rect(60, 0, 80, 40), Class: "person"}}, now.Add(10*time.Second))
+	if later[0].ID == id || tr.Has(id) {
+		t.Error("Expected the track to expire after MaxAge")
+	}
+}
+
+func TestParkedCarBecomesStatic(t *testing.T) {
+	tr := New(Config{StaticAfter: time.Minute})
+	now := time.Unix(0, 0)
+
+	// Parks and is seen for a while, then detection stops because nothing moves
+	var id int
+	for i := 0; i <= 15; i++ {
+		track := tr.Update([]Detection{{Box: image.Rect(100+i%3, 100, 300, 200), Class: "car"}}, now.Add(time.Duration(i)*time.Second))[0]
+		id = track.ID
+		if track.Static {
+			t.Fatalf("Second %d: static too early", i)
+		}
+	}
+	// A person stopping for a moment isn't kept
+	tr.Update([]Detection{{Box: image.Rect(400, 100, 420, 150), Class: "person"}}, now.Add(16*time.Second))
+
+	// Someone walks by an hour later
+	later := now.Add(time.Hour)
+	track := tr.Update([]Detection{{Box: image.Rect(101, 101, 300, 200), Class: "car"}}, later)[0]
+	if track.ID != id || !track.Static {
+		t.Fatalf("Expected track %d to continue as static, got %+v", id, track)
+	}
+	if len(tr.Tracks()) != 1 {
+		t.Errorf("Expected only the car to be kept, got %d tracks", len(tr.Tracks()))
+	}
+
+	// Drives off
+	track = tr.Update([]Detection{{Box: image.Rect(160, 100, 360, 200), Class: "car"}}, later.Add(time.Second))[0]
+	if track.ID != id || track.Static {
+		t.Errorf("Expected track %d to move on, got %+v", id, track)
+	}
+}